@@ -4,17 +4,16 @@ go 1.12
 
 require (
 	github.com/agnivade/levenshtein v1.0.3
-	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
+	github.com/containerd/containerd v1.7.2
+	github.com/docker/cli v24.0.4+incompatible
+	github.com/docker/distribution v2.8.2+incompatible
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/gdamore/tcell v1.3.0
-	github.com/kr/pretty v0.2.0 // indirect
 	github.com/lucasb-eyer/go-colorful v1.0.3 // indirect
-	github.com/mattn/go-runewidth v0.0.9 // indirect
+	github.com/moby/buildkit v0.12.5
+	github.com/moby/patternmatcher v0.5.0
 	github.com/pkg/errors v0.9.1
-	github.com/urfave/cli v1.22.4
-	golang.org/x/sync v0.0.0-20200317015054-43a5402ce75a
-	golang.org/x/sys v0.0.0-20200413165638-669c56c373c4 // indirect
-	golang.org/x/text v0.3.2 // indirect
-	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
-	gopkg.in/yaml.v2 v2.2.8
+	github.com/urfave/cli v1.22.12
+	golang.org/x/sync v0.1.0
+	gopkg.in/yaml.v2 v2.4.0
 )
-
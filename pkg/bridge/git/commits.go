@@ -0,0 +1,51 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+//GetHeadCommit returns the hash of the HEAD commit of the git repository which contains dir
+func GetHeadCommit(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", "HEAD")
+	cmd.Dir = dir
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			if _, err := GetGitRoot(dir); err != nil {
+				return "", ErrNotGitRepository
+			}
+			return "", ErrNoCommits
+		}
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+//GetTree returns the root of the git repository which contains rootDir, and the hash of its tree:
+//the currently commited files, as well as any unstaged changes in the provided directories
+func GetTree(rootDir string, unstagedFiles ...string) (gitRoot string, treeHash string, err error) {
+	return writeTree(rootDir, unstagedFiles...)
+}
+
+//DescribeCommit returns the tree hash of a commit in the git repository which contains dir, and its subject
+//(the first line of its message)
+func DescribeCommit(dir, commit string) (treeHash string, subject string, err error) {
+	cmd := exec.Command("git", "show", "--no-patch", "--format=%T%n%s", commit, "--")
+	cmd.Dir = dir
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return "", "", fmt.Errorf("could not find the commit %s: %s", commit, strings.TrimSpace(stderr.String()))
+	}
+	lines := strings.SplitN(strings.TrimSpace(stdout.String()), "\n", 2)
+	if len(lines) == 2 {
+		subject = lines[1]
+	}
+	return lines[0], subject, nil
+}
@@ -0,0 +1,60 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+//mergeBase returns the commit where HEAD and ref diverged
+func mergeBase(gitRoot, ref string) (string, error) {
+	cmd := exec.Command("git", "merge-base", ref, "HEAD")
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Dir = gitRoot
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("could not find where HEAD diverged from %s (if this is a shallow clone, fetch more history): %s",
+			ref, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+//ChangedFilesSince returns the absolute paths of the files beneath rootDir which changed since HEAD diverged
+//from ref (like "git diff ref...", e.g., for ref origin/main on a branch), including uncommitted and untracked files.
+//Deleted files are included as well.
+func ChangedFilesSince(rootDir, ref string) ([]string, error) {
+	gitRoot, treeHash, err := writeTree(rootDir, rootDir)
+	if err != nil {
+		return nil, err
+	}
+	base, err := mergeBase(gitRoot, ref)
+	if err != nil {
+		return nil, err
+	}
+	relRoot, err := filepath.Rel(gitRoot, rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("git", "diff-tree", "-r", "-z", "--name-only", base, treeHash, "--", filepath.ToSlash(relRoot))
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Dir = gitRoot
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("could not list the files changed since %s: %s", ref, strings.TrimSpace(stderr.String()))
+	}
+
+	var changedFiles []string
+	for _, file := range strings.Split(stdout.String(), "\x00") {
+		if file != "" {
+			changedFiles = append(changedFiles, filepath.Join(gitRoot, filepath.FromSlash(file)))
+		}
+	}
+	return changedFiles, nil
+}
@@ -2,10 +2,12 @@ package git
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
@@ -51,55 +53,132 @@ func GetGitRoot(dir string) (string, error) {
 	return strings.TrimSpace(stdout.String()), nil
 }
 
-//GetCurrentTreeHash returns a hash of the git repository, consisting of the currently
-//commited files, as well as any unstaged changes in the provided directories
-func GetCurrentTreeHash(rootDir string, unstagedFiles ...string) (string, error) {
-	rootDir, err := GetGitRoot(rootDir)
+//writeTree writes a tree object for the git repository which contains rootDir, consisting of the currently
+//commited files, as well as any unstaged changes in the provided directories, and returns the git root and tree hash.
+//The repository's index is not modified.
+func writeTree(rootDir string, unstagedFiles ...string) (gitRoot string, treeHash string, err error) {
+	gitRoot, err = GetGitRoot(rootDir)
 	if err != nil {
-		return "setup-git-for-unique-token", nil
+		return "", "", ErrNotGitRepository
 	}
 
 	tmpindex, err := ioutil.TempFile("", "sanicindex")
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	defer os.Remove(tmpindex.Name())
 
 	//See http://web.archive.org/web/20190606210911/https://stackoverflow.com/questions/23816330/compute-git-hash-of-all-uncommitted-code
-	currIndexData, err := ioutil.ReadFile(rootDir + "/.git/index")
+	currIndexData, err := ioutil.ReadFile(gitRoot + "/.git/index")
 	if err != nil {
-		return "commit-for-unique-token", nil
+		return "", "", ErrNoCommits
 	}
 	_, err = tmpindex.Write(currIndexData)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	stderr := &bytes.Buffer{}
 
 	cmd := exec.Command("git", append([]string{"add", "-A"}, unstagedFiles...)...)
-	cmd.Dir = rootDir
+	cmd.Dir = gitRoot
 	cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+tmpindex.Name())
 	cmd.Stderr = stderr
 	err = cmd.Run()
 	if err != nil {
 		fmt.Fprint(os.Stderr, stderr.String())
-		return "", err
+		return "", "", err
 	}
 
 	stdout := &bytes.Buffer{}
 	stderr = &bytes.Buffer{}
 
 	cmd = exec.Command("git", "write-tree")
-	cmd.Dir = rootDir
+	cmd.Dir = gitRoot
 	cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+tmpindex.Name())
 	cmd.Stderr = stderr
 	cmd.Stdout = stdout
 	err = cmd.Run()
 	if err != nil {
 		fmt.Fprint(os.Stderr, stderr.String())
+		return "", "", err
+	}
+	return gitRoot, strings.TrimSpace(stdout.String()), nil
+}
+
+//ErrNotGitRepository is returned when a directory is not inside of a git repository
+var ErrNotGitRepository = errors.New("not a git repository, or git is not installed")
+
+//ErrNoCommits is returned when a git repository does not have an index yet
+var ErrNoCommits = errors.New("the git repository does not have an index yet, commit something first")
+
+//GetCurrentTreeHash returns a hash of the git repository, consisting of the currently
+//commited files, as well as any unstaged changes in the provided directories
+func GetCurrentTreeHash(rootDir string, unstagedFiles ...string) (string, error) {
+	_, treeHash, err := writeTree(rootDir, unstagedFiles...)
+	if err == ErrNotGitRepository {
+		return "setup-git-for-unique-token", nil
+	}
+	if err == ErrNoCommits {
+		return "commit-for-unique-token", nil
+	}
+	if err != nil {
 		return "", err
 	}
-	return strings.TrimSpace(stdout.String())[:12], nil
+	return treeHash[:12], nil
+}
+
+//GetObjectHashes returns the git object hash of each of the given absolute paths (files or directories),
+//including any unstaged changes to them. Paths which are not tracked (e.g., ignored files) are not returned.
+func GetObjectHashes(rootDir string, paths ...string) (map[string]string, error) {
+	gitRoot, treeHash, err := writeTree(rootDir, paths...)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]string)
+	for _, path := range paths {
+		relPath, err := filepath.Rel(gitRoot, path)
+		if err != nil {
+			return nil, err
+		}
+		if relPath == "." {
+			hashes[path] = treeHash
+			continue
+		}
+		cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", treeHash+":"+filepath.ToSlash(relPath))
+		cmd.Dir = gitRoot
+		stdout := &bytes.Buffer{}
+		cmd.Stdout = stdout
+		if err := cmd.Run(); err != nil {
+			if _, ok := err.(*exec.ExitError); ok {
+				continue //not in the tree
+			}
+			return nil, err
+		}
+		hashes[path] = strings.TrimSpace(stdout.String())
+	}
+	return hashes, nil
+}
+
+//GetIgnoredFiles returns the absolute paths of the files beneath dir which git ignores (e.g., with a .gitignore),
+//and so are not part of the hashes returned by GetObjectHashes
+func GetIgnoredFiles(dir string) ([]string, error) {
+	cmd := exec.Command("git", "ls-files", "-z", "--others", "--ignored", "--exclude-standard", "--", ".")
+	cmd.Dir = dir
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("could not list the files ignored by git in %s: %s", dir, strings.TrimSpace(stderr.String()))
+	}
 
+	var files []string
+	for _, file := range strings.Split(stdout.String(), "\x00") {
+		if file != "" {
+			files = append(files, filepath.Join(dir, filepath.FromSlash(file)))
+		}
+	}
+	return files, nil
 }
@@ -0,0 +1,244 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+//descriptor references a blob or manifest by its digest, see https://github.com/opencontainers/image-spec/blob/master/descriptor.md
+type descriptor struct {
+	MediaType string   `json:"mediaType"`
+	Digest    string   `json:"digest"`
+	Size      int64    `json:"size"`
+	URLs      []string `json:"urls"`
+	//Platform is only set for the manifests of an image index
+	Platform *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+//manifest has the fields of image manifests (config and layers) and of image indexes/manifest lists (manifests)
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    *descriptor  `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+//imageSource is where images are copied from: a registry (Client) or an OCI image layout (see OCILayout)
+type imageSource interface {
+	getManifest(ctx context.Context, repository, reference string) ([]byte, string, string, error)
+	getBlob(ctx context.Context, repository, digest string) (io.ReadCloser, int64, error)
+}
+
+//imageDestination is where images are copied to: a registry (Client) or an OCI image layout (see OCILayout)
+type imageDestination interface {
+	blobExists(ctx context.Context, repository, digest string) (bool, error)
+	//putBlob writes a blob, calling reopen (if it is not nil) for another copy of it if it has to be sent again
+	putBlob(ctx context.Context, repository, digest string, blob io.Reader, size int64, reopen func() (io.ReadCloser, error)) error
+	putManifest(ctx context.Context, repository, reference, mediaType string, body []byte) error
+}
+
+//getManifest returns the manifest for a reference (a tag or digest), its media type and its digest
+func (client *Client) getManifest(ctx context.Context, repository, reference string) ([]byte, string, string, error) {
+	req, err := client.newRequest(ctx, http.MethodGet, repository, "manifests/"+reference, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	resp, err := client.do(req, client.scope(repository, "pull"))
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", fmt.Errorf("could not get %s:%s from registry %s: %s", repository, reference, client.host, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+	mediaType := resp.Header.Get("Content-Type")
+	if parsed := (manifest{}); json.Unmarshal(body, &parsed) == nil && parsed.MediaType != "" {
+		mediaType = parsed.MediaType
+	}
+	return body, mediaType, fmt.Sprintf("sha256:%x", sha256.Sum256(body)), nil
+}
+
+//putManifest uploads a manifest with the given media type as a reference (a tag or digest)
+func (client *Client) putManifest(ctx context.Context, repository, reference, mediaType string, body []byte) error {
+	req, err := client.newRequest(ctx, http.MethodPut, repository, "manifests/"+reference, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := client.do(req, client.scope(repository, "pull", "push"))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not upload %s:%s to registry %s: %s", repository, reference, client.host, resp.Status)
+	}
+	return nil
+}
+
+//blobExists returns whether a blob with the given digest is already in the repository
+func (client *Client) blobExists(ctx context.Context, repository, digest string) (bool, error) {
+	req, err := client.newRequest(ctx, http.MethodHead, repository, "blobs/"+digest, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.do(req, client.scope(repository, "pull", "push"))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("could not check for blob %s in %s in registry %s: %s", digest, repository, client.host, resp.Status)
+	}
+}
+
+//getBlob downloads a blob. The caller must close it.
+func (client *Client) getBlob(ctx context.Context, repository, digest string) (io.ReadCloser, int64, error) {
+	req, err := client.newRequest(ctx, http.MethodGet, repository, "blobs/"+digest, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := client.do(req, client.scope(repository, "pull"))
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("could not get blob %s from %s in registry %s: %s", digest, repository, client.host, resp.Status)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+//putBlob uploads a blob in a single request, see https://docs.docker.com/registry/spec/api/#monolithic-upload
+func (client *Client) putBlob(ctx context.Context, repository, digest string, blob io.Reader, size int64, reopen func() (io.ReadCloser, error)) error {
+	scope := client.scope(repository, "pull", "push")
+	req, err := client.newRequest(ctx, http.MethodPost, repository, "blobs/uploads/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.do(req, scope)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("could not start uploading blob %s to %s in registry %s: %s", digest, repository, client.host, resp.Status)
+	}
+	location, err := req.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return err
+	}
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+
+	//the token for the scope was fetched by the POST above, but it can expire while a large blob is uploaded
+	req, err = http.NewRequest(http.MethodPut, location.String(), blob)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+	if reopen != nil {
+		req.GetBody = reopen
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = client.do(req, scope)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("could not upload blob %s to %s in registry %s: %s", digest, repository, client.host, resp.Status)
+	}
+	return nil
+}
+
+//copyBlob copies a blob between repositories, unless the destination already has it
+func copyBlob(ctx context.Context, src imageSource, srcRepository string, dst imageDestination, dstRepository string, blob descriptor) error {
+	if len(blob.URLs) > 0 {
+		return nil //a foreign layer (e.g., of a windows base image), which is not stored in the registry
+	}
+	exists, err := dst.blobExists(ctx, dstRepository, blob.Digest)
+	if err != nil || exists {
+		return err
+	}
+	body, size, err := src.getBlob(ctx, srcRepository, blob.Digest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	reopen := func() (io.ReadCloser, error) {
+		body, _, err := src.getBlob(ctx, srcRepository, blob.Digest)
+		return body, err
+	}
+	return dst.putBlob(ctx, dstRepository, blob.Digest, body, size, reopen)
+}
+
+//copyManifest copies a manifest and everything it references (recursively, for image indexes), and uploads it as
+//each of the given references (if there are none, it is uploaded by its digest)
+func copyManifest(ctx context.Context, src imageSource, srcRepository, reference string, dst imageDestination, dstRepository string, dstReferences []string) (string, error) {
+	body, mediaType, digest, err := src.getManifest(ctx, srcRepository, reference)
+	if err != nil {
+		return "", err
+	}
+	parsed := manifest{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "", fmt.Errorf("could not read the manifest of %s:%s: %s", srcRepository, reference, err.Error())
+	}
+
+	for _, child := range parsed.Manifests {
+		if _, err := copyManifest(ctx, src, srcRepository, child.Digest, dst, dstRepository, nil); err != nil {
+			return "", err
+		}
+	}
+	blobs := parsed.Layers
+	if parsed.Config != nil {
+		blobs = append([]descriptor{*parsed.Config}, blobs...)
+	}
+	for _, blob := range blobs {
+		if err := copyBlob(ctx, src, srcRepository, dst, dstRepository, blob); err != nil {
+			return "", err
+		}
+	}
+
+	if len(dstReferences) == 0 {
+		dstReferences = []string{digest}
+	}
+	for _, dstReference := range dstReferences {
+		if err := dst.putManifest(ctx, dstRepository, dstReference, mediaType, body); err != nil {
+			return "", err
+		}
+	}
+	return digest, nil
+}
+
+//CopyImage copies an image (including every platform of a multi-platform image) from a repository in one registry
+//to a repository in another (or the same) registry, as each of the given tags, without pulling it with docker.
+//The manifests are copied byte for byte, so the image keeps its digest, which is returned.
+func CopyImage(ctx context.Context, src *Client, srcRepository, reference string, dst *Client, dstRepository string, dstTags []string) (string, error) {
+	if len(dstTags) == 0 {
+		return "", fmt.Errorf("no tags given to copy %s:%s to", srcRepository, reference)
+	}
+	return copyManifest(ctx, src, srcRepository, reference, dst, dstRepository, dstTags)
+}
@@ -0,0 +1,266 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/webappio/sanic/pkg/util"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//Credentials authenticate to a registry, with one of:
+// - Username and Password,
+// - IdentityToken, an OAuth2 refresh token (which some registries give "docker login" instead of storing the password), or
+// - RegistryToken, a bearer token which is sent to the registry as-is
+type Credentials struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
+}
+
+//dockerConfigAuth is an entry in the auths of a docker config.json
+type dockerConfigAuth struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
+}
+
+//dockerConfig is the part of a docker config.json (see https://docs.docker.com/engine/reference/commandline/login/)
+//which has to do with credentials
+type dockerConfig struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore,omitempty"`
+	CredHelpers map[string]string           `json:"credHelpers,omitempty"`
+}
+
+//Host returns the host[:port] of a registry as configured in sanic, e.g., registry.example.com for registry.example.com/team
+func Host(registry string) string {
+	if idx := strings.Index(registry, "/"); idx != -1 {
+		return registry[:idx]
+	}
+	return registry
+}
+
+//UserDockerConfig returns the path of the user's docker config.json, in $DOCKER_CONFIG or ~/.docker
+func UserDockerConfig() (string, error) {
+	dockerConfig := os.Getenv("DOCKER_CONFIG")
+	if dockerConfig == "" {
+		var err error
+		if dockerConfig, err = util.ExpandUser("~/.docker"); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dockerConfig, "config.json"), nil
+}
+
+//dockerConfigKey returns the key that docker uses for a registry in config.json and with credential helpers
+func dockerConfigKey(registry string) string {
+	switch host := Host(registry); host {
+	case "docker.io", "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "https://index.docker.io/v1/"
+	default:
+		return host
+	}
+}
+
+//CredentialsFromHelper gets the credentials for a registry from a docker credential helper,
+//e.g., "ecr-login" runs docker-credential-ecr-login
+func CredentialsFromHelper(helper, registry string) (*Credentials, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(dockerConfigKey(registry))
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("could not get the credentials for %s from docker-credential-%s: %s %s",
+			registry, helper, err.Error(), strings.TrimSpace(stdout.String()+stderr.String()))
+	}
+	helperCredentials := struct {
+		Username string
+		Secret   string
+	}{}
+	if err := json.Unmarshal(stdout.Bytes(), &helperCredentials); err != nil {
+		return nil, fmt.Errorf("docker-credential-%s returned invalid credentials: %s", helper, err.Error())
+	}
+	if helperCredentials.Username == "<token>" {
+		return &Credentials{IdentityToken: helperCredentials.Secret}, nil
+	}
+	return &Credentials{Username: helperCredentials.Username, Password: helperCredentials.Secret}, nil
+}
+
+//CredentialsFromDockerConfig reads the credentials for a registry from a docker config.json,
+//including from the credential helpers it configures
+func CredentialsFromDockerConfig(path, registry string) (*Credentials, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := dockerConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("could not read the docker config %s: %s", path, err.Error())
+	}
+
+	key := dockerConfigKey(registry)
+	if helper, ok := config.CredHelpers[key]; ok {
+		return CredentialsFromHelper(helper, registry)
+	}
+	for _, authKey := range []string{key, "https://" + key, "http://" + key} {
+		auth, ok := config.Auths[authKey]
+		if !ok {
+			continue
+		}
+		credentials := &Credentials{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			IdentityToken: auth.IdentityToken,
+			RegistryToken: auth.RegistryToken,
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("the docker config %s has an invalid auth for %s: %s", path, authKey, err.Error())
+			}
+			userPass := strings.SplitN(string(decoded), ":", 2)
+			if len(userPass) != 2 {
+				return nil, fmt.Errorf("the docker config %s has an invalid auth for %s", path, authKey)
+			}
+			credentials.Username, credentials.Password = userPass[0], userPass[1]
+		}
+		return credentials, nil
+	}
+	if config.CredsStore != "" {
+		return CredentialsFromHelper(config.CredsStore, registry)
+	}
+	return nil, fmt.Errorf("the docker config %s does not have credentials for %s", path, key)
+}
+
+func (credentials *Credentials) dockerConfigAuth() dockerConfigAuth {
+	auth := dockerConfigAuth{
+		IdentityToken: credentials.IdentityToken,
+		RegistryToken: credentials.RegistryToken,
+	}
+	if credentials.Username != "" {
+		auth.Username = credentials.Username
+		auth.Password = credentials.Password
+		auth.Auth = base64.StdEncoding.EncodeToString([]byte(credentials.Username + ":" + credentials.Password))
+	}
+	return auth
+}
+
+//WriteDockerConfig writes a config.json into dir, so that docker commands run with DOCKER_CONFIG=dir use the credentials
+//for the registry. Everything else in the docker config at basePath (if it exists), e.g., the logins and credential
+//helpers for other registries, is kept. Since docker asks its credsStore for every registry that has no credHelpers
+//entry (even when auths has its credentials), the registries which were stored in credsStore get credHelpers entries
+//instead.
+func WriteDockerConfig(dir, basePath, registry string, credentials *Credentials) error {
+	config := make(map[string]json.RawMessage)
+	data, err := ioutil.ReadFile(basePath)
+	if err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("could not read the docker config %s: %s", basePath, err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	auths := make(map[string]json.RawMessage)
+	credHelpers := make(map[string]string)
+	credsStore := ""
+	for field, value := range map[string]interface{}{"auths": &auths, "credHelpers": &credHelpers, "credsStore": &credsStore} {
+		if raw, ok := config[field]; ok && string(raw) != "null" {
+			if err := json.Unmarshal(raw, value); err != nil {
+				return fmt.Errorf("the docker config %s has an invalid %s: %s", basePath, field, err.Error())
+			}
+		}
+	}
+
+	key := dockerConfigKey(registry)
+	for _, authKey := range []string{key, "https://" + key, "http://" + key} {
+		delete(auths, authKey)
+		delete(credHelpers, authKey)
+	}
+	if credsStore != "" {
+		for authKey := range auths {
+			if _, ok := credHelpers[authKey]; !ok {
+				credHelpers[authKey] = credsStore
+			}
+		}
+	}
+	if auths[key], err = json.Marshal(credentials.dockerConfigAuth()); err != nil {
+		return err
+	}
+	delete(config, "credsStore")
+	delete(config, "credHelpers")
+	if config["auths"], err = json.Marshal(auths); err != nil {
+		return err
+	}
+	if len(credHelpers) > 0 {
+		if config["credHelpers"], err = json.Marshal(credHelpers); err != nil {
+			return err
+		}
+	}
+
+	if data, err = json.MarshalIndent(config, "", "  "); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "config.json"), data, 0600)
+}
+
+//ResolveDockerConfig returns a docker config.json with the credentials for every registry that the docker config at path
+//has a login or a credential helper for, with the credentials from the helpers written into it, for builds which cannot
+//run the helpers (e.g., in a cluster). It also returns the registries whose credentials could not be found.
+func ResolveDockerConfig(path string) ([]byte, []string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := dockerConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, nil, fmt.Errorf("could not read the docker config %s: %s", path, err.Error())
+	}
+	keys := make(map[string]bool)
+	for key := range config.Auths {
+		keys[key] = true
+	}
+	for key := range config.CredHelpers {
+		keys[key] = true
+	}
+	resolved := dockerConfig{Auths: make(map[string]dockerConfigAuth)}
+	var unresolved []string
+	for key := range keys {
+		registry := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+		credentials, err := CredentialsFromDockerConfig(path, registry)
+		if err != nil {
+			unresolved = append(unresolved, registry)
+			continue
+		}
+		resolved.Auths[dockerConfigKey(registry)] = credentials.dockerConfigAuth()
+	}
+	sort.Strings(unresolved)
+	data, err = json.Marshal(resolved)
+	return data, unresolved, err
+}
+
+//PullSecretConfig returns the contents of a kubernetes image pull secret (its .dockerconfigjson) for the registry.
+//Kubernetes only supports credentials with a username and password.
+func PullSecretConfig(registry string, credentials *Credentials) ([]byte, error) {
+	if credentials.Username == "" {
+		return nil, fmt.Errorf("image pull secrets need a username and password for the registry %s, not a token", registry)
+	}
+	auth := credentials.dockerConfigAuth()
+	auth.IdentityToken = ""
+	auth.RegistryToken = ""
+	return json.Marshal(dockerConfig{Auths: map[string]dockerConfigAuth{dockerConfigKey(registry): auth}})
+}
@@ -0,0 +1,129 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestWriteDockerConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		base        string
+		auths       []string
+		credHelpers map[string]string
+		headers     bool //whether the base config has HttpHeaders, which should be kept
+	}{
+		{
+			name:  "no config",
+			auths: []string{"registry.example.com"},
+		},
+		{
+			name:    "other logins",
+			base:    `{"auths": {"ghcr.io": {"auth": "dTpw"}, "https://registry.example.com": {"auth": "b2xkOm9sZA=="}}, "HttpHeaders": {"a": "b"}}`,
+			auths:   []string{"ghcr.io", "registry.example.com"},
+			headers: true,
+		},
+		{
+			name:        "credential helpers",
+			base:        `{"credsStore": "desktop", "credHelpers": {"registry.example.com": "ecr-login", "gcr.io": "gcloud"}, "auths": {"ghcr.io": {}, "gcr.io": {}}}`,
+			auths:       []string{"gcr.io", "ghcr.io", "registry.example.com"},
+			credHelpers: map[string]string{"gcr.io": "gcloud", "ghcr.io": "desktop"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sanic-docker-config-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			basePath := filepath.Join(dir, "base.json")
+			if test.base != "" {
+				if err := ioutil.WriteFile(basePath, []byte(test.base), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			credentials := &Credentials{Username: "ci", Password: "secret"}
+			if err := WriteDockerConfig(dir, basePath, "registry.example.com/team", credentials); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := struct {
+				dockerConfig
+				HTTPHeaders map[string]string `json:"HttpHeaders"`
+			}{}
+			if err := json.Unmarshal(data, &config); err != nil {
+				t.Fatal(err)
+			}
+			var auths []string
+			for key := range config.Auths {
+				auths = append(auths, key)
+			}
+			sort.Strings(auths)
+			if !reflect.DeepEqual(auths, test.auths) {
+				t.Errorf("auths: got %v, want %v", auths, test.auths)
+			}
+			if config.CredsStore != "" {
+				t.Errorf("got the credsStore %s, which would be asked for the registry's credentials", config.CredsStore)
+			}
+			if len(config.CredHelpers) > 0 || len(test.credHelpers) > 0 {
+				if !reflect.DeepEqual(config.CredHelpers, test.credHelpers) {
+					t.Errorf("credHelpers: got %v, want %v", config.CredHelpers, test.credHelpers)
+				}
+			}
+			if test.headers && config.HTTPHeaders["a"] != "b" {
+				t.Errorf("the other settings of the config were not kept: %s", data)
+			}
+
+			got, err := CredentialsFromDockerConfig(filepath.Join(dir, "config.json"), "registry.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != *credentials {
+				t.Errorf("got the credentials %+v, want %+v", got, credentials)
+			}
+		})
+	}
+}
+
+func TestResolveDockerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sanic-docker-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	config := `{"auths": {"https://index.docker.io/v1/": {"auth": "dTpw"}, "ghcr.io": {"identitytoken": "t"}},
+		"credHelpers": {"gcr.io": "sanic-test-missing-helper"}}`
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	data, unresolved, err := ResolveDockerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unresolved, []string{"gcr.io"}) {
+		t.Errorf("unresolved: got %v, want [gcr.io]", unresolved)
+	}
+	resolved := dockerConfig{}
+	if err := json.Unmarshal(data, &resolved); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]dockerConfigAuth{
+		"https://index.docker.io/v1/": {Auth: "dTpw", Username: "u", Password: "p"},
+		"ghcr.io":                     {IdentityToken: "t"},
+	}
+	if !reflect.DeepEqual(resolved.Auths, want) {
+		t.Errorf("auths: got %+v, want %+v", resolved.Auths, want)
+	}
+}
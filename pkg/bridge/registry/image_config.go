@@ -0,0 +1,154 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+//imageConfig is the part of an image's configuration blob that sanic reads,
+//see https://github.com/opencontainers/image-spec/blob/master/config.md
+type imageConfig struct {
+	Created time.Time `json:"created"`
+	Config  struct {
+		Labels map[string]string
+	} `json:"config"`
+	History []struct {
+		CreatedBy  string `json:"created_by"`
+		EmptyLayer bool   `json:"empty_layer"`
+	} `json:"history"`
+}
+
+//Layer is a layer of an image in a registry, with its compressed size and the instruction which created it
+type Layer struct {
+	Digest    string
+	Size      int64
+	CreatedBy string
+}
+
+//ImageLabels returns the labels of an image in the registry. For a multi-platform image, they are the labels of
+//the image for the current platform, or of the first one if it does not have an image for the current platform.
+func (client *Client) ImageLabels(ctx context.Context, repository, reference string) (map[string]string, error) {
+	body, _, _, err := client.getManifest(ctx, repository, reference)
+	if err != nil {
+		return nil, err
+	}
+	parsed := manifest{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("could not read the manifest of %s:%s: %s", repository, reference, err.Error())
+	}
+	if len(parsed.Manifests) > 0 {
+		child := parsed.Manifests[0]
+		for _, m := range parsed.Manifests {
+			if m.Platform != nil && m.Platform.OS == runtime.GOOS && m.Platform.Architecture == runtime.GOARCH {
+				child = m
+				break
+			}
+		}
+		return client.ImageLabels(ctx, repository, child.Digest)
+	}
+	config, err := client.imageConfig(ctx, repository, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%s: %s", repository, reference, err.Error())
+	}
+	return config.Config.Labels, nil
+}
+
+//imageConfig downloads the configuration blob of an image manifest
+func (client *Client) imageConfig(ctx context.Context, repository string, parsed manifest) (*imageConfig, error) {
+	if parsed.Config == nil {
+		return nil, fmt.Errorf("the manifest does not have an image configuration")
+	}
+	blob, _, err := client.getBlob(ctx, repository, parsed.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	config := &imageConfig{}
+	if err := json.NewDecoder(blob).Decode(config); err != nil {
+		return nil, fmt.Errorf("could not read the image configuration: %s", err.Error())
+	}
+	return config, nil
+}
+
+//ImageLayers returns the layers of an image in the registry, oldest first. For a multi-platform image, they are the
+//layers of the largest of its images.
+func (client *Client) ImageLayers(ctx context.Context, repository, reference string) ([]Layer, error) {
+	body, _, _, err := client.getManifest(ctx, repository, reference)
+	if err != nil {
+		return nil, err
+	}
+	parsed := manifest{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("could not read the manifest of %s:%s: %s", repository, reference, err.Error())
+	}
+	if len(parsed.Manifests) > 0 {
+		var largest []Layer
+		var largestSize int64
+		for _, m := range parsed.Manifests {
+			layers, err := client.ImageLayers(ctx, repository, m.Digest)
+			if err != nil {
+				return nil, err
+			}
+			var size int64
+			for _, layer := range layers {
+				size += layer.Size
+			}
+			if largest == nil || size > largestSize {
+				largest, largestSize = layers, size
+			}
+		}
+		return largest, nil
+	}
+
+	config, err := client.imageConfig(ctx, repository, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%s: %s", repository, reference, err.Error())
+	}
+	//every layer was created by the next history entry which is not empty
+	var createdBy []string
+	for _, entry := range config.History {
+		if !entry.EmptyLayer {
+			createdBy = append(createdBy, entry.CreatedBy)
+		}
+	}
+	var layers []Layer
+	for i, layer := range parsed.Layers {
+		l := Layer{Digest: layer.Digest, Size: layer.Size}
+		if len(createdBy) == len(parsed.Layers) {
+			l.CreatedBy = createdBy[i]
+		}
+		layers = append(layers, l)
+	}
+	return layers, nil
+}
+
+//ImageCreated returns when an image in the registry was built. For a multi-platform image, it is when its first
+//image was built (skipping attestations, which are not images).
+func (client *Client) ImageCreated(ctx context.Context, repository, reference string) (time.Time, error) {
+	body, _, _, err := client.getManifest(ctx, repository, reference)
+	if err != nil {
+		return time.Time{}, err
+	}
+	parsed := manifest{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return time.Time{}, fmt.Errorf("could not read the manifest of %s:%s: %s", repository, reference, err.Error())
+	}
+	if len(parsed.Manifests) > 0 {
+		child := parsed.Manifests[0]
+		for _, m := range parsed.Manifests {
+			if m.Platform == nil || m.Platform.OS != "unknown" {
+				child = m
+				break
+			}
+		}
+		return client.ImageCreated(ctx, repository, child.Digest)
+	}
+	config, err := client.imageConfig(ctx, repository, parsed)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s:%s: %s", repository, reference, err.Error())
+	}
+	return config.Created, nil
+}
@@ -0,0 +1,219 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//ociRefNameAnnotation is the annotation of the manifests in an OCI layout's index.json with their tag
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+//ociIndex is the index.json of an OCI image layout, see https://github.com/opencontainers/image-spec/blob/master/image-layout.md
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+//OCILayout is a directory with images in the OCI image layout format, which images can be copied into and out of
+//like a registry (without a repository, i.e., its images are only told apart by their tags)
+type OCILayout struct {
+	dir   string
+	mutex sync.Mutex
+}
+
+//NewOCILayout returns the OCI image layout in dir, creating it if it does not exist
+func NewOCILayout(dir string) (*OCILayout, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return nil, err
+	}
+	layoutFile := filepath.Join(dir, "oci-layout")
+	if _, err := os.Stat(layoutFile); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(layoutFile, []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return &OCILayout{dir: dir}, nil
+}
+
+func (layout *OCILayout) blobPath(digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || strings.ContainsAny(parts[1], `/\.`) {
+		return "", fmt.Errorf("%s is not a sha256 digest", digest)
+	}
+	return filepath.Join(layout.dir, "blobs", "sha256", parts[1]), nil
+}
+
+func (layout *OCILayout) readIndex() (*ociIndex, error) {
+	index := &ociIndex{SchemaVersion: 2}
+	data, err := ioutil.ReadFile(filepath.Join(layout.dir, "index.json"))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("%s is not a valid OCI image layout: %s", layout.dir, err.Error())
+	}
+	return index, nil
+}
+
+func (layout *OCILayout) getManifest(ctx context.Context, repository, reference string) ([]byte, string, string, error) {
+	digest, mediaType := reference, ""
+	if !strings.HasPrefix(reference, "sha256:") {
+		layout.mutex.Lock()
+		index, err := layout.readIndex()
+		layout.mutex.Unlock()
+		if err != nil {
+			return nil, "", "", err
+		}
+		digest = ""
+		for _, manifest := range index.Manifests {
+			if manifest.Annotations[ociRefNameAnnotation] == reference {
+				digest, mediaType = manifest.Digest, manifest.MediaType
+			}
+		}
+		if digest == "" {
+			return nil, "", "", fmt.Errorf("there is no image tagged %s in %s", reference, layout.dir)
+		}
+	}
+	path, err := layout.blobPath(digest)
+	if err != nil {
+		return nil, "", "", err
+	}
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("could not read the manifest %s in %s: %s", digest, layout.dir, err.Error())
+	}
+	if parsed := (manifest{}); json.Unmarshal(body, &parsed) == nil && parsed.MediaType != "" {
+		mediaType = parsed.MediaType
+	}
+	return body, mediaType, fmt.Sprintf("sha256:%x", sha256.Sum256(body)), nil
+}
+
+func (layout *OCILayout) getBlob(ctx context.Context, repository, digest string) (io.ReadCloser, int64, error) {
+	path, err := layout.blobPath(digest)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read blob %s in %s: %s", digest, layout.dir, err.Error())
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (layout *OCILayout) blobExists(ctx context.Context, repository, digest string) (bool, error) {
+	path, err := layout.blobPath(digest)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//putBlob writes a blob to the layout, checking that it has the given digest
+func (layout *OCILayout) putBlob(ctx context.Context, repository, digest string, blob io.Reader, size int64, reopen func() (io.ReadCloser, error)) error {
+	path, err := layout.blobPath(digest)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), blob)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write blob %s to %s: %s", digest, layout.dir, err.Error())
+	}
+	if actual := fmt.Sprintf("sha256:%x", hash.Sum(nil)); actual != digest {
+		return fmt.Errorf("blob %s has the digest %s", digest, actual)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+//putManifest writes a manifest to the layout, and adds it to index.json if reference is a tag
+func (layout *OCILayout) putManifest(ctx context.Context, repository, reference, mediaType string, body []byte) error {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	path, err := layout.blobPath(digest)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, body, 0644); err != nil {
+		return err
+	}
+	if strings.HasPrefix(reference, "sha256:") {
+		return nil
+	}
+
+	layout.mutex.Lock()
+	defer layout.mutex.Unlock()
+	index, err := layout.readIndex()
+	if err != nil {
+		return err
+	}
+	var manifests []ociDescriptor
+	for _, manifest := range index.Manifests {
+		if manifest.Annotations[ociRefNameAnnotation] != reference {
+			manifests = append(manifests, manifest)
+		}
+	}
+	index.Manifests = append(manifests, ociDescriptor{
+		MediaType:   mediaType,
+		Digest:      digest,
+		Size:        int64(len(body)),
+		Annotations: map[string]string{ociRefNameAnnotation: reference},
+	})
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(layout.dir, "index.json"), data, 0644)
+}
+
+//ExportImage copies an image (including every platform of a multi-platform image) from a repository in a registry
+//into an OCI image layout, tagged with the given tags, and returns its digest
+func ExportImage(ctx context.Context, src *Client, srcRepository, reference string, dst *OCILayout, dstTags []string) (string, error) {
+	if len(dstTags) == 0 {
+		return "", fmt.Errorf("no tags given to export %s:%s as", srcRepository, reference)
+	}
+	return copyManifest(ctx, src, srcRepository, reference, dst, "", dstTags)
+}
+
+//ImportImage copies the image with the given tag from an OCI image layout to a repository in a registry,
+//as each of the given tags, and returns its digest
+func ImportImage(ctx context.Context, src *OCILayout, reference string, dst *Client, dstRepository string, dstTags []string) (string, error) {
+	if len(dstTags) == 0 {
+		return "", fmt.Errorf("no tags given to import %s as", reference)
+	}
+	return copyManifest(ctx, src, "", reference, dst, dstRepository, dstTags)
+}
@@ -0,0 +1,325 @@
+package registry
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+//manifestMediaTypes are the manifest types sanic understands, sent as the Accept header for manifest requests
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+//Client talks to a docker registry using the registry HTTP API v2
+type Client struct {
+	//host is the host[:port] of the registry API
+	host string
+	//prefix is prepended to every repository name, e.g., registry.example.com/team -> team/
+	prefix      string
+	insecure    bool
+	credentials *Credentials //nil for anonymous access
+	httpClient  *http.Client
+	tokens      map[string]string //scope -> bearer token
+	basicAuth   bool              //whether the registry asked for basic authentication instead of tokens
+	mutex       sync.Mutex
+}
+
+//NewClient creates a Client for a registry as configured in sanic, e.g., registry.example.com:5000 or docker.io/myuser
+//If insecure is true, plain HTTP is used. credentials can be nil, to only access public repositories.
+func NewClient(registry string, insecure bool, credentials *Credentials) *Client {
+	host := Host(registry)
+	prefix := ""
+	if idx := strings.Index(registry, "/"); idx != -1 {
+		prefix = strings.Trim(registry[idx+1:], "/") + "/"
+	}
+	switch host {
+	case "docker.io", "index.docker.io", "registry.hub.docker.com":
+		host = "registry-1.docker.io"
+	}
+	return &Client{
+		host:        host,
+		prefix:      prefix,
+		insecure:    insecure,
+		credentials: credentials,
+		httpClient:  http.DefaultClient,
+		tokens:      make(map[string]string),
+	}
+}
+
+func (client *Client) url(path string) string {
+	scheme := "https"
+	if client.insecure {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s", scheme, client.host, path)
+}
+
+//do sends a request, handling bearer token (for the given scope) or basic authentication if the registry asks for it.
+//If a cached bearer token is rejected (i.e., it expired), a new one is fetched and the request is sent again,
+//so requests with a body need a GetBody to resend it (which http.NewRequest sets for in-memory bodies).
+func (client *Client) do(req *http.Request, scope string) (*http.Response, error) {
+	client.mutex.Lock()
+	token, cached := client.tokens[scope]
+	basicAuth := client.basicAuth
+	client.mutex.Unlock()
+	staticToken := client.credentials != nil && client.credentials.RegistryToken != ""
+	if staticToken {
+		token = client.credentials.RegistryToken
+	}
+	if cached || staticToken {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if basicAuth {
+		req.SetBasicAuth(client.credentials.Username, client.credentials.Password)
+	}
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized || staticToken || (basicAuth && !cached) {
+		//the credentials were accepted, or they were rejected but would not be any different the next time
+		return resp, nil
+	}
+	if cached {
+		//bearer tokens expire (e.g., after 5 minutes on Docker Hub), so a new one is fetched below
+		client.mutex.Lock()
+		if client.tokens[scope] == token {
+			delete(client.tokens, scope)
+		}
+		client.mutex.Unlock()
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("registry %s rejected the credentials for %s %s, and the request cannot be sent again", client.host, req.Method, req.URL.Path)
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	var authorization string
+	switch {
+	case strings.HasPrefix(strings.ToLower(challenge), "bearer "):
+		resp.Body.Close()
+		token, err = client.fetchToken(req.Context(), challenge, scope)
+		if err != nil {
+			return nil, err
+		}
+		client.mutex.Lock()
+		client.tokens[scope] = token
+		client.mutex.Unlock()
+		authorization = "Bearer " + token
+	case strings.HasPrefix(strings.ToLower(challenge), "basic ") && client.credentials != nil && client.credentials.Username != "":
+		resp.Body.Close()
+		client.mutex.Lock()
+		client.basicAuth = true
+		client.mutex.Unlock()
+		authorization = "Basic " + base64.StdEncoding.EncodeToString(
+			[]byte(client.credentials.Username+":"+client.credentials.Password))
+	default:
+		return resp, nil
+	}
+
+	retry := req.Clone(req.Context())
+	retry.Header.Set("Authorization", authorization)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return client.httpClient.Do(retry)
+}
+
+//parseChallenge parses the parameters of a WWW-Authenticate header, e.g., Bearer realm="...",service="..."
+func parseChallenge(challenge string) map[string]string {
+	params := make(map[string]string)
+	challenge = challenge[strings.Index(challenge, " ")+1:]
+	for _, param := range strings.Split(challenge, ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 {
+			params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return params
+}
+
+func (client *Client) fetchToken(ctx context.Context, challenge, scope string) (string, error) {
+	params := parseChallenge(challenge)
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("registry %s sent an invalid authentication challenge: %s", client.host, challenge)
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	if scope != "" {
+		query.Set("scope", scope)
+	} else if params["scope"] != "" {
+		query.Set("scope", params["scope"])
+	}
+
+	var req *http.Request
+	if client.credentials != nil && client.credentials.IdentityToken != "" {
+		//see https://docs.docker.com/registry/spec/auth/oauth/
+		query.Set("grant_type", "refresh_token")
+		query.Set("refresh_token", client.credentials.IdentityToken)
+		query.Set("client_id", "sanic")
+		req, err = http.NewRequest(http.MethodPost, realm.String(), strings.NewReader(query.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		realm.RawQuery = query.Encode()
+		req, err = http.NewRequest(http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if client.credentials != nil && client.credentials.Username != "" {
+			req.SetBasicAuth(client.credentials.Username, client.credentials.Password)
+		}
+	}
+	resp, err := client.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not authenticate to registry %s: %s", client.host, resp.Status)
+	}
+	tokenResponse := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return "", err
+	}
+	if tokenResponse.Token != "" {
+		return tokenResponse.Token, nil
+	}
+	return tokenResponse.AccessToken, nil
+}
+
+//newRequest creates a request for a path in the given repository (without the registry's prefix)
+func (client *Client) newRequest(ctx context.Context, method, repository, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, client.url(client.prefix+repository+"/"+path), body)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(ctx), nil
+}
+
+//scope returns the token scope for the given actions (e.g., pull, push) on a repository
+func (client *Client) scope(repository string, actions ...string) string {
+	return fmt.Sprintf("repository:%s%s:%s", client.prefix, repository, strings.Join(actions, ","))
+}
+
+//ManifestDigest returns the digest (e.g., sha256:abc...) of the manifest for the given repository (e.g., namespace-web)
+//and tag, or "" if there is no such manifest
+func (client *Client) ManifestDigest(ctx context.Context, repository, tag string) (string, error) {
+	req, err := client.newRequest(ctx, http.MethodHead, repository, "manifests/"+tag, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	resp, err := client.do(req, client.scope(repository, "pull"))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header.Get("Docker-Content-Digest"), nil
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", fmt.Errorf("could not check for %s:%s in registry %s: %s", repository, tag, client.host, resp.Status)
+	}
+}
+
+//Tag points newTag at the manifest of reference (a tag or digest) in the same repository, without pulling the image
+func (client *Client) Tag(ctx context.Context, repository, reference, newTag string) error {
+	manifest, mediaType, _, err := client.getManifest(ctx, repository, reference)
+	if err != nil {
+		return err
+	}
+	return client.putManifest(ctx, repository, newTag, mediaType, manifest)
+}
+
+//Tags returns the tags in a repository, or none if the repository does not exist
+func (client *Client) Tags(ctx context.Context, repository string) ([]string, error) {
+	req, err := client.newRequest(ctx, http.MethodGet, repository, "tags/list", nil)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for {
+		resp, err := client.do(req, client.scope(repository, "pull"))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return nil, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("could not list the tags of %s in registry %s: %s", repository, client.host, resp.Status)
+		}
+		page := struct {
+			Tags []string `json:"tags"`
+		}{}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not read the tags of %s in registry %s: %s", repository, client.host, err.Error())
+		}
+		tags = append(tags, page.Tags...)
+
+		//the registry paginates large lists with a link to the next page, e.g., </v2/web/tags/list?last=abc&n=100>; rel="next"
+		link := resp.Header.Get("Link")
+		if !strings.Contains(link, `rel="next"`) || !strings.HasPrefix(link, "<") || !strings.Contains(link, ">") {
+			return tags, nil
+		}
+		next, err := req.URL.Parse(link[1:strings.Index(link, ">")])
+		if err != nil {
+			return nil, err
+		}
+		req, err = http.NewRequest(http.MethodGet, next.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+	}
+}
+
+//DeleteManifest deletes a manifest (and so every tag which points at it) by its digest. The registry only frees the
+//space of its blobs when its garbage collector runs.
+func (client *Client) DeleteManifest(ctx context.Context, repository, digest string) error {
+	req, err := client.newRequest(ctx, http.MethodDelete, repository, "manifests/"+digest, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.do(req, client.scope(repository, "delete"))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK, http.StatusNotFound:
+		return nil
+	case http.StatusMethodNotAllowed:
+		return fmt.Errorf("registry %s does not allow deleting images (e.g., REGISTRY_STORAGE_DELETE_ENABLED is not set)", client.host)
+	default:
+		return fmt.Errorf("could not delete %s@%s from registry %s: %s", repository, digest, client.host, resp.Status)
+	}
+}
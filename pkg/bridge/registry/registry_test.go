@@ -0,0 +1,73 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//expiringTokenRegistry is a registry which hands out bearer tokens that are only accepted for a few requests
+type expiringTokenRegistry struct {
+	mutex        sync.Mutex
+	tokensIssued int
+	uses         map[string]int
+	maxUses      int
+	bodies       []string
+}
+
+func (registry *expiringTokenRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if r.URL.Path == "/token" {
+		registry.tokensIssued++
+		fmt.Fprintf(w, `{"token":"token-%d"}`, registry.tokensIssued)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || registry.uses[token] >= registry.maxUses {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	registry.uses[token]++
+	body, _ := ioutil.ReadAll(r.Body)
+	registry.bodies = append(registry.bodies, string(body))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func TestDoRefreshesExpiredTokens(t *testing.T) {
+	registry := &expiringTokenRegistry{uses: make(map[string]int), maxUses: 2}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	client := NewClient(strings.TrimPrefix(server.URL, "http://"), true, nil)
+
+	for i := 0; i < 5; i++ {
+		body := fmt.Sprintf("manifest %d", i)
+		if err := client.putManifest(context.Background(), "repo", "tag", "application/json", []byte(body)); err != nil {
+			t.Fatalf("request %d: %s", i, err)
+		}
+	}
+	if registry.tokensIssued != 3 {
+		t.Errorf("got %d tokens, want 3 (one for every 2 requests)", registry.tokensIssued)
+	}
+	want := []string{"manifest 0", "manifest 1", "manifest 2", "manifest 3", "manifest 4"}
+	if strings.Join(registry.bodies, ",") != strings.Join(want, ",") {
+		t.Errorf("the registry got the bodies %q, want %q", registry.bodies, want)
+	}
+
+	//a body which cannot be sent again is an error, rather than an empty retry
+	registry.uses["token-3"] = registry.maxUses
+	req, err := client.newRequest(context.Background(), http.MethodPut, "repo", "manifests/tag", ioutil.NopCloser(bytes.NewBufferString("stream")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.do(req, client.scope("repo", "pull", "push")); err == nil {
+		t.Error("expected an error for a body which cannot be sent again")
+	}
+}
@@ -0,0 +1,72 @@
+package build
+
+import (
+	"context"
+	"github.com/webappio/sanic/pkg/util"
+	"time"
+)
+
+//Backend builds the images of services for a Builder, e.g., with docker or in the kubernetes cluster.
+//Every backend reports the progress of its builds to the Builder's Interface and Logger in the same way:
+//step changes with ProcessVertex (if it knows them), pushing with SetPushing, the pushed digest with SetDigest, and
+//everything it outputs as log lines. The Builder starts, fails and succeeds the jobs itself.
+type Backend interface {
+	//Build builds the image of a service from dockerfile (see Builder.dockerfile), named with each of imageNames, and
+	//pushes it if the Builder's DoPush is set. It returns ctx.Err() (or an error wrapping it) if ctx is cancelled.
+	Build(ctx context.Context, builder *Builder, service util.BuildableService, dockerfile string, imageNames []string) error
+	//ImageStore returns the docker-compatible CLI (docker or podman) which has the images that are built without being
+	//pushed, or "" if the backend can only push them
+	ImageStore() string
+}
+
+//backend returns the Backend named by the builder's Backend
+func (builder *Builder) backend() Backend {
+	switch builder.Backend {
+	case BackendBuildkit:
+		return buildkitBackend{}
+	case BackendPodman:
+		return podmanBackend{}
+	case BackendKaniko:
+		return kanikoBackend{}
+	default:
+		return dockerBackend{}
+	}
+}
+
+//dockerBackend builds images with "docker build", or with "docker buildx build" for what only buildx can do
+type dockerBackend struct{}
+
+func (dockerBackend) Build(ctx context.Context, builder *Builder, service util.BuildableService, dockerfile string, imageNames []string) error {
+	serviceConfig := builder.serviceConfig(service)
+	if len(serviceConfig.Platforms) > 0 || builder.importsCache() || builder.exportsCache() {
+		//docker build can neither build for other platforms nor export a registry cache, but buildx can
+		if err := builder.checkPlatforms(service, builder.buildxPlatforms); err != nil {
+			return err
+		}
+		return builder.buildWithBuildx(ctx, service, dockerfile, imageNames)
+	}
+	return builder.buildWithDocker(ctx, service, dockerfile, imageNames)
+}
+
+func (dockerBackend) ImageStore() string {
+	return "docker"
+}
+
+//buildkitBackend builds images with a buildkitd daemon, and loads the ones which are not pushed into docker.
+//If buildkitd is not available, it falls back to dockerBackend.
+type buildkitBackend struct{}
+
+func (buildkitBackend) Build(ctx context.Context, builder *Builder, service util.BuildableService, dockerfile string, imageNames []string) error {
+	if err := builder.checkBuildkit(); err != nil {
+		builder.Logger.Log(service.Name, time.Now(), "buildkit is not available, falling back to docker build: ", err.Error())
+		return dockerBackend{}.Build(ctx, builder, service, dockerfile, imageNames)
+	}
+	if err := builder.checkPlatforms(service, builder.buildkitPlatforms); err != nil {
+		return err
+	}
+	return builder.buildWithBuildkit(ctx, service, dockerfile, imageNames)
+}
+
+func (buildkitBackend) ImageStore() string {
+	return "docker"
+}
@@ -1,5 +1,7 @@
 package build
 
+import "time"
+
 /*An Interface represents a way to output the current state of a build
   Currently there are two implementations:
   - Interactive Interfaces use advanced terminal capabilities, similar to the "curses" library
@@ -13,13 +15,36 @@ type Interface interface {
 	FailJob(service string, err error)
 	//SucceedJob marks a specific job as having succeeded. It will no longer receive any logs.
 	SucceedJob(service string)
+	//CancelJob marks a job as cancelled, whether or not it was started. It will no longer receive any logs.
+	CancelJob(service string)
+	//SkipJob marks a job which was never started (e.g., because a service it depends on failed) as skipped.
+	SkipJob(service string, reason string)
 	//SetPushing marks a job as currently pushing
 	SetPushing(service string)
+	//SetUpToDate marks a job as not needing to be built, because its image already exists
+	SetUpToDate(service string)
+	//SetImageSize records the size of a job's image (see ImageSize), once it has been built
+	SetImageSize(service string, size *ImageSize)
+	//SetDigest records the digest (e.g., sha256:abc...) of a job's image in the registry, once it has been pushed
+	SetDigest(service string, digest string)
+	//SetWaiting shows that no more jobs will start until something happens (e.g., "watching for changes..."),
+	//or stops showing it if reason is empty
+	SetWaiting(reason string)
+	//SetEstimates sets how long the jobs of each service are expected to take (only for services which have been built
+	//before), and how many jobs run at once, to show how long the build has left
+	SetEstimates(estimates map[string]time.Duration, parallelism int)
 	//ProcessLog handles a single log line
 	ProcessLog(service string, logLine string)
-	//Terminate this interface and close any resources it is using.
+	//ProcessVertex handles a change in the status of a build step (currently only sent by the buildkit backend)
+	ProcessVertex(service string, vertex Vertex)
+	//Terminate this interface and close any resources it is using, without waiting for the user.
 	Close()
+	//InspectAndClose closes the interface once the build is over. If any job failed, interactive interfaces (on a
+	//terminal) first keep showing the failures until the user quits, so that their logs can be read.
+	InspectAndClose()
 	//The interface is in charge of handling user cancelling (e.g., sigquit or ^C).
 	//Call these functions when the user specifies that they would like to cancel building.
 	AddCancelListener(cancelFunc func())
+	//Interfaces which let the user cancel a single job (e.g., interactively) call these functions with its service
+	AddJobCancelListener(cancelFunc func(service string))
 }
@@ -1,36 +1,83 @@
 package build
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
+	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
+//The streams of log lines (see Logger.LogStream)
+const (
+	//StreamSanic is for messages from sanic itself
+	StreamSanic = "sanic"
+	//StreamStdout and StreamStderr are for the output of the commands which build the images
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+//The formats of log files (see NewFlatfileLogger)
+const (
+	//LogFormatText writes each line as "[time] message"
+	LogFormatText = "text"
+	//LogFormatJSON writes each line as a JSON object with its time, service, stream and message (see LogLine)
+	LogFormatJSON = "json"
+)
+
+//LogLine is a line of a log in LogFormatJSON
+type LogLine struct {
+	Time    time.Time `json:"time"`
+	Service string    `json:"service"`
+	Stream  string    `json:"stream"`
+	Message string    `json:"message"`
+}
+
 //Logger takes log messages from the buildkit build server(s) and stores them
 type Logger interface {
+	//Log logs a message from sanic itself, i.e., in StreamSanic
 	Log(service string, when time.Time, message ...interface{}) error
+	//LogStream logs a message in the given stream, e.g., a line that a build command wrote to StreamStderr
+	LogStream(service string, stream string, when time.Time, message ...interface{}) error
 	Close()
 	AddLogLineListener(func(service, logLine string))
+	//LogPath returns where the logs of a service are stored
+	LogPath(service string) string
 }
 
 type flatfileLogger struct {
 	mutex              sync.Mutex
 	LogDirectory       string
+	runDirectory       string
+	format             string
 	currVertexStatuses map[string]string
 	openFiles          map[string]*os.File
 	logLineListeners   []func(service, logLine string)
 	verbose            bool
 }
 
-//NewFlatfileLogger builds a new Logger which writes text logs to (repository root)/logs/(service name).log
-func NewFlatfileLogger(logDirectory string, verbose bool) Logger {
+//NewFlatfileLogger builds a new Logger which writes the logs of each service to
+//(repository root)/logs/builds/(runID)/(service name).log, or .jsonl in LogFormatJSON.
+//The logs of the most recent runs are kept, up to keepRuns (including this one), and logs/builds/latest points at this run.
+func NewFlatfileLogger(logDirectory, runID, format string, keepRuns int, verbose bool) Logger {
+	buildsDirectory := filepath.Join(logDirectory, "builds")
+	if runIDs, err := BuildRunIDs(logDirectory); err == nil && keepRuns > 0 {
+		for len(runIDs) >= keepRuns {
+			os.RemoveAll(filepath.Join(buildsDirectory, runIDs[len(runIDs)-1]))
+			runIDs = runIDs[:len(runIDs)-1]
+		}
+	}
 	return &flatfileLogger{
 		LogDirectory:       logDirectory,
+		runDirectory:       filepath.Join(buildsDirectory, runID),
+		format:             format,
 		openFiles:          make(map[string]*os.File),
 		currVertexStatuses: make(map[string]string),
 		logLineListeners:   []func(service, logLine string){},
@@ -38,6 +85,35 @@ func NewFlatfileLogger(logDirectory string, verbose bool) Logger {
 	}
 }
 
+//NewBuildRunID returns the ID of a build run which starts now, and builds the given tree hash
+func NewBuildRunID(treeHash string) string {
+	if len(treeHash) > 12 {
+		treeHash = treeHash[:12]
+	}
+	return time.Now().Format("20060102-150405") + "-" + treeHash
+}
+
+var buildRunIDRegexp = regexp.MustCompile(`^\d{8}-\d{6}-`)
+
+//BuildRunIDs returns the IDs of the build runs which have logs in logDirectory, most recent first
+func BuildRunIDs(logDirectory string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(logDirectory, "builds"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var runIDs []string
+	for _, entry := range entries {
+		if entry.IsDir() && buildRunIDRegexp.MatchString(entry.Name()) {
+			runIDs = append(runIDs, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(runIDs)))
+	return runIDs, nil
+}
+
 func (logger *flatfileLogger) logFile(service string) (*os.File, error) {
 	logger.mutex.Lock()
 	defer logger.mutex.Unlock()
@@ -47,26 +123,41 @@ func (logger *flatfileLogger) logFile(service string) (*os.File, error) {
 	if existingFile, ok := logger.openFiles[service]; ok {
 		logFile = existingFile
 	} else {
-		err := os.MkdirAll(logger.LogDirectory, 0700)
+		err := os.MkdirAll(logger.runDirectory, 0700)
 		if err != nil {
 			return nil, errors.Errorf(
 				"Could not make the logs output directory at %s: %s",
-				logger.LogDirectory,
+				logger.runDirectory,
 				err.Error())
 		}
+		if len(logger.openFiles) == 0 {
+			latest := filepath.Join(filepath.Dir(logger.runDirectory), "latest")
+			os.Remove(latest)
+			os.Symlink(filepath.Base(logger.runDirectory), latest)
+		}
 		logFile, err = os.OpenFile(
-			filepath.Join(logger.LogDirectory, service+".log"),
-			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			logger.LogPath(service),
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 		if err != nil {
 			return nil, err
 		}
-		logFile.WriteString("") //wipe old logs
 		logger.openFiles[service] = logFile
 	}
 	return logFile, nil
 }
 
+func (logger *flatfileLogger) LogPath(service string) string {
+	if logger.format == LogFormatJSON {
+		return filepath.Join(logger.runDirectory, service+".jsonl")
+	}
+	return filepath.Join(logger.runDirectory, service+".log")
+}
+
 func (logger *flatfileLogger) Log(service string, when time.Time, message ...interface{}) error {
+	return logger.LogStream(service, StreamSanic, when, message...)
+}
+
+func (logger *flatfileLogger) LogStream(service string, stream string, when time.Time, message ...interface{}) error {
 	f, err := logger.logFile(service)
 	if err != nil {
 		return err
@@ -75,7 +166,15 @@ func (logger *flatfileLogger) Log(service string, when time.Time, message ...int
 	defer logger.mutex.Unlock()
 
 	messageString := strings.Trim(fmt.Sprint(message...), "\r\n")
-	_, err = f.WriteString(fmt.Sprintf("[%s] %s\n", when.In(time.Local), messageString))
+	if logger.format == LogFormatJSON {
+		var line []byte
+		line, err = json.Marshal(LogLine{Time: when, Service: service, Stream: stream, Message: messageString})
+		if err == nil {
+			_, err = f.Write(append(line, '\n'))
+		}
+	} else {
+		_, err = f.WriteString(fmt.Sprintf("[%s] %s\n", when.In(time.Local), messageString))
+	}
 	for _, listener := range logger.logLineListeners {
 		listener(service, messageString+"\n")
 	}
@@ -85,6 +184,34 @@ func (logger *flatfileLogger) Log(service string, when time.Time, message ...int
 	return nil
 }
 
+//logTimeRegexp matches the time at the start of a line of a log in LogFormatText
+var logTimeRegexp = regexp.MustCompile(`^\[\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(\.\d+)? [+-]\d{4} [^\]]*\] `)
+
+//logFileLines returns the lines of the messages in (a part of) a log file at path, in LogFormatJSON if it is a .jsonl
+//file and otherwise in LogFormatText, without their times, as they are passed to the listeners of the logger
+func logFileLines(data []byte, path string) []string {
+	var messages []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasSuffix(path, ".jsonl") {
+			var logLine LogLine
+			if json.Unmarshal([]byte(line), &logLine) != nil {
+				continue
+			}
+			line = logLine.Message
+		} else {
+			line = logTimeRegexp.ReplaceAllString(line, "")
+		}
+		messages = append(messages, line)
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.Join(messages, "\n"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
 func humanReadableBytes(bytes int64) string {
 	suf := []string{"B", "KB", "MB", "GB", "TB", "PB", "EB"}
 	if bytes == 0 {
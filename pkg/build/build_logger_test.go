@@ -0,0 +1,43 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogFileLines(t *testing.T) {
+	for _, format := range []string{LogFormatText, LogFormatJSON} {
+		t.Run(format, func(t *testing.T) {
+			logDirectory, err := ioutil.TempDir("", "sanic-logger-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(logDirectory)
+			logger := NewFlatfileLogger(logDirectory, NewBuildRunID("abc"), format, 0, false)
+			defer logger.Close()
+			var listened []string
+			logger.AddLogLineListener(func(service, logLine string) {
+				for _, line := range strings.Split(logLine, "\n") {
+					if line = strings.TrimSpace(line); line != "" {
+						listened = append(listened, line)
+					}
+				}
+			})
+
+			logger.Log("web", time.Now(), "Building...")
+			logger.LogStream("web", StreamStdout, time.Now(), "#1 [internal] load build definition\n#1 DONE 0.0s\n\n")
+			logger.LogStream("web", StreamStderr, time.Now(), "[1/2] FROM alpine")
+			data, err := ioutil.ReadFile(logger.LogPath("web"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lines := logFileLines(data, logger.LogPath("web")); !reflect.DeepEqual(lines, listened) {
+				t.Errorf("got %q from the log file, but the listener got %q", lines, listened)
+			}
+		})
+	}
+}
@@ -6,12 +6,33 @@ import (
 	"context"
 	"fmt"
 	"github.com/pkg/errors"
+	"github.com/webappio/sanic/pkg/bridge/registry"
+	"github.com/webappio/sanic/pkg/config"
+	"github.com/webappio/sanic/pkg/shell"
 	"github.com/webappio/sanic/pkg/util"
+	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
-//Builder uses buildkit to build a list of service directories
+const (
+	//BackendDocker builds images by running "docker build"
+	BackendDocker = "docker"
+	//BackendBuildkit builds images by sending them to a buildkitd daemon
+	BackendBuildkit = "buildkit"
+	//BackendPodman builds images by running "podman build", e.g., for rootless workstations
+	BackendPodman = "podman"
+	//BackendKaniko builds images in the kubernetes cluster, as jobs which run kaniko
+	BackendKaniko = "kaniko"
+)
+
+//Builder builds the images of services with one of the Backends, and tags and pushes them
 type Builder struct {
 	Registry         string
 	RegistryInsecure bool
@@ -20,74 +41,449 @@ type Builder struct {
 	Logger           Logger
 	Interface        Interface
 	DoPush           bool
+	//Graph is the dependencies between the services, or nil to build every service on its own.
+	//Services are built from the images of the services they depend on which this builder tags, see dockerfile.
+	Graph *Graph
+	//Backend is one of BackendDocker (the default if empty), BackendBuildkit, BackendPodman or BackendKaniko
+	Backend string
+	//BuildkitAddr is the address of the buildkitd daemon for BackendBuildkit, or empty for $BUILDKIT_HOST or buildkit's default
+	BuildkitAddr string
+	//ServiceConfigs are the build configurations of each service for the current environment, keyed by service name.
+	//Their Context must be an absolute path.
+	ServiceConfigs map[string]config.ServiceBuild
+	//ServiceTags are the content hashes of each service (see ContentHashes), used as their tags instead of BuildTag
+	ServiceTags map[string]string
+	//SkipUpToDate skips building services whose image with the same tag already exists
+	//(in the registry if DoPush is set, otherwise in the local docker daemon)
+	SkipUpToDate bool
+	//RegistryCredentials are used to query the Registry, or nil to only query it anonymously
+	RegistryCredentials *registry.Credentials
+	//DockerConfig is a directory with a docker config.json to use for docker and buildkit (i.e., for pushing),
+	//or "" to use the user's
+	DockerConfig string
+	//CacheFrom and CacheTo are where builds import and export their layer cache, at CacheRef:
+	//config.CacheInline, config.CacheRegistry, or "" for neither. The cache is only exported if DoPush is set.
+	CacheFrom string
+	CacheTo   string
+	//NoCache builds every step again, without using the local cache or CacheFrom
+	NoCache bool
+	//Provenance is stamped on every image as labels, or nil to only add the labels in ServiceConfigs
+	Provenance *Provenance
+	//KubectlCommand creates kubectl commands for the environment's cluster (see provisioner.Provisioner),
+	//which BackendKaniko runs its builds in
+	KubectlCommand func(args ...string) (*exec.Cmd, error)
+	//History is compared against to check the maxImageGrowth of services, or nil to not check it
+	History *BuildHistory
+	//Shell runs the hooks of services (see config.BuildHooks), or nil if there is no sanic environment to run them in
+	Shell shell.Shell
+
+	state *builderState
+}
+
+//builderState is what a Builder sets up once it needs it. Copies of a Builder share it, e.g., the buildkit session.
+type builderState struct {
+	buildkitCheck      sync.Once
+	buildkitErr        error
+	buildkit           *buildkitSession
+	registryClientOnce sync.Once
+	registryClient     *registry.Client
+
+	buildkitPlatformsCheck sync.Once
+	buildkitPlatformList   []string
+	buildkitPlatformsErr   error
+	buildxPlatformsCheck   sync.Once
+	buildxPlatformList     []string
+	buildxPlatformsErr     error
+}
+
+//builderStateLock guards creating the state of Builders, since their jobs run concurrently
+var builderStateLock sync.Mutex
+
+//shared returns the state of the builder, which is created the first time it is needed
+func (builder *Builder) shared() *builderState {
+	builderStateLock.Lock()
+	defer builderStateLock.Unlock()
+	if builder.state == nil {
+		builder.state = &builderState{}
+	}
+	return builder.state
+}
+
+//command creates an exec.Cmd for docker or podman, which uses the builder's DockerConfig
+func (builder *Builder) command(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	if builder.DockerConfig != "" {
+		//podman does not read docker's config directory, only its own auth file (which has the same format)
+		cmd.Env = append(os.Environ(),
+			"DOCKER_CONFIG="+builder.DockerConfig,
+			"REGISTRY_AUTH_FILE="+filepath.Join(builder.DockerConfig, "config.json"))
+	}
+	return cmd
 }
 
 func (builder *Builder) runCommandAndOutput(cmd *exec.Cmd, ctx context.Context, serviceName string) error {
-	stdout, err := cmd.StdoutPipe()
+	stdoutReader, stdoutWriter, err := os.Pipe()
 	if err != nil {
 		return errors.Wrap(err, "could not pipe stdout from docker build command")
 	}
+	defer stdoutReader.Close()
+	defer stdoutWriter.Close()
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "could not pipe stderr from docker build command")
+	}
+	defer stderrReader.Close()
+	defer stderrWriter.Close()
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
 
 	stderr := &bytes.Buffer{}
-	cmd.Stderr = stderr
+	stdoutDone := builder.logOutput(stdoutReader, serviceName, StreamStdout, nil)
+	stderrDone := builder.logOutput(stderrReader, serviceName, StreamStderr, func(line string) {
+		stderr.WriteString(line + "\n")
+	})
 
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	//the command has its own copies of the pipes, so close ours to see EOF when it exits
+	stdoutWriter.Close()
+	stderrWriter.Close()
+
+	err = util.WaitCmdContextually(ctx, cmd)
+	<-stdoutDone
+	<-stderrDone
+	return errors.Wrapf(err, "error: %v", stderr)
+}
+
+//logOutput logs every line read from r as the given stream of the service, and calls onLine (if it is not nil) with it.
+//The returned channel is closed once r is exhausted.
+func (builder *Builder) logOutput(r io.Reader, serviceName, stream string, onLine func(line string)) <-chan interface{} {
+	done := make(chan interface{})
 	go func() {
-		buildOut := bufio.NewScanner(stdout)
-		for buildOut.Scan() {
-			err = builder.Logger.Log(serviceName, time.Now(), buildOut.Text())
-			if err != nil {
-				return
+		defer close(done)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			builder.Logger.LogStream(serviceName, stream, time.Now(), scanner.Text())
+			if onLine != nil {
+				onLine(scanner.Text())
 			}
 		}
 	}()
+	return done
+}
 
-	err = cmd.Start()
+//ImageName returns the name of a service's image in the registry, i.e., prefixed with the namespace if there is one
+func (builder *Builder) ImageName(service util.BuildableService) string {
+	if builder.NameSpace != "" {
+		return fmt.Sprintf("%s-%s", builder.NameSpace, service.Name)
+	}
+	return service.Name
+}
+
+//ImageRepository returns the image name (without a tag) of a service, including the namespace and registry
+func (builder *Builder) ImageRepository(service util.BuildableService) string {
+	if builder.Registry != "" {
+		return fmt.Sprintf("%s/%s", builder.Registry, builder.ImageName(service))
+	}
+	return builder.ImageName(service)
+}
+
+//ServiceTag returns the tag for a service's image: its content hash if there is one (see ContentHashes), otherwise BuildTag
+func (builder *Builder) ServiceTag(service util.BuildableService) string {
+	if tag, ok := builder.ServiceTags[service.Name]; ok {
+		return tag
+	}
+	return builder.BuildTag
+}
+
+//taggedImage returns the image that a service is built into, with its tag
+func (builder *Builder) taggedImage(service util.BuildableService) string {
+	return fmt.Sprintf("%s:%s", builder.ImageRepository(service), builder.ServiceTag(service))
+}
+
+//serviceConfig returns the build configuration for a service, or an empty configuration if there is none
+func (builder *Builder) serviceConfig(service util.BuildableService) config.ServiceBuild {
+	return builder.ServiceConfigs[service.Name]
+}
+
+//buildArgs returns the build args for a service as NAME=value, or as just NAME if the value should
+//come from the environment (which is always the case for SANIC_ENV and CI)
+func (builder *Builder) buildArgs(service util.BuildableService) []string {
+	args := []string{"SANIC_ENV", "CI"}
+	serviceArgs := builder.serviceConfig(service).Args
+	var argNames []string
+	for name := range serviceArgs {
+		argNames = append(argNames, name)
+	}
+	sort.Strings(argNames)
+	for _, name := range argNames {
+		if value := serviceArgs[name]; value != nil {
+			args = append(args, name+"="+*value)
+		} else {
+			args = append(args, name)
+		}
+	}
+	return args
+}
+
+//sortedKeys returns the keys of a map in order, so that the arguments built from it are the same in every build
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//buildContext returns the absolute path of the build context for a service
+func (builder *Builder) buildContext(service util.BuildableService) string {
+	if context := builder.serviceConfig(service).Context; context != "" {
+		return context
+	}
+	return service.Dir
+}
+
+//dockerfile returns the path of the Dockerfile to build a service with, and a function which removes it after the build.
+//If the service is built from other services (see Graph), it is a temporary copy of the service's Dockerfile in which
+//their images are replaced with the ones this builder tags, so that the service is built from the images that were
+//just built, rather than from whatever their names resolve to (e.g., python-base:latest).
+func (builder *Builder) dockerfile(service util.BuildableService) (string, func(), error) {
+	dockerfilePath := filepath.Join(service.Dir, service.Dockerfile)
+	if builder.Graph == nil || len(builder.Graph.Parents(service.Name)) == 0 {
+		return dockerfilePath, func() {}, nil
+	}
+	dockerfile, err := util.RewriteDockerfileImages(dockerfilePath, func(image string) (string, bool) {
+		parent, ok := builder.Graph.ServiceOfImage(image)
+		if !ok || parent == service.Name {
+			return "", false
+		}
+		return builder.taggedImage(util.BuildableService{Name: parent}), true
+	})
 	if err != nil {
-		return err
+		return "", nil, errors.Wrapf(err, "could not read the Dockerfile of %s", service.Name)
+	}
+	dir, err := ioutil.TempDir("", "sanic-dockerfile")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	if err := ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), dockerfile, 0644); err != nil {
+		cleanup()
+		return "", nil, err
 	}
+	return filepath.Join(dir, "Dockerfile"), cleanup, nil
+}
 
-	err = util.WaitCmdContextually(ctx, cmd)
-	return errors.Wrapf(err, "error: %v", stderr)
+//checkParentsPushed returns an error if a service is built from other services by a backend which runs outside of docker
+//(e.g., buildkitd), but the images of those services are only in docker because they are not pushed
+func (builder *Builder) checkParentsPushed(service util.BuildableService, backend string) error {
+	if builder.DoPush || builder.Graph == nil || len(builder.Graph.Parents(service.Name)) == 0 {
+		return nil
+	}
+	return fmt.Errorf("the %s backend can only build %s from %s with --push, since it cannot use images that are only in docker",
+		backend, service.Name, strings.Join(builder.Graph.Parents(service.Name), ", "))
+}
+
+//alwaysBuilt returns whether a service is built even if its image is up to date: when it, or a service it is built
+//from, has a preBuild hook, since its tag cannot include the files which the hook generates (see ContentHashes)
+func (builder *Builder) alwaysBuilt(service util.BuildableService) bool {
+	if builder.serviceConfig(service).Hooks.PreBuild != "" {
+		return true
+	}
+	if builder.Graph == nil {
+		return false
+	}
+	for _, parent := range builder.Graph.Parents(service.Name) {
+		if builder.alwaysBuilt(util.BuildableService{Name: parent}) {
+			return true
+		}
+	}
+	return false
 }
 
 //BuildService builds a specific sevice directory with a specific context
 func (builder *Builder) BuildService(ctx context.Context, service util.BuildableService) error {
-	fullImageName := fmt.Sprintf("%s:%s", service.Name, builder.BuildTag)
-	if builder.NameSpace != "" {
-		fullImageName = fmt.Sprintf("%s-%s:%s", builder.NameSpace, service.Name, builder.BuildTag)
+	return builder.buildService(ctx, service, builder.SkipUpToDate, nil)
+}
+
+//RetagService is for services which are known not to have changed: their existing image is tagged with
+//every tag that building them would add (see SkipUpToDate). If the image does not exist, the service is built.
+func (builder *Builder) RetagService(ctx context.Context, service util.BuildableService) error {
+	return builder.buildService(ctx, service, true, nil)
+}
+
+//buildService builds a service as a single job of the Interface. If test is not nil, it runs in the same job with the
+//name of the image once it is built (or up to date), and its error fails the job.
+func (builder *Builder) buildService(ctx context.Context, service util.BuildableService, skipUpToDate bool, test func(ctx context.Context, image string) error) error {
+	imageRepository := builder.ImageRepository(service)
+	fullImageName := builder.taggedImage(service)
+	imageNames := []string{fullImageName}
+	if builder.ServiceTag(service) != builder.BuildTag {
+		//also tag it with the tag of the whole repository, for deploy templates which only use IMAGE_TAG
+		imageNames = append(imageNames, fmt.Sprintf("%s:%s", imageRepository, builder.BuildTag))
 	}
-	if builder.Registry != "" {
-		fullImageName = fmt.Sprintf("%s/%s", builder.Registry, fullImageName)
+	for _, tag := range builder.serviceConfig(service).Tags {
+		imageNames = append(imageNames, fmt.Sprintf("%s:%s", imageRepository, tag))
+	}
+	if builder.exportsCache() && builder.CacheTo == config.CacheInline {
+		//the image itself holds the inline cache, so it is tagged as the cache for the next build to import
+		imageNames = append(imageNames, builder.CacheRef(service))
 	}
 
 	builder.Interface.StartJob(service.Name, fullImageName)
 
-	cmd := exec.Command("docker", "build",
-		"--build-arg", "SANIC_ENV",
-		"--build-arg", "CI",
-		".",
-		"--file", service.Dockerfile,
-		"--tag", fullImageName)
-	cmd.Dir = service.Dir
-
-	err := builder.runCommandAndOutput(cmd, ctx, service.Name)
+	upToDate := skipUpToDate && !builder.alwaysBuilt(service) && builder.isUpToDate(ctx, service, imageNames)
+	var err error
+	if upToDate {
+		builder.Interface.SetUpToDate(service.Name)
+		builder.Logger.Log(service.Name, time.Now(), "Up to date!")
+	} else {
+		hooks := builder.serviceConfig(service).Hooks
+		err = builder.runHook(ctx, service, "preBuild", hooks.PreBuild, fullImageName)
+		if err == nil {
+			//the preBuild hook may generate the Dockerfile, so it is only read after it
+			var dockerfile string
+			var removeDockerfile func()
+			dockerfile, removeDockerfile, err = builder.dockerfile(service)
+			if err == nil {
+				defer removeDockerfile()
+				err = builder.backend().Build(ctx, builder, service, dockerfile, imageNames)
+			}
+		}
+		if err == nil {
+			err = builder.checkImageSize(ctx, service, fullImageName)
+		}
+		if err == nil {
+			err = builder.runHook(ctx, service, "postBuild", hooks.PostBuild, fullImageName)
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		//the job is marked as cancelled by whoever cancelled it
+		builder.Logger.Log(service.Name, time.Now(), "Build cancelled.")
+		return ctx.Err()
+	}
 	if err != nil {
 		builder.Interface.FailJob(service.Name, err)
 		builder.Logger.Log(service.Name, time.Now(), "Build failed! ", err.Error())
 		return errors.Wrap(err, "could not build "+service.Name)
 	}
+	if !upToDate {
+		builder.Logger.Log(service.Name, time.Now(), "Build succeeded!")
+	}
 
-	if builder.DoPush {
-		cmd = exec.Command("docker", "push", fullImageName)
-		builder.Logger.Log(service.Name, time.Now(), "pushing image to registry...")
-		err = builder.runCommandAndOutput(cmd, ctx, service.Name)
+	if test != nil {
+		err = test(ctx, fullImageName)
+		if err != nil && ctx.Err() != nil {
+			builder.Logger.Log(service.Name, time.Now(), "Tests cancelled.")
+			return ctx.Err()
+		}
 		if err != nil {
 			builder.Interface.FailJob(service.Name, err)
-			return errors.Wrap(err, "could not push "+service.Name)
+			builder.Logger.Log(service.Name, time.Now(), "Tests failed! ", err.Error())
+			return errors.Wrap(err, "the tests of "+service.Name+" failed")
 		}
+		builder.Logger.Log(service.Name, time.Now(), "Tests passed!")
 	}
 
 	builder.Interface.SucceedJob(service.Name)
-	builder.Logger.Log(service.Name, time.Now(), "Build succeeded!")
-	return err
+	return nil
+}
+
+//runHook runs one of a service's hooks (see config.BuildHooks) in its directory, if it has one, and logs its output.
+//The hook gets the name of the service and its image as SANIC_SERVICE and SANIC_IMAGE.
+func (builder *Builder) runHook(ctx context.Context, service util.BuildableService, name, command, image string) error {
+	if command == "" {
+		return nil
+	}
+	if builder.Shell == nil {
+		return fmt.Errorf("the %s hook can only run in a sanic environment, see sanic env", name)
+	}
+	builder.Logger.Log(service.Name, time.Now(), "Running the ", name, " hook...")
+	cmd := builder.Shell.ShellCommand(service.Dir, command, nil)
+	cmd.Env = append(cmd.Env, "SANIC_SERVICE="+service.Name, "SANIC_IMAGE="+image)
+	//so that cancelling the build also kills what the hook's shell started, which would otherwise keep its output open
+	util.SetProcessGroup(cmd)
+	if err := builder.runCommandAndOutput(cmd, ctx, service.Name); err != nil {
+		return errors.Wrapf(err, "the %s hook failed", name)
+	}
+	return nil
+}
+
+//buildWithDocker builds a service with "docker build", and then pushes it with "docker push" if DoPush is set
+func (builder *Builder) buildWithDocker(ctx context.Context, service util.BuildableService, dockerfile string, imageNames []string) error {
+	serviceConfig := builder.serviceConfig(service)
+	args := []string{"build"}
+	for _, buildArg := range builder.buildArgs(service) {
+		args = append(args, "--build-arg", buildArg)
+	}
+	if serviceConfig.Target != "" {
+		args = append(args, "--target", serviceConfig.Target)
+	}
+	if serviceConfig.Network != "" {
+		args = append(args, "--network", serviceConfig.Network)
+	}
+	if builder.NoCache {
+		args = append(args, "--no-cache")
+	}
+	labels := builder.imageLabels(service)
+	var labelNames []string
+	for name := range labels {
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+	for _, name := range labelNames {
+		args = append(args, "--label", name+"="+labels[name])
+	}
+	for _, imageName := range imageNames {
+		args = append(args, "--tag", imageName)
+	}
+	args = append(args,
+		"--file", dockerfile,
+		builder.buildContext(service))
+
+	cmd := builder.command("docker", args...)
+	cmd.Dir = service.Dir
+
+	err := builder.runCommandAndOutput(cmd, ctx, service.Name)
+	if err != nil {
+		return err
+	}
+
+	if builder.DoPush {
+		builder.Interface.SetPushing(service.Name)
+		builder.Logger.Log(service.Name, time.Now(), "pushing image to registry...")
+		for _, imageName := range imageNames {
+			cmd = builder.command("docker", "push", imageName)
+			err = builder.runCommandAndOutput(cmd, ctx, service.Name)
+			if err != nil {
+				return errors.Wrap(err, "could not push")
+			}
+		}
+		if digest := pushedDigest("docker", imageNames[0]); digest != "" {
+			builder.Interface.SetDigest(service.Name, digest)
+		}
+	}
+	return nil
+}
+
+//pushedDigest returns the digest of a pushed image (e.g., sha256:abc...) in the registry it was pushed to, or "" if it is unknown.
+//imageStore is the CLI which pushed it, docker or podman.
+func pushedDigest(imageStore, image string) string {
+	cmd := exec.Command(imageStore, "image", "inspect", "--format", "{{range .RepoDigests}}{{.}}\n{{end}}", image)
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	if cmd.Run() != nil {
+		return ""
+	}
+	repository := image[:strings.LastIndex(image, ":")]
+	for _, repoDigest := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(repoDigest, repository+"@") {
+			return strings.TrimPrefix(repoDigest, repository+"@")
+		}
+	}
+	return ""
 }
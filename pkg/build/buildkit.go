@@ -0,0 +1,456 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/auth/authprovider"
+	"github.com/moby/buildkit/session/filesync"
+	"github.com/moby/buildkit/util/appdefaults"
+	"github.com/pkg/errors"
+	"github.com/webappio/sanic/pkg/util"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Vertex is a single step of a build (e.g., "[2/5] RUN pip install -r requirements.txt"), as reported by buildkit
+type Vertex struct {
+	Digest    string
+	Name      string
+	Cached    bool
+	Started   *time.Time
+	Completed *time.Time
+	Error     string
+	//Current and Total are the bytes transferred so far for this step (e.g., pulling or exporting layers), if any
+	Current int64
+	Total   int64
+	//Platform and Step are parsed from the name of Dockerfile steps, e.g., linux/arm64 and 2/5 for
+	//"[linux/arm64 2/5] RUN pip install -r requirements.txt". Platform is only set in multi-platform builds,
+	//and both are empty for other steps (e.g., "[internal] load build definition from Dockerfile").
+	Platform string
+	Step     string
+}
+
+var platformStepRegex = regexp.MustCompile(`^\[(?:([a-z0-9_]+/[a-z0-9_/.-]+) )?(?:\S+ )?(\d+/\d+)\]`)
+
+//vertexPlatformStep returns the platform and step of a vertex name, see Vertex.Platform
+func vertexPlatformStep(name string) (platform, step string) {
+	match := platformStepRegex.FindStringSubmatch(name)
+	if match == nil {
+		return "", ""
+	}
+	return match[1], match[2]
+}
+
+//buildkitProgress merges the solve statuses of a single build into the current state of each of its vertices
+type buildkitProgress struct {
+	vertices map[string]*Vertex
+	progress map[string]map[string][2]int64 //vertex digest -> status id -> current, total
+	logged   map[string]string              //vertex digest -> the last state which was logged for it
+}
+
+func (progress *buildkitProgress) update(status *client.SolveStatus) (changed []Vertex) {
+	changedDigests := make(map[string]bool)
+	var order []string
+	markChanged := func(digest string) {
+		if !changedDigests[digest] {
+			changedDigests[digest] = true
+			order = append(order, digest)
+		}
+	}
+
+	for _, v := range status.Vertexes {
+		vertex, ok := progress.vertices[v.Digest.String()]
+		if !ok {
+			vertex = &Vertex{Digest: v.Digest.String()}
+			progress.vertices[v.Digest.String()] = vertex
+		}
+		vertex.Name = v.Name
+		vertex.Platform, vertex.Step = vertexPlatformStep(v.Name)
+		vertex.Started = v.Started
+		vertex.Completed = v.Completed
+		vertex.Cached = v.Cached
+		vertex.Error = v.Error
+		markChanged(v.Digest.String())
+	}
+	for _, s := range status.Statuses {
+		digest := s.Vertex.String()
+		vertex, ok := progress.vertices[digest]
+		if !ok {
+			continue
+		}
+		if progress.progress[digest] == nil {
+			progress.progress[digest] = make(map[string][2]int64)
+		}
+		progress.progress[digest][s.ID] = [2]int64{s.Current, s.Total}
+		vertex.Current, vertex.Total = 0, 0
+		for _, p := range progress.progress[digest] {
+			vertex.Current += p[0]
+			vertex.Total += p[1]
+		}
+		markChanged(digest)
+	}
+
+	for _, digest := range order {
+		changed = append(changed, *progress.vertices[digest])
+	}
+	return
+}
+
+//buildkitSession is the connection to buildkitd which every build of a Builder shares, along with a single session,
+//so that buildkitd keeps the build contexts that it was sent for the next builds. The session is started before any
+//build, so builds register the directories that they send in it, and where the images that they export are written.
+type buildkitSession struct {
+	client  *client.Client
+	session *session.Session
+
+	lock    sync.Mutex
+	dirs    map[string]filesync.SyncedDir
+	outputs map[string]io.WriteCloser //first image name of a build (as buildkit normalizes it) -> where it is written
+}
+
+//LookupDir returns a directory which a running build sends to buildkitd, see filesync.DirSource
+func (bs *buildkitSession) LookupDir(name string) (filesync.SyncedDir, bool) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	dir, ok := bs.dirs[name]
+	return dir, ok
+}
+
+//output returns where an image that buildkitd exports is written, by the image.name in the exporter's metadata
+func (bs *buildkitSession) output(metadata map[string]string) (io.WriteCloser, error) {
+	name := strings.Split(metadata["image.name"], ",")[0]
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	output, ok := bs.outputs[name]
+	if !ok {
+		return nil, fmt.Errorf("no build exports %s", name)
+	}
+	return output, nil
+}
+
+//register adds the directories of a build to the session, and where its image (the first of imageNames) is written
+//if it is exported rather than pushed. The returned function removes them once the build is done.
+func (bs *buildkitSession) register(dirs map[string]filesync.SyncedDir, imageName string, output io.WriteCloser) (func(), error) {
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid image name %s", imageName)
+	}
+	imageName = reference.TagNameOnly(named).String()
+
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	for name, dir := range dirs {
+		bs.dirs[name] = dir
+	}
+	if output != nil {
+		bs.outputs[imageName] = output
+	}
+	return func() {
+		bs.lock.Lock()
+		defer bs.lock.Unlock()
+		for name := range dirs {
+			delete(bs.dirs, name)
+		}
+		if output != nil {
+			delete(bs.outputs, imageName)
+		}
+	}, nil
+}
+
+//buildkitAddr returns the address of the buildkitd daemon: BuildkitAddr, $BUILDKIT_HOST, or buildkit's default socket
+func (builder *Builder) buildkitAddr() string {
+	if builder.BuildkitAddr != "" {
+		return builder.BuildkitAddr
+	}
+	if addr := os.Getenv("BUILDKIT_HOST"); addr != "" {
+		return addr
+	}
+	return appdefaults.Address
+}
+
+//checkBuildkit connects to the buildkitd daemon and starts the session that every build shares.
+//It only connects once per Builder (and its copies, e.g., for testTarget stages), so that every service in a run uses the
+//same daemon, session and cache.
+func (builder *Builder) checkBuildkit() error {
+	state := builder.shared()
+	state.buildkitCheck.Do(func() {
+		state.buildkit, state.buildkitErr = builder.startBuildkitSession()
+	})
+	return state.buildkitErr
+}
+
+func (builder *Builder) startBuildkitSession() (*buildkitSession, error) {
+	addr := builder.buildkitAddr()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := client.New(ctx, addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not connect to buildkitd at %s", addr)
+	}
+	if _, err := c.ListWorkers(ctx); err != nil {
+		c.Close()
+		return nil, errors.Wrapf(err, "could not connect to buildkitd at %s", addr)
+	}
+
+	var dockerConfig *configfile.ConfigFile
+	if builder.DockerConfig != "" {
+		dockerConfig, err = config.Load(builder.DockerConfig)
+	} else {
+		dockerConfig, err = config.Load(config.Dir())
+	}
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "could not read the registry credentials")
+	}
+
+	s, err := session.NewSession(context.Background(), "sanic", "")
+	if err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "could not create a buildkit session")
+	}
+	bs := &buildkitSession{
+		client:  c,
+		session: s,
+		dirs:    make(map[string]filesync.SyncedDir),
+		outputs: make(map[string]io.WriteCloser),
+	}
+	s.Allow(filesync.NewFSSyncProvider(bs))
+	s.Allow(filesync.NewFSSyncTarget(bs.output))
+	s.Allow(authprovider.NewDockerAuthProvider(dockerConfig))
+	go s.Run(context.Background(), c.Dialer())
+	return bs, nil
+}
+
+//Close ends the buildkit session that the builds of the Builder share, if it started one
+func (builder *Builder) Close() {
+	if bs := builder.shared().buildkit; bs != nil {
+		bs.session.Close()
+		bs.client.Close()
+	}
+}
+
+//dockerignoreExcludes returns the patterns in the .dockerignore of a build context, if it has one
+func dockerignoreExcludes(contextDir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(contextDir, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return dockerignore.ReadAll(f)
+}
+
+//cacheOptionsEntry parses a cache import or export option (see cacheImport and cacheExport), e.g., type=inline
+func cacheOptionsEntry(option string) client.CacheOptionsEntry {
+	entry := client.CacheOptionsEntry{Attrs: make(map[string]string)}
+	for _, field := range strings.Split(option, ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if parts[0] == "type" {
+			entry.Type = parts[1]
+		} else {
+			entry.Attrs[parts[0]] = parts[1]
+		}
+	}
+	return entry
+}
+
+//buildWithBuildkit builds (and, if DoPush is set, pushes) a service with the buildkitd daemon, in the session which
+//every build shares. If the image is not pushed, it is loaded into the local docker daemon instead.
+func (builder *Builder) buildWithBuildkit(ctx context.Context, service util.BuildableService, dockerfile string, imageNames []string) error {
+	if err := builder.checkParentsPushed(service, "buildkit"); err != nil {
+		return err
+	}
+	bs := builder.shared().buildkit
+	serviceConfig := builder.serviceConfig(service)
+	contextDir := builder.buildContext(service)
+	excludes, err := dockerignoreExcludes(contextDir)
+	if err != nil {
+		return errors.Wrapf(err, "could not read the .dockerignore of %s", service.Name)
+	}
+
+	frontendAttrs := map[string]string{"filename": filepath.Base(dockerfile)}
+	for _, buildArg := range builder.buildArgs(service) {
+		if !strings.Contains(buildArg, "=") {
+			value, ok := os.LookupEnv(buildArg)
+			if !ok {
+				continue
+			}
+			buildArg += "=" + value
+		}
+		parts := strings.SplitN(buildArg, "=", 2)
+		frontendAttrs["build-arg:"+parts[0]] = parts[1]
+	}
+	if serviceConfig.Target != "" {
+		frontendAttrs["target"] = serviceConfig.Target
+	}
+	if serviceConfig.Network != "" {
+		frontendAttrs["force-network-mode"] = serviceConfig.Network
+	}
+	if len(serviceConfig.Platforms) > 0 {
+		frontendAttrs["platform"] = strings.Join(serviceConfig.Platforms, ",")
+	}
+	if builder.NoCache {
+		frontendAttrs["no-cache"] = ""
+	}
+	for name, value := range builder.imageLabels(service) {
+		frontendAttrs["label:"+name] = value
+	}
+
+	//the directories are named after the build, since every build sends its own in the same session
+	buildID := identity.NewID()
+	contextName, dockerfileName := "context-"+buildID, "dockerfile-"+buildID
+	opt := client.SolveOpt{
+		Frontend:      "dockerfile.v0",
+		FrontendAttrs: frontendAttrs,
+		FrontendInputs: map[string]llb.State{
+			"context": llb.Local(contextName,
+				llb.SessionID(bs.session.ID()),
+				llb.ExcludePatterns(excludes),
+				llb.SharedKeyHint(contextDir),
+				llb.WithCustomName("load build context")),
+			"dockerfile": llb.Local(dockerfileName,
+				llb.SessionID(bs.session.ID()),
+				llb.FollowPaths([]string{filepath.Base(dockerfile)}),
+				llb.SharedKeyHint(dockerfile),
+				llb.WithCustomName("load build definition from "+filepath.Base(dockerfile))),
+		},
+		SharedSession:         bs.session,
+		SessionPreInitialized: true,
+	}
+	if builder.importsCache() {
+		opt.CacheImports = []client.CacheOptionsEntry{cacheOptionsEntry(builder.cacheImport(service))}
+	}
+	if builder.exportsCache() {
+		opt.CacheExports = []client.CacheOptionsEntry{cacheOptionsEntry(builder.cacheExport(service))}
+	}
+
+	var loadCmd *exec.Cmd
+	var loadIn io.WriteCloser
+	loadOut := &bytes.Buffer{}
+	if builder.DoPush {
+		attrs := map[string]string{"name": strings.Join(imageNames, ","), "push": "true"}
+		if builder.RegistryInsecure {
+			attrs["registry.insecure"] = "true"
+		}
+		opt.Exports = []client.ExportEntry{{Type: client.ExporterImage, Attrs: attrs}}
+		builder.Interface.SetPushing(service.Name)
+	} else {
+		opt.Exports = []client.ExportEntry{{Type: client.ExporterDocker, Attrs: map[string]string{"name": strings.Join(imageNames, ",")}}}
+		loadCmd = builder.command("docker", "load")
+		loadCmd.Stdout = loadOut
+		loadCmd.Stderr = loadOut
+		if loadIn, err = loadCmd.StdinPipe(); err != nil {
+			return errors.Wrap(err, "could not create a pipe to load the image into docker")
+		}
+		if err := loadCmd.Start(); err != nil {
+			return errors.Wrap(err, "could not start docker load")
+		}
+	}
+
+	unregister, err := bs.register(map[string]filesync.SyncedDir{
+		contextName:    {Dir: contextDir},
+		dockerfileName: {Dir: filepath.Dir(dockerfile)},
+	}, imageNames[0], loadIn)
+	if err != nil {
+		return err
+	}
+	defer unregister()
+
+	statusChan := make(chan *client.SolveStatus)
+	statusDone := make(chan interface{})
+	go func() {
+		defer close(statusDone)
+		progress := &buildkitProgress{
+			vertices: make(map[string]*Vertex),
+			progress: make(map[string]map[string][2]int64),
+			logged:   make(map[string]string),
+		}
+		for status := range statusChan {
+			builder.processSolveStatus(service.Name, progress, status)
+		}
+	}()
+	resp, err := bs.client.Solve(ctx, nil, opt, statusChan)
+	<-statusDone
+
+	if loadCmd != nil {
+		//docker load sees the end of the image once the exporter closes its stdin, or if the build failed before that
+		loadIn.Close()
+		loadErr := util.WaitCmdContextually(ctx, loadCmd)
+		if err == nil && loadErr != nil {
+			return errors.Wrapf(loadErr, "could not load the built image into docker: %s", strings.TrimSpace(loadOut.String()))
+		}
+		if err == nil {
+			builder.Logger.LogStream(service.Name, StreamStdout, time.Now(), strings.TrimSpace(loadOut.String()))
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if digest, ok := resp.ExporterResponse[exptypes.ExporterImageDigestKey]; ok && builder.DoPush {
+		builder.Interface.SetDigest(service.Name, digest)
+	}
+	return nil
+}
+
+//processSolveStatus sends vertex updates to the Interface, and logs step output and step completion to the Logger
+func (builder *Builder) processSolveStatus(service string, progress *buildkitProgress, status *client.SolveStatus) {
+	for _, vertex := range progress.update(status) {
+		builder.Interface.ProcessVertex(service, vertex)
+	}
+	for _, v := range status.Vertexes {
+		var state string
+		var when time.Time
+		var message string
+		switch {
+		case v.Error != "":
+			state, when, message = "error", time.Now(), v.Name+" ERROR: "+v.Error
+		case v.Cached:
+			state, when, message = "cached", time.Now(), v.Name+" CACHED"
+		case v.Completed != nil && v.Started != nil:
+			state, when, message = "done", *v.Completed, fmt.Sprintf("%s DONE %.1fs", v.Name, v.Completed.Sub(*v.Started).Seconds())
+		case v.Started != nil:
+			state, when, message = "started", *v.Started, v.Name
+		default:
+			continue
+		}
+		if progress.logged[v.Digest.String()] == state {
+			continue
+		}
+		progress.logged[v.Digest.String()] = state
+		builder.Logger.LogStream(service, StreamStderr, when, message)
+	}
+	for _, l := range status.Logs {
+		//the output of the build steps themselves, where 1 is their stdout and 2 is their stderr
+		stream := StreamStdout
+		if l.Stream == 2 {
+			stream = StreamStderr
+		}
+		for _, line := range strings.Split(strings.TrimRight(string(l.Data), "\n"), "\n") {
+			builder.Logger.LogStream(service, stream, l.Timestamp, line)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package build
+
+import (
+	"github.com/webappio/sanic/pkg/config"
+	"github.com/webappio/sanic/pkg/util"
+)
+
+//CacheTag is the tag of the image which holds the build cache of a service, next to its other tags
+const CacheTag = "buildcache"
+
+//CacheRef returns the image which a service's build cache is imported from and exported to (see CacheFrom and CacheTo)
+func (builder *Builder) CacheRef(service util.BuildableService) string {
+	return builder.ImageRepository(service) + ":" + CacheTag
+}
+
+//cacheRepository returns the repository which holds a service's build cache for the backends (podman and kaniko)
+//which push every cached layer as its own image, rather than a single cache image at CacheRef
+func (builder *Builder) cacheRepository(service util.BuildableService) string {
+	return builder.ImageRepository(service) + "/" + CacheTag
+}
+
+//importsCache returns whether builds import their layer cache from the registry
+func (builder *Builder) importsCache() bool {
+	return builder.CacheFrom != "" && builder.Registry != "" && !builder.NoCache
+}
+
+//exportsCache returns whether builds export their layer cache, which is only possible when they are pushed
+func (builder *Builder) exportsCache() bool {
+	return builder.CacheTo != "" && builder.Registry != "" && builder.DoPush
+}
+
+//cacheImport returns the cache import option of a service for buildkit (see cacheOptionsEntry) or buildx --cache-from.
+//Inline caches are in images, which the registry cache importer reads as well.
+func (builder *Builder) cacheImport(service util.BuildableService) string {
+	option := "type=registry,ref=" + builder.CacheRef(service)
+	if builder.RegistryInsecure {
+		option += ",registry.insecure=true"
+	}
+	return option
+}
+
+//cacheExport returns the cache export option of a service for buildkit (see cacheOptionsEntry) or buildx --cache-to
+func (builder *Builder) cacheExport(service util.BuildableService) string {
+	if builder.CacheTo == config.CacheInline {
+		return "type=inline"
+	}
+	option := "type=registry,ref=" + builder.CacheRef(service) + ",mode=max"
+	if builder.RegistryInsecure {
+		option += ",registry.insecure=true"
+	}
+	return option
+}
@@ -0,0 +1,139 @@
+package build
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/webappio/sanic/pkg/util"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//Graph is the dependency graph between services, where a service depends on every other service
+//whose image is referenced by its Dockerfile (e.g., FROM python-base, or COPY --from=python-base)
+type Graph struct {
+	services map[string]util.BuildableService
+	parents  map[string][]string
+	children map[string][]string
+	images   map[string]string //image name (with or without the namespace) -> service
+}
+
+//imageReferenceName strips the registry, tag and digest from an image reference,
+//e.g., registry.example.com:5000/ns-python-base:abc123 -> ns-python-base
+func imageReferenceName(image string) string {
+	if idx := strings.Index(image, "@"); idx != -1 {
+		image = image[:idx]
+	}
+	if idx := strings.LastIndex(image, "/"); idx != -1 {
+		image = image[idx+1:]
+	}
+	if idx := strings.Index(image, ":"); idx != -1 {
+		image = image[:idx]
+	}
+	return image
+}
+
+//NewGraph parses the Dockerfiles of each service to find dependencies between them.
+//Image references are matched against service names, with or without the given namespace prefix.
+//It returns an error if the dependencies between services form a cycle.
+func NewGraph(services []util.BuildableService, namespace string) (*Graph, error) {
+	graph := &Graph{
+		services: make(map[string]util.BuildableService),
+		parents:  make(map[string][]string),
+		children: make(map[string][]string),
+		images:   make(map[string]string),
+	}
+	for _, service := range services {
+		graph.services[service.Name] = service
+		graph.images[service.Name] = service.Name
+		if namespace != "" {
+			graph.images[namespace+"-"+service.Name] = service.Name
+		}
+	}
+
+	for _, service := range services {
+		images, err := util.DockerfileImageReferences(filepath.Join(service.Dir, service.Dockerfile))
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read the Dockerfile for %s", service.Name)
+		}
+		seenParents := make(map[string]bool)
+		for _, image := range images {
+			parent, ok := graph.ServiceOfImage(image)
+			if !ok || parent == service.Name || seenParents[parent] {
+				continue
+			}
+			seenParents[parent] = true
+			graph.parents[service.Name] = append(graph.parents[service.Name], parent)
+			graph.children[parent] = append(graph.children[parent], service.Name)
+		}
+	}
+
+	if cycle := graph.findCycle(); cycle != nil {
+		return nil, fmt.Errorf("the Dockerfiles of these services depend on each other in a cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return graph, nil
+}
+
+//findCycle returns the services in a dependency cycle (with the first service repeated at the end), or nil
+func (graph *Graph) findCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var stack []string
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, parent := range graph.parents[name] {
+			switch state[parent] {
+			case visiting:
+				for i, stackName := range stack {
+					if stackName == parent {
+						return append(append([]string{}, stack[i:]...), parent)
+					}
+				}
+			case unvisited:
+				if cycle := visit(parent); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		return nil
+	}
+
+	var names []string
+	for name := range graph.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if state[name] == unvisited {
+			if cycle := visit(name); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+//Parents returns the names of the services that the given service's Dockerfile depends on
+func (graph *Graph) Parents(service string) []string {
+	return graph.parents[service]
+}
+
+//Children returns the names of the services whose Dockerfiles depend on the given service
+func (graph *Graph) Children(service string) []string {
+	return graph.children[service]
+}
+
+//ServiceOfImage returns the service that an image reference refers to, if any,
+//e.g., python-base for registry.example.com/ns-python-base:abc123
+func (graph *Graph) ServiceOfImage(image string) (string, bool) {
+	service, ok := graph.images[imageReferenceName(image)]
+	return service, ok
+}
@@ -0,0 +1,147 @@
+package build
+
+import (
+	"github.com/webappio/sanic/pkg/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+//writeServices creates a directory for each service with the given Dockerfile, and returns the services
+func writeServices(t *testing.T, dockerfiles map[string]string) []util.BuildableService {
+	root, err := ioutil.TempDir("", "sanic-graph-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	var names []string
+	for name := range dockerfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var services []util.BuildableService
+	for _, name := range names {
+		dir := filepath.Join(root, name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfiles[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		services = append(services, util.BuildableService{Name: name, Dir: dir, Dockerfile: "Dockerfile"})
+	}
+	return services
+}
+
+func TestNewGraph(t *testing.T) {
+	tests := []struct {
+		name        string
+		namespace   string
+		dockerfiles map[string]string
+		parents     map[string][]string
+		cycle       bool
+	}{
+		{
+			name: "from and copy --from",
+			dockerfiles: map[string]string{
+				"base":   "FROM alpine\n",
+				"assets": "FROM node AS build\nFROM scratch\nCOPY --from=build /out /\n",
+				"web":    "FROM base\nCOPY --from=assets /out /static\n",
+			},
+			parents: map[string][]string{"web": {"base", "assets"}},
+		},
+		{
+			name:      "namespaced, tagged and registry references",
+			namespace: "ns",
+			dockerfiles: map[string]string{
+				"base": "FROM alpine\n",
+				"api":  "FROM registry.example.com:5000/ns-base:abc123\n",
+				"web":  "ARG BASE_IMAGE=base\nFROM ${BASE_IMAGE}\n",
+			},
+			parents: map[string][]string{"api": {"base"}, "web": {"base"}},
+		},
+		{
+			name: "cycle",
+			dockerfiles: map[string]string{
+				"a": "FROM b\n",
+				"b": "FROM a\n",
+			},
+			cycle: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			graph, err := NewGraph(writeServices(t, test.dockerfiles), test.namespace)
+			if test.cycle {
+				if err == nil {
+					t.Fatal("expected an error for the cycle")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name := range test.dockerfiles {
+				if parents := graph.Parents(name); !reflect.DeepEqual(parents, test.parents[name]) {
+					t.Errorf("parents of %s: got %v, want %v", name, parents, test.parents[name])
+				}
+			}
+		})
+	}
+}
+
+//TestDockerfileUsesParentImages checks that a service is built from the images of its parents which the same builder
+//tags, rather than from whatever its Dockerfile's references resolve to
+func TestDockerfileUsesParentImages(t *testing.T) {
+	services := writeServices(t, map[string]string{
+		"base": "FROM alpine\n",
+		"web": "# syntax=docker/dockerfile:1\n" +
+			"ARG BASE=base\n" +
+			"FROM ${BASE} AS build\n" +
+			"RUN echo \\\n" +
+			"  hi\n" +
+			"FROM \\\n" +
+			"  ns-base:old\n" +
+			"COPY --from=build /a /b\n" +
+			"COPY --chown=1:1 --from=base /c /d\n",
+		"tool": "FROM alpine\n",
+	})
+	graph, err := NewGraph(services, "ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := &Builder{Registry: "registry.example.com", BuildTag: "tree", NameSpace: "ns", Graph: graph}
+
+	dockerfile, removeDockerfile, err := builder.dockerfile(services[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeDockerfile()
+	contents, err := ioutil.ReadFile(dockerfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# syntax=docker/dockerfile:1\n" +
+		"ARG BASE=base\n" +
+		"FROM registry.example.com/ns-base:tree AS build\n" +
+		"RUN echo \\\n" +
+		"  hi\n" +
+		"FROM registry.example.com/ns-base:tree\n" +
+		"COPY --from=build /a /b\n" +
+		"COPY --chown=1:1 --from=registry.example.com/ns-base:tree /c /d\n"
+	if string(contents) != want {
+		t.Errorf("got the Dockerfile:\n%s\nwant:\n%s", contents, want)
+	}
+	removeDockerfile()
+	if _, err := os.Stat(dockerfile); !os.IsNotExist(err) {
+		t.Errorf("the Dockerfile %s was not removed", dockerfile)
+	}
+
+	//services which are not built from other services use their own Dockerfile
+	if dockerfile, _, err := builder.dockerfile(services[1]); err != nil || dockerfile != filepath.Join(services[1].Dir, "Dockerfile") {
+		t.Errorf("got the Dockerfile %s (%v), want the one of the service", dockerfile, err)
+	}
+}
@@ -0,0 +1,189 @@
+package build
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"github.com/moby/patternmatcher"
+	"github.com/pkg/errors"
+	"github.com/webappio/sanic/pkg/bridge/git"
+	"github.com/webappio/sanic/pkg/config"
+	"github.com/webappio/sanic/pkg/util"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//ContentHashes computes a tag for each service, which only changes when something that affects its image changes:
+//the contents of its directory, its Dockerfile and its build context (including the files which git ignores, unless
+//the context's .dockerignore excludes them), the environment (which is passed as SANIC_ENV),
+//its build configuration (including the current values of args which are passed through from the environment),
+//and the content hashes of the services it depends on (see Graph).
+//configs must have absolute Contexts, as for Builder.ServiceConfigs.
+//It returns git.ErrNotGitRepository or git.ErrNoCommits if the contents cannot be hashed with git.
+func ContentHashes(rootDir, envName string, services []util.BuildableService, graph *Graph, configs map[string]config.ServiceBuild) (map[string]string, error) {
+	var paths []string
+	for _, service := range services {
+		paths = append(paths, service.Dir, filepath.Join(service.Dir, service.Dockerfile))
+		if context := configs[service.Name].Context; context != "" {
+			paths = append(paths, context)
+		}
+	}
+	objectHashes, err := git.GetObjectHashes(rootDir, paths...)
+	if err != nil {
+		return nil, err
+	}
+
+	ignoredFileHashes := make(map[string]string)
+	servicesByName := make(map[string]util.BuildableService)
+	for _, service := range services {
+		servicesByName[service.Name] = service
+		contextDir := configs[service.Name].Context
+		if contextDir == "" {
+			contextDir = service.Dir
+		}
+		if _, ok := ignoredFileHashes[contextDir]; !ok {
+			ignoredFileHashes[contextDir], err = hashIgnoredFiles(contextDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	hashes := make(map[string]string)
+	var hashService func(service util.BuildableService) string
+	hashService = func(service util.BuildableService) string {
+		if hash, ok := hashes[service.Name]; ok {
+			return hash
+		}
+		serviceConfig := configs[service.Name]
+		h := sha1.New()
+		fmt.Fprintf(h, "env %s\n", envName)
+		fmt.Fprintf(h, "dir %s\n", objectHashes[service.Dir])
+		fmt.Fprintf(h, "dockerfile %s %s\n", service.Dockerfile, objectHashes[filepath.Join(service.Dir, service.Dockerfile)])
+		if serviceConfig.Context != "" {
+			fmt.Fprintf(h, "context %s\n", objectHashes[serviceConfig.Context])
+			fmt.Fprintf(h, "ignored %s\n", ignoredFileHashes[serviceConfig.Context])
+		} else {
+			fmt.Fprintf(h, "ignored %s\n", ignoredFileHashes[service.Dir])
+		}
+		writeBuildConfig(h, serviceConfig)
+		if graph != nil {
+			parents := append([]string{}, graph.Parents(service.Name)...)
+			sort.Strings(parents)
+			for _, parent := range parents {
+				if parentService, ok := servicesByName[parent]; ok {
+					fmt.Fprintf(h, "parent %s %s\n", parent, hashService(parentService))
+				}
+			}
+		}
+		hashes[service.Name] = fmt.Sprintf("%x", h.Sum(nil))[:12]
+		return hashes[service.Name]
+	}
+
+	for _, service := range services {
+		hashService(service)
+	}
+	return hashes, nil
+}
+
+//hashIgnoredFiles returns a hash of the files in a build context which git ignores (see git.GetIgnoredFiles), but
+//which are still sent to the builder because the context's .dockerignore does not exclude them, e.g., generated code
+func hashIgnoredFiles(contextDir string) (string, error) {
+	files, err := git.GetIgnoredFiles(contextDir)
+	if err != nil {
+		return "", err
+	}
+	excludes, err := dockerignoreExcludes(contextDir)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not read the .dockerignore of %s", contextDir)
+	}
+	matcher, err := patternmatcher.New(excludes)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid .dockerignore in %s", contextDir)
+	}
+	sort.Strings(files)
+	h := sha1.New()
+	for _, file := range files {
+		relPath, err := filepath.Rel(contextDir, file)
+		if err != nil {
+			return "", err
+		}
+		if excluded, err := matcher.MatchesOrParentMatches(filepath.ToSlash(relPath)); err != nil || excluded {
+			continue
+		}
+		if err := hashFile(h, relPath, file); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+//hashFile writes the path and contents of a file (or the target of a symlink) to a hash
+func hashFile(h io.Writer, relPath, path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil //deleted since it was listed
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "symlink %s %s\n", filepath.ToSlash(relPath), target)
+		return nil
+	}
+	fmt.Fprintf(h, "file %s %o %d\n", filepath.ToSlash(relPath), info.Mode().Perm(), info.Size())
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	return err
+}
+
+//writeBuildConfig writes everything in a service's build configuration which affects its image (other than its
+//Context, whose contents are hashed instead) to a hash. Its extra tags do not affect the image, so they are not included.
+func writeBuildConfig(h io.Writer, serviceConfig config.ServiceBuild) {
+	fmt.Fprintf(h, "target %s\nnetwork %s\n", serviceConfig.Target, serviceConfig.Network)
+	fmt.Fprintf(h, "platforms %s\n", strings.Join(serviceConfig.Platforms, ","))
+	var args []string
+	for name, value := range serviceConfig.Args {
+		if value != nil {
+			args = append(args, name+"="+*value)
+		} else if envValue, ok := os.LookupEnv(name); ok {
+			//only a digest, since these are often secrets (e.g., NPM_TOKEN)
+			args = append(args, fmt.Sprintf("%s=env:%x", name, sha256.Sum256([]byte(envValue))))
+		} else {
+			args = append(args, name)
+		}
+	}
+	sort.Strings(args)
+	fmt.Fprintf(h, "args %s\n", strings.Join(args, " "))
+	var labels []string
+	for name, value := range serviceConfig.Labels {
+		labels = append(labels, name+"="+value)
+	}
+	sort.Strings(labels)
+	fmt.Fprintf(h, "labels %s\n", strings.Join(labels, " "))
+	if serviceConfig.Hooks.PreBuild != "" {
+		//the files it generates are not known until it runs, so such services are always built (see
+		//Builder.alwaysBuilt), but the command itself can change what is built
+		fmt.Fprintf(h, "preBuild %s\n", serviceConfig.Hooks.PreBuild)
+	}
+}
+
+//BuildConfigHash returns a hash of a service's build configuration, as included in its content hash (see
+//ContentHashes), e.g., to check whether two environments build a service in the same way
+func BuildConfigHash(serviceConfig config.ServiceBuild) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "context %s\n", serviceConfig.Context)
+	writeBuildConfig(h, serviceConfig)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
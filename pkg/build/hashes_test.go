@@ -0,0 +1,161 @@
+package build
+
+import (
+	"github.com/webappio/sanic/pkg/config"
+	"github.com/webappio/sanic/pkg/util"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+//gitInit commits everything in the parent directory of the given services to a new git repository
+func gitInit(t *testing.T, services []util.BuildableService) string {
+	root := filepath.Dir(services[0].Dir)
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "-A"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = root
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s", args, out)
+		}
+	}
+	return root
+}
+
+func TestContentHashes(t *testing.T) {
+	services := writeServices(t, map[string]string{
+		"base": "FROM alpine\n",
+		"web":  "FROM base\n",
+	})
+	root := gitInit(t, services)
+	graph, err := NewGraph(services, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := "1"
+	baseConfigs := func() map[string]config.ServiceBuild {
+		return map[string]config.ServiceBuild{
+			"base": {},
+			"web": {
+				Args:   map[string]*string{"VERSION": &value, "NPM_TOKEN": nil, "OTHER": nil},
+				Labels: map[string]string{"a": "1", "b": "2"},
+				Tags:   []string{"latest"},
+			},
+		}
+	}
+	os.Setenv("NPM_TOKEN", "secret")
+	defer os.Unsetenv("NPM_TOKEN")
+
+	hashes := func(envName string, configs map[string]config.ServiceBuild) map[string]string {
+		t.Helper()
+		hashes, err := ContentHashes(root, envName, services, graph, configs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hashes
+	}
+	original := hashes("dev", baseConfigs())
+	for i := 0; i < 10; i++ {
+		if again := hashes("dev", baseConfigs()); again["web"] != original["web"] || again["base"] != original["base"] {
+			t.Fatalf("hashes are not stable: %v, then %v", original, again)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		envName string
+		change  func(configs map[string]config.ServiceBuild)
+		setenv  string
+		base    bool //whether the change affects base (and so web, which is built from it)
+	}{
+		{name: "environment", envName: "prod", base: true},
+		{name: "pass-through arg value", setenv: "rotated"},
+		{name: "arg value", change: func(configs map[string]config.ServiceBuild) {
+			other := "2"
+			configs["web"].Args["VERSION"] = &other
+		}},
+		{name: "label", change: func(configs map[string]config.ServiceBuild) { configs["web"].Labels["b"] = "3" }},
+		{name: "parent target", change: func(configs map[string]config.ServiceBuild) {
+			configs["base"] = config.ServiceBuild{Target: "prod"}
+		}, base: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envName := "dev"
+			if test.envName != "" {
+				envName = test.envName
+			}
+			if test.setenv != "" {
+				os.Setenv("NPM_TOKEN", test.setenv)
+				defer os.Setenv("NPM_TOKEN", "secret")
+			}
+			configs := baseConfigs()
+			if test.change != nil {
+				test.change(configs)
+			}
+			changed := hashes(envName, configs)
+			if changed["web"] == original["web"] {
+				t.Errorf("the hash of web did not change")
+			}
+			if (changed["base"] != original["base"]) != test.base {
+				t.Errorf("the hash of base changed: %t, want %t", changed["base"] != original["base"], test.base)
+			}
+		})
+	}
+
+	t.Run("tags", func(t *testing.T) {
+		configs := baseConfigs()
+		web := configs["web"]
+		web.Tags = []string{"stable"}
+		configs["web"] = web
+		if changed := hashes("dev", configs); changed["web"] != original["web"] {
+			t.Errorf("the hash of web changed with its extra tags, which do not affect its image")
+		}
+	})
+}
+
+func TestContentHashesIgnoredFiles(t *testing.T) {
+	services := writeServices(t, map[string]string{"web": "FROM alpine\nCOPY . .\n"})
+	dir := services[0].Dir
+	writeFile := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(".gitignore", "gen/\nnode_modules/\n")
+	writeFile(".dockerignore", "node_modules\n")
+	root := gitInit(t, services)
+	hash := func() string {
+		t.Helper()
+		hashes, err := ContentHashes(root, "dev", services, nil, map[string]config.ServiceBuild{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hashes["web"]
+	}
+
+	original := hash()
+	writeFile("node_modules/left-pad/index.js", "module.exports = 1")
+	if hash() != original {
+		t.Errorf("the hash changed with a file that .dockerignore excludes from the build context")
+	}
+	writeFile("gen/api.go", "package api")
+	generated := hash()
+	if generated == original {
+		t.Errorf("the hash did not change with a file in the build context that git ignores")
+	}
+	writeFile("gen/api.go", "package api2")
+	if hash() == generated {
+		t.Errorf("the hash did not change when a file in the build context that git ignores changed")
+	}
+}
@@ -0,0 +1,202 @@
+package build
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//historyRuns is how many builds of each service a BuildHistory keeps
+const historyRuns = 50
+
+//estimateRuns is how many of the latest builds of a service its estimate is the median of
+const estimateRuns = 5
+
+//BuildTiming is how long a single build of a service took
+type BuildTiming struct {
+	StartTime time.Time `json:"startTime"`
+	Seconds   float64   `json:"seconds"`
+	//ImageBytes is the size of the image that was built, if it could be measured (see ImageSize)
+	ImageBytes      int64 `json:"imageBytes,omitempty"`
+	ImageCompressed bool  `json:"imageCompressed,omitempty"`
+}
+
+//Duration returns how long the build took
+func (timing BuildTiming) Duration() time.Duration {
+	return time.Duration(timing.Seconds * float64(time.Second))
+}
+
+//BuildHistory records how long the builds of each service took, across runs of sanic build.
+//Builds which did not build anything (e.g., because the image was up to date) or which did not succeed are not recorded.
+type BuildHistory struct {
+	mutex    sync.Mutex
+	path     string
+	Services map[string][]BuildTiming `json:"services"` //service -> its builds, oldest first
+}
+
+//LoadBuildHistory reads the BuildHistory at the given path, or returns an empty one if it does not exist yet
+func LoadBuildHistory(path string) (*BuildHistory, error) {
+	history := &BuildHistory{path: path, Services: make(map[string][]BuildTiming)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return history, err
+	}
+	if err := json.Unmarshal(data, history); err != nil {
+		return &BuildHistory{path: path, Services: make(map[string][]BuildTiming)}, err
+	}
+	if history.Services == nil {
+		history.Services = make(map[string][]BuildTiming)
+	}
+	return history, nil
+}
+
+//Record adds a build of the service (and the size of its image, if it is not nil) to the history,
+//dropping its oldest builds past historyRuns
+func (history *BuildHistory) Record(service string, startTime time.Time, duration time.Duration, size *ImageSize) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	timing := BuildTiming{StartTime: startTime, Seconds: duration.Seconds()}
+	if size != nil {
+		timing.ImageBytes = size.Bytes
+		timing.ImageCompressed = size.Compressed
+	}
+	timings := append(history.Services[service], timing)
+	if len(timings) > historyRuns {
+		timings = timings[len(timings)-historyRuns:]
+	}
+	history.Services[service] = timings
+}
+
+//Save writes the history back to where it was loaded from
+func (history *BuildHistory) Save() error {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(history.path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(history.path, data, 0600)
+}
+
+//Timings returns the recorded builds of a service, oldest first
+func (history *BuildHistory) Timings(service string) []BuildTiming {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	return append([]BuildTiming(nil), history.Services[service]...)
+}
+
+//LastImageSize returns the size of the service's image at its latest build which measured it in the same way
+//(compressed or not, see ImageSize), if there is one
+func (history *BuildHistory) LastImageSize(service string, compressed bool) (int64, bool) {
+	timings := history.Timings(service)
+	for i := len(timings) - 1; i >= 0; i-- {
+		if timings[i].ImageBytes > 0 && timings[i].ImageCompressed == compressed {
+			return timings[i].ImageBytes, true
+		}
+	}
+	return 0, false
+}
+
+//Estimates returns how long building each of the given services is expected to take (the median of its latest
+//builds), for the services which have been built before
+func (history *BuildHistory) Estimates(services []string) map[string]time.Duration {
+	estimates := make(map[string]time.Duration)
+	for _, service := range services {
+		timings := history.Timings(service)
+		if len(timings) == 0 {
+			continue
+		}
+		if len(timings) > estimateRuns {
+			timings = timings[len(timings)-estimateRuns:]
+		}
+		estimates[service] = MedianDuration(timings)
+	}
+	return estimates
+}
+
+//MedianDuration returns the median duration of the given builds, or 0 if there are none
+func MedianDuration(timings []BuildTiming) time.Duration {
+	if len(timings) == 0 {
+		return 0
+	}
+	var durations []time.Duration
+	for _, timing := range timings {
+		durations = append(durations, timing.Duration())
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	if len(durations)%2 == 0 {
+		return (durations[len(durations)/2-1] + durations[len(durations)/2]) / 2
+	}
+	return durations[len(durations)/2]
+}
+
+//HistoryInterface is an Interface which records how long each job that built an image took into a BuildHistory,
+//and passes everything through to another Interface
+type HistoryInterface struct {
+	Interface
+	History    *BuildHistory
+	mutex      sync.Mutex
+	startTimes map[string]time.Time
+	upToDate   map[string]bool
+	imageSizes map[string]*ImageSize
+}
+
+//NewHistoryInterface wraps the given Interface to record the durations of the builds in history
+func NewHistoryInterface(iface Interface, history *BuildHistory) *HistoryInterface {
+	return &HistoryInterface{
+		Interface:  iface,
+		History:    history,
+		startTimes: make(map[string]time.Time),
+		upToDate:   make(map[string]bool),
+		imageSizes: make(map[string]*ImageSize),
+	}
+}
+
+func (iface *HistoryInterface) StartJob(service string, image string) {
+	iface.mutex.Lock()
+	iface.startTimes[service] = time.Now()
+	delete(iface.upToDate, service)
+	delete(iface.imageSizes, service)
+	iface.mutex.Unlock()
+
+	iface.Interface.StartJob(service, image)
+}
+
+func (iface *HistoryInterface) SetUpToDate(service string) {
+	iface.mutex.Lock()
+	iface.upToDate[service] = true
+	iface.mutex.Unlock()
+
+	iface.Interface.SetUpToDate(service)
+}
+
+func (iface *HistoryInterface) SetImageSize(service string, size *ImageSize) {
+	iface.mutex.Lock()
+	iface.imageSizes[service] = size
+	iface.mutex.Unlock()
+
+	iface.Interface.SetImageSize(service, size)
+}
+
+func (iface *HistoryInterface) SucceedJob(service string) {
+	iface.mutex.Lock()
+	if startTime, ok := iface.startTimes[service]; ok && !iface.upToDate[service] {
+		iface.History.Record(service, startTime, time.Since(startTime), iface.imageSizes[service])
+	}
+	iface.mutex.Unlock()
+
+	iface.Interface.SucceedJob(service)
+}
@@ -0,0 +1,154 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/webappio/sanic/pkg/config"
+	"github.com/webappio/sanic/pkg/util"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//imageSizeLayers is how many of the largest layers of an image are logged after it is built
+const imageSizeLayers = 5
+
+//ImageLayer is a layer of a built image, with the instruction which created it (if it is known)
+type ImageLayer struct {
+	Bytes     int64  `json:"bytes"`
+	CreatedBy string `json:"createdBy,omitempty"`
+}
+
+//ImageSize is the size of a built image and of its layers (oldest first).
+//Images in the local image store are measured uncompressed, and images which are only in the registry compressed.
+type ImageSize struct {
+	Bytes      int64        `json:"bytes"`
+	Compressed bool         `json:"compressed,omitempty"`
+	Layers     []ImageLayer `json:"layers"`
+}
+
+//String describes the size, e.g., "1.20GB" or "400.00MB compressed"
+func (size *ImageSize) String() string {
+	if size.Compressed {
+		return humanReadableBytes(size.Bytes) + " compressed"
+	}
+	return humanReadableBytes(size.Bytes)
+}
+
+//localImageSize measures an image in the image store of a Backend (see Backend.ImageStore)
+func localImageSize(imageStore, image string) (*ImageSize, error) {
+	out := &bytes.Buffer{}
+	cmd := exec.Command(imageStore, "image", "inspect", "--format", "{{.Size}}", image)
+	cmd.Stdout = out
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "could not inspect %s", image)
+	}
+	total, err := strconv.ParseInt(strings.TrimSpace(out.String()), 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read the size of %s", image)
+	}
+	size := &ImageSize{Bytes: total}
+
+	out.Reset()
+	cmd = exec.Command(imageStore, "history", "--human=false", "--no-trunc", "--format", "{{.Size}}\t{{.CreatedBy}}", image)
+	cmd.Stdout = out
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "could not read the history of %s", image)
+	}
+	//the history is newest first
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		parts := strings.SplitN(lines[i], "\t", 2)
+		layerBytes, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || layerBytes == 0 {
+			continue
+		}
+		layer := ImageLayer{Bytes: layerBytes}
+		if len(parts) == 2 {
+			layer.CreatedBy = strings.TrimPrefix(strings.TrimSpace(parts[1]), "/bin/sh -c #(nop) ")
+		}
+		size.Layers = append(size.Layers, layer)
+	}
+	return size, nil
+}
+
+//imageSize measures a service's image once it is built, in the local image store, or in the registry if it was
+//only pushed there (e.g., multi-platform images, or with the kaniko backend)
+func (builder *Builder) imageSize(ctx context.Context, service util.BuildableService, image string) (*ImageSize, error) {
+	imageStore := builder.backend().ImageStore()
+	if localImageExists(imageStore, image) {
+		return localImageSize(imageStore, image)
+	}
+	if !builder.DoPush || builder.Registry == "" {
+		return nil, fmt.Errorf("%s is not in the local image store or in a registry", image)
+	}
+	tag := image[strings.LastIndex(image, ":")+1:]
+	layers, err := builder.registry().ImageLayers(ctx, builder.ImageName(service), tag)
+	if err != nil {
+		return nil, err
+	}
+	size := &ImageSize{Compressed: true}
+	for _, layer := range layers {
+		size.Bytes += layer.Size
+		size.Layers = append(size.Layers, ImageLayer{Bytes: layer.Size, CreatedBy: layer.CreatedBy})
+	}
+	return size, nil
+}
+
+//checkImageSize measures a service's image after it is built, sends its size to the Interface and logs its largest
+//layers. It returns an error if the image is over the service's maxImageSize, or grew by more than its
+//maxImageGrowth since the last recorded build, unless its imageSizeAction is warn (which only logs a warning).
+//Images which cannot be measured are not checked.
+func (builder *Builder) checkImageSize(ctx context.Context, service util.BuildableService, image string) error {
+	size, err := builder.imageSize(ctx, service, image)
+	if err != nil {
+		builder.Logger.Log(service.Name, time.Now(), "could not measure the size of the image: ", err.Error())
+		return nil
+	}
+	builder.Interface.SetImageSize(service.Name, size)
+
+	largest := append([]ImageLayer(nil), size.Layers...)
+	sort.SliceStable(largest, func(i, j int) bool { return largest[i].Bytes > largest[j].Bytes })
+	if len(largest) > imageSizeLayers {
+		largest = largest[:imageSizeLayers]
+	}
+	builder.Logger.Log(service.Name, time.Now(), fmt.Sprintf("image size: %s in %d layers", size, len(size.Layers)))
+	for _, layer := range largest {
+		builder.Logger.Log(service.Name, time.Now(), fmt.Sprintf("  %10s %s", humanReadableBytes(layer.Bytes), layer.CreatedBy))
+	}
+
+	serviceConfig := builder.serviceConfig(service)
+	var problems []string
+	if serviceConfig.MaxImageSize != "" {
+		maxBytes, err := config.ParseByteSize(serviceConfig.MaxImageSize)
+		if err == nil && size.Bytes > maxBytes {
+			problems = append(problems, fmt.Sprintf("the image is %s, which is over its maxImageSize of %s",
+				size, serviceConfig.MaxImageSize))
+		}
+	}
+	if serviceConfig.MaxImageGrowth != nil && builder.History != nil {
+		previous, ok := builder.History.LastImageSize(service.Name, size.Compressed)
+		if ok && previous > 0 {
+			growth := 100 * float64(size.Bytes-previous) / float64(previous)
+			if growth > *serviceConfig.MaxImageGrowth {
+				problems = append(problems, fmt.Sprintf(
+					"the image grew by %.0f%% since its last build (from %s to %s), more than its maxImageGrowth of %g%%",
+					growth, humanReadableBytes(previous), humanReadableBytes(size.Bytes), *serviceConfig.MaxImageGrowth))
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	if serviceConfig.ImageSizeAction == config.ImageSizeWarn {
+		for _, problem := range problems {
+			builder.Logger.Log(service.Name, time.Now(), "Warning: ", problem)
+		}
+		return nil
+	}
+	return errors.New(strings.Join(problems, ", and "))
+}
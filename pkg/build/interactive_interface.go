@@ -1,22 +1,34 @@
 package build
 
 import (
+	"bytes"
 	"fmt"
-	"github.com/webappio/sanic/pkg/util"
 	"github.com/gdamore/tcell"
+	"github.com/webappio/sanic/pkg/util"
+	"io"
+	"io/ioutil"
+	"os"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
+//recentLogLines is how many of the latest lines of the log of each job are kept in memory, for the overview
+const recentLogLines = 200
+
 type interactiveInterfaceJob struct {
-	lastLogLines   *util.StringRingBuffer
-	linesDisplayed int //used at rendering time
+	recentLines    *util.StringRingBuffer //the latest lines of the log of the job, see recentLogLines
+	linesDisplayed int                    //used at rendering time
 	status         string
 	pushing        bool
+	upToDate       bool
+	currentStep    string
+	platformSteps  map[string]string //platform -> its current step, e.g., linux/arm64 -> 2/5, for multi-platform builds
 	image          string
 	service        string
+	startTime      time.Time
+	imageSize      *ImageSize
 }
 
 type interactiveInterface struct {
@@ -26,15 +38,39 @@ type interactiveInterface struct {
 	screenStyle     tcell.Style
 	cancelled       bool
 	running         bool
+	waiting         string
 	cancelListeners []func()
+
+	jobCancelListeners []func(service string)
+	selected           string //the service of the job selected with the arrow keys, if any
+	expanded           bool   //whether the log of the selected job is shown full-screen
+	scroll             int    //how many lines of the log are below the full-log view, 0 to follow it
+	searching          bool   //whether a search is being typed into searchInput
+	searchInput        string
+	search             string //the text of the current search, highlighted in the full-log view
+	searchMatch        int    //the index of the line of the current match of the search, or -1
+	searchStatus       string
+	logPath            func(service string) string //where the logger writes the log of each service
+	fullLog            []string                    //the lines of the log file of the job in the full-log view
+	fullLogOffset      int64                       //how much of that log file has been read into fullLog
+	inspecting         bool                        //whether the build finished with failures, and the screen is kept until the user quits
+	quit               chan interface{}
+	quitOnce           sync.Once
+	estimates          map[string]time.Duration //service -> how long its job is expected to take, see SetEstimates
+	parallelism        int
 }
 
-//NewInteractiveInterface creates and initializes a new tcell screen and event loop for use as an Interface
-func NewInteractiveInterface() (Interface, error) {
+//NewInteractiveInterface creates and initializes a new tcell screen and event loop for use as an Interface.
+//The full-log view of a job reads the log file of its service at logPath (see Logger.LogPath), so that only the
+//latest lines of each log are kept in memory.
+func NewInteractiveInterface(logPath func(service string) string) (Interface, error) {
 	iface := &interactiveInterface{
+		logPath:     logPath,
 		screenStyle: tcell.StyleDefault,
 		jobs:        make(map[string]*interactiveInterfaceJob),
 		running:     true,
+		searchMatch: -1,
+		quit:        make(chan interface{}),
 	}
 
 	tcell.SetEncodingFallback(tcell.EncodingFallbackFail)
@@ -58,14 +94,8 @@ func NewInteractiveInterface() (Interface, error) {
 				iface.redrawScreen()
 				screen.Sync()
 			case *tcell.EventKey:
-				switch typedEvent.Key() {
-				case tcell.KeyCtrlC, tcell.KeyEsc, tcell.KeyExit:
-					for _, cancel := range iface.cancelListeners {
-						cancel()
-					}
-					iface.cancelled = true
-					return
-				}
+				iface.handleKey(typedEvent)
+				iface.redrawScreen()
 			}
 		}
 	}()
@@ -86,7 +116,7 @@ func (iface *interactiveInterface) redrawScreen() {
 	defer func() {
 		r := recover()
 		if r != nil {
-			iface.Close()
+			iface.close(false)
 			panic(r)
 		}
 	}()
@@ -96,14 +126,24 @@ func (iface *interactiveInterface) redrawScreen() {
 	iface.mutex.Lock()
 	defer iface.mutex.Unlock()
 
+	if !iface.running {
+		return
+	}
+
 	var succeededJobs []*interactiveInterfaceJob
 	var failedJobs []*interactiveInterfaceJob
+	var skippedJobs []*interactiveInterfaceJob
+	var cancelledJobs []*interactiveInterfaceJob
 	var currJobs []*interactiveInterfaceJob
 
 	for _, job := range iface.jobs {
 		switch job.status {
 		case "succeeded":
 			succeededJobs = append(succeededJobs, job)
+		case "skipped":
+			skippedJobs = append(skippedJobs, job)
+		case "cancelled":
+			cancelledJobs = append(cancelledJobs, job)
 		case "failed":
 			failedJobs = append(failedJobs, job)
 		default:
@@ -130,31 +170,41 @@ func (iface *interactiveInterface) redrawScreen() {
 		}
 	}
 
+	if job, ok := iface.jobs[iface.selected]; ok && iface.expanded {
+		iface.drawFullLog(job, width, height, displayAndTruncateString)
+		iface.screen.Show()
+		return
+	}
+
 	numFailedAndBuilding := len(failedJobs) + len(currJobs)
-	if numFailedAndBuilding == 0 {
+	if numFailedAndBuilding == 0 && iface.waiting == "" {
 		return
 	}
 
 	currRenderLine := 0
-	linesPerJob := (height - 1) / numFailedAndBuilding
-	if linesPerJob < 2 {
-		linesPerJob = 2
+	linesPerJob := 2
+	numRemainderLines := 0
+	if numFailedAndBuilding > 0 {
+		linesPerJob = (height - 1) / numFailedAndBuilding
+		if linesPerJob < 2 {
+			linesPerJob = 2
+		}
+		numRemainderLines = height - 1 - linesPerJob*numFailedAndBuilding
 	}
-	numRemainderLines := height - 1 - linesPerJob*numFailedAndBuilding
 
 	failureStyle := iface.screenStyle.Foreground(tcell.NewRGBColor(190, 0, 0))
 	for _, job := range failedJobs {
 		if currRenderLine+1 >= height-2 {
 			break
 		}
-		displayAndTruncateString(currRenderLine, "[failed] "+job.image, failureStyle)
+		displayAndTruncateString(currRenderLine, "[failed] "+job.image, iface.selectedStyle(job, failureStyle))
 		currRenderLine++
 		logLinesToDisplay := linesPerJob - 1
 		if numRemainderLines > 0 {
 			logLinesToDisplay++
 			numRemainderLines--
 		}
-		for _, logLine := range job.lastLogLines.Peek(logLinesToDisplay) {
+		for _, logLine := range job.lastLogLines(logLinesToDisplay) {
 			displayAndTruncateString(currRenderLine, logLine, iface.screenStyle)
 			currRenderLine++
 		}
@@ -169,58 +219,119 @@ func (iface *interactiveInterface) redrawScreen() {
 		if job.pushing {
 			status = "[building/pushing]"
 		}
-		displayAndTruncateString(currRenderLine, status+" "+job.image, currStyle)
+		header := status + " " + jobDescription(job)
+		if estimate, ok := iface.estimates[job.service]; ok {
+			header += "  " + jobProgress(time.Since(job.startTime), estimate)
+		}
+		displayAndTruncateString(currRenderLine, header, iface.selectedStyle(job, currStyle))
 		currRenderLine++
 		logLinesToDisplay := linesPerJob - 1
 		if numRemainderLines > 0 {
 			logLinesToDisplay++
 			numRemainderLines--
 		}
-		for _, logLine := range job.lastLogLines.Peek(logLinesToDisplay) {
+		for _, logLine := range job.lastLogLines(logLinesToDisplay) {
 			displayAndTruncateString(currRenderLine, logLine, iface.screenStyle)
 			currRenderLine++
 		}
 	}
 
-	numJobs := len(currJobs) + len(failedJobs) + len(succeededJobs)
+	for ; currRenderLine < height-1; currRenderLine++ {
+		displayAndTruncateString(currRenderLine, "", iface.screenStyle)
+	}
+
+	numJobs := len(currJobs) + len(failedJobs) + len(skippedJobs) + len(cancelledJobs) + len(succeededJobs)
 	statusStyle := iface.screenStyle.Foreground(tcell.NewRGBColor(190, 190, 190))
-	displayAndTruncateString(
-		height-1,
-		fmt.Sprintf(
-			"%d/%d failed, %d/%d completed, %d/%d building",
-			len(failedJobs), numJobs,
-			len(succeededJobs), numJobs,
-			len(currJobs), numJobs,
-		),
-		statusStyle,
+	status := fmt.Sprintf(
+		"%d/%d failed, %d/%d skipped, %d/%d cancelled, %d/%d completed, %d/%d building",
+		len(failedJobs), numJobs,
+		len(skippedJobs), numJobs,
+		len(cancelledJobs), numJobs,
+		len(succeededJobs), numJobs,
+		len(currJobs), numJobs,
 	)
+	if remaining, ok := iface.remainingTime(); ok {
+		status += fmt.Sprintf(" - about %s left", remaining.Round(time.Second))
+	}
+	if iface.waiting != "" {
+		status += " - " + iface.waiting
+	}
+	switch {
+	case iface.inspecting:
+		status = fmt.Sprintf("%d/%d failed - ↑/↓: select, enter: view its log, q: quit", len(failedJobs), numJobs)
+	case iface.selected != "":
+		status += " - enter: view the log of " + iface.selected + ", c: cancel it"
+	default:
+		status += " - ↑/↓: select a build"
+	}
+	displayAndTruncateString(height-1, status, statusStyle)
 
 	iface.screen.Show()
 }
 
 func (iface *interactiveInterface) Close() {
+	iface.close(false)
+}
+
+func (iface *interactiveInterface) InspectAndClose() {
+	//nobody might be there to quit, e.g., if the output is piped
+	stat, err := os.Stdout.Stat()
+	iface.close(err == nil && stat.Mode()&os.ModeCharDevice != 0)
+}
+
+//close closes the screen and summarizes the build. If inspectFailures is set and any jobs failed, the screen is kept
+//(see handleKey) until the user quits, so that the logs of the failures can be read.
+func (iface *interactiveInterface) close(inspectFailures bool) {
 	iface.mutex.Lock()
 	defer iface.mutex.Unlock()
 
+	if !iface.running {
+		return
+	}
+	if inspectFailures && !iface.cancelled {
+		iface.inspecting = true
+	}
+	if failedJobs := iface.visibleJobs(); iface.inspecting && len(failedJobs) > 0 {
+		iface.waiting = ""
+		if job, ok := iface.jobs[iface.selected]; !ok || job.status != "failed" {
+			iface.selected = failedJobs[0].service
+		}
+		iface.expanded = iface.expanded && iface.jobs[iface.selected].status == "failed"
+		iface.mutex.Unlock()
+		iface.redrawScreen()
+		<-iface.quit
+		iface.mutex.Lock()
+	}
+
 	iface.running = false
+	iface.inspecting = false
 	iface.screen.Fini()
 	var serviceLogDirs []string
 	var serviceImages []string
-	var failedJobs []string
+	allSucceeded := true
+	var upToDateImages []string
 	for jobName, job := range iface.jobs {
 		serviceLogDirs = append(serviceLogDirs, fmt.Sprintf("logs/%s.log", jobName)) //TODO messy
-		serviceImages = append(serviceImages, job.image)
+		if job.upToDate {
+			upToDateImages = append(upToDateImages, job.image)
+		} else if job.imageSize != nil {
+			serviceImages = append(serviceImages, fmt.Sprintf("%s (%s)", job.image, job.imageSize))
+		} else {
+			serviceImages = append(serviceImages, job.image)
+		}
 		if job.status != "succeeded" {
-			failedJobs = append(failedJobs, jobName)
+			allSucceeded = false
 		}
 	}
 
-	if !iface.cancelled {
-		if len(failedJobs) > 0 {
-			fmt.Printf("Failed to build the following jobs: %s\nSee the logs folder for details.\n", strings.Join(failedJobs, ", "))
-		} else {
+	//failures are summarized by the caller, see SummarizeResults
+	if !iface.cancelled && allSucceeded {
+		if len(serviceImages) > 0 {
 			fmt.Printf("Successfully built: %s\n", strings.Join(serviceImages, " "))
 		}
+		if len(upToDateImages) > 0 {
+			fmt.Printf("Up to date: %s\n", strings.Join(upToDateImages, " "))
+		}
 	}
 
 }
@@ -229,11 +340,9 @@ func (iface *interactiveInterface) StartJob(service string, image string) {
 	iface.mutex.Lock()
 	defer iface.mutex.Unlock()
 
-	iface.jobs[service] = &interactiveInterfaceJob{
-		service:      service,
-		image:        image,
-		lastLogLines: util.CreateStringRingBuffer(20),
-	}
+	job := newInteractiveInterfaceJob(service, image)
+	job.startTime = time.Now()
+	iface.jobs[service] = job
 }
 
 func (iface *interactiveInterface) FailJob(service string, err error) {
@@ -256,6 +365,57 @@ func (iface *interactiveInterface) SucceedJob(service string) {
 	}
 }
 
+func (iface *interactiveInterface) SetImageSize(service string, size *ImageSize) {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+
+	if job, ok := iface.jobs[service]; ok {
+		job.imageSize = size
+	}
+}
+
+func (iface *interactiveInterface) SetDigest(service string, digest string) {
+	//digests are only used in build reports, ignore
+}
+
+func (iface *interactiveInterface) SetWaiting(reason string) {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+
+	iface.waiting = reason
+}
+
+func (iface *interactiveInterface) SetUpToDate(service string) {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+
+	if job, ok := iface.jobs[service]; ok {
+		job.upToDate = true
+	}
+}
+
+func (iface *interactiveInterface) CancelJob(service string) {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+
+	job, ok := iface.jobs[service]
+	if !ok {
+		job = newInteractiveInterfaceJob(service, service)
+		iface.jobs[service] = job
+	}
+	job.status = "cancelled"
+}
+
+func (iface *interactiveInterface) SkipJob(service string, reason string) {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+
+	job := newInteractiveInterfaceJob(service, service)
+	job.status = "skipped"
+	job.recentLines.Push(reason)
+	iface.jobs[service] = job
+}
+
 func (iface *interactiveInterface) SetPushing(service string) {
 	iface.mutex.Lock()
 	defer iface.mutex.Unlock()
@@ -265,6 +425,50 @@ func (iface *interactiveInterface) SetPushing(service string) {
 	}
 }
 
+func (iface *interactiveInterface) ProcessVertex(service string, vertex Vertex) {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+
+	job, ok := iface.jobs[service]
+	if !ok {
+		return
+	}
+	if vertex.Platform != "" && vertex.Started != nil {
+		if job.platformSteps == nil {
+			job.platformSteps = make(map[string]string)
+		}
+		job.platformSteps[vertex.Platform] = vertex.Step
+	}
+	if vertex.Completed != nil {
+		if job.currentStep != "" && strings.HasPrefix(job.currentStep, vertex.Name) {
+			job.currentStep = ""
+		}
+		return
+	}
+	if vertex.Started != nil {
+		job.currentStep = vertex.Name
+		if vertex.Total > 0 {
+			job.currentStep += fmt.Sprintf(" (%s/%s)", humanReadableBytes(vertex.Current), humanReadableBytes(vertex.Total))
+		} else if vertex.Current > 0 {
+			job.currentStep += fmt.Sprintf(" (%s)", humanReadableBytes(vertex.Current))
+		}
+	}
+}
+
+//formatPlatformSteps shows the step that each platform of a multi-platform build is on, e.g., "linux/amd64 4/5, linux/arm64 2/5"
+func formatPlatformSteps(platformSteps map[string]string) string {
+	var platforms []string
+	for platform := range platformSteps {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	var steps []string
+	for _, platform := range platforms {
+		steps = append(steps, platform+" "+platformSteps[platform])
+	}
+	return strings.Join(steps, ", ")
+}
+
 func (iface *interactiveInterface) ProcessLog(service, logLine string) {
 	iface.mutex.Lock()
 	defer iface.mutex.Unlock()
@@ -273,9 +477,12 @@ func (iface *interactiveInterface) ProcessLog(service, logLine string) {
 	if !ok {
 		panic("Could not find service: " + service)
 	}
-	logLine = strings.TrimSpace(logLine)
-	if logLine != "" {
-		job.lastLogLines.Push(logLine)
+	for _, line := range strings.Split(strings.TrimSpace(logLine), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		job.recentLines.Push(line)
 		//notice: server time might drift, so we use local time
 	}
 }
@@ -283,3 +490,427 @@ func (iface *interactiveInterface) ProcessLog(service, logLine string) {
 func (iface *interactiveInterface) AddCancelListener(cancelFunc func()) {
 	iface.cancelListeners = append(iface.cancelListeners, cancelFunc)
 }
+
+func (iface *interactiveInterface) SetEstimates(estimates map[string]time.Duration, parallelism int) {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+
+	iface.estimates = estimates
+	iface.parallelism = parallelism
+}
+
+//remainingTime estimates how long the build has left: the expected time of the jobs which have not started yet and
+//the rest of the ones being built, shared between the parallel jobs (but at least the longest of the ones being built).
+//It returns false if there is nothing to estimate. The caller must hold the mutex.
+func (iface *interactiveInterface) remainingTime() (time.Duration, bool) {
+	var total, longest time.Duration
+	found := false
+	for service, estimate := range iface.estimates {
+		job, ok := iface.jobs[service]
+		if ok && job.status != "" {
+			continue
+		}
+		found = true
+		if ok {
+			estimate -= time.Since(job.startTime)
+			if estimate < 0 {
+				estimate = 0
+			}
+			if estimate > longest {
+				longest = estimate
+			}
+		}
+		total += estimate
+	}
+	if !found {
+		return 0, false
+	}
+	if iface.parallelism > 1 {
+		total /= time.Duration(iface.parallelism)
+	}
+	if total < longest {
+		total = longest
+	}
+	return total, true
+}
+
+//jobProgress shows how far along a job is compared to how long it usually takes, e.g., "[######----] ~40s left"
+func jobProgress(elapsed, estimate time.Duration) string {
+	const width = 10
+	filled := width
+	if estimate > 0 && elapsed < estimate {
+		filled = int(width * elapsed / estimate)
+	}
+	bar := "[" + strings.Repeat("#", filled) + strings.Repeat("-", width-filled) + "]"
+	if elapsed >= estimate {
+		return fmt.Sprintf("%s %s longer than usual", bar, (elapsed - estimate).Round(time.Second))
+	}
+	return fmt.Sprintf("%s ~%s left", bar, (estimate - elapsed).Round(time.Second))
+}
+
+func (iface *interactiveInterface) AddJobCancelListener(cancelFunc func(service string)) {
+	iface.jobCancelListeners = append(iface.jobCancelListeners, cancelFunc)
+}
+
+//visibleJobs returns the jobs which are shown on the screen, in order: the failed jobs, then the ones being built
+//(or only the failed ones, once the build is over). The caller must hold the mutex.
+func (iface *interactiveInterface) visibleJobs() []*interactiveInterfaceJob {
+	var failedJobs []*interactiveInterfaceJob
+	var currJobs []*interactiveInterfaceJob
+	for _, job := range iface.jobs {
+		switch job.status {
+		case "failed":
+			failedJobs = append(failedJobs, job)
+		case "succeeded", "skipped", "cancelled":
+		default:
+			currJobs = append(currJobs, job)
+		}
+	}
+	sort.Slice(failedJobs, func(i, j int) bool { return failedJobs[i].service < failedJobs[j].service })
+	sort.Slice(currJobs, func(i, j int) bool { return currJobs[i].service < currJobs[j].service })
+	if iface.inspecting {
+		return failedJobs
+	}
+	return append(failedJobs, currJobs...)
+}
+
+//handleKey handles a key press:
+// - on the list of jobs, the arrow keys select a job, enter shows its whole log, and c cancels it
+// - on the log of a job, the arrow keys, page up/down and home/end scroll it, / searches it,
+//   n and N go to the previous and next match, c cancels the job, and esc or q go back to the list
+//ctrl-c (or esc on the list) cancels the whole build, and q quits once it is over.
+func (iface *interactiveInterface) handleKey(ev *tcell.EventKey) {
+	var cancelBuild bool
+	var cancelJob string
+	defer func() {
+		//the listeners call back into the interface, so they are called without the mutex
+		if cancelBuild {
+			for _, cancel := range iface.cancelListeners {
+				cancel()
+			}
+		}
+		if cancelJob != "" {
+			for _, cancel := range iface.jobCancelListeners {
+				cancel(cancelJob)
+			}
+		}
+	}()
+
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+
+	quit := func() {
+		iface.quitOnce.Do(func() { close(iface.quit) })
+	}
+	cancelSelected := func() {
+		if job, ok := iface.jobs[iface.selected]; ok && job.status == "" {
+			cancelJob = job.service
+		}
+	}
+
+	if ev.Key() == tcell.KeyCtrlC {
+		if iface.inspecting {
+			quit()
+			return
+		}
+		cancelBuild = true
+		iface.cancelled = true
+		return
+	}
+
+	job, expanded := iface.jobs[iface.selected]
+	expanded = expanded && iface.expanded
+	if expanded && iface.searching {
+		switch ev.Key() {
+		case tcell.KeyEnter:
+			iface.searching = false
+			iface.search = iface.searchInput
+			iface.searchMatch = -1
+			if iface.search != "" {
+				_, height := iface.screen.Size()
+				_, end := logWindow(len(iface.fullLogLines(job)), height-2, iface.scroll)
+				iface.findMatch(job, end-1, -1, height-2)
+			}
+		case tcell.KeyEsc:
+			iface.searching = false
+		case tcell.KeyBackspace, tcell.KeyBackspace2:
+			if runes := []rune(iface.searchInput); len(runes) > 0 {
+				iface.searchInput = string(runes[:len(runes)-1])
+			}
+		case tcell.KeyRune:
+			iface.searchInput += string(ev.Rune())
+		}
+		return
+	}
+
+	if expanded {
+		_, height := iface.screen.Size()
+		page := height - 2
+		if page < 1 {
+			page = 1
+		}
+		switch {
+		case ev.Key() == tcell.KeyEsc, ev.Key() == tcell.KeyLeft, ev.Rune() == 'q':
+			iface.expanded = false
+			iface.fullLog = nil
+		case ev.Key() == tcell.KeyUp, ev.Rune() == 'k':
+			iface.scroll++
+		case ev.Key() == tcell.KeyDown, ev.Rune() == 'j':
+			iface.scroll--
+		case ev.Key() == tcell.KeyPgUp:
+			iface.scroll += page
+		case ev.Key() == tcell.KeyPgDn, ev.Rune() == ' ':
+			iface.scroll -= page
+		case ev.Key() == tcell.KeyHome, ev.Rune() == 'g':
+			iface.scroll = len(iface.fullLogLines(job))
+		case ev.Key() == tcell.KeyEnd, ev.Rune() == 'G':
+			iface.scroll = 0
+		case ev.Rune() == '/':
+			iface.searching = true
+			iface.searchInput = ""
+		case ev.Rune() == 'n' && iface.search != "":
+			iface.findMatch(job, iface.searchMatch-1, -1, page)
+		case ev.Rune() == 'N' && iface.search != "":
+			iface.findMatch(job, iface.searchMatch+1, 1, page)
+		case ev.Rune() == 'c':
+			cancelSelected()
+		}
+		iface.scroll = clampScroll(iface.scroll, len(iface.fullLogLines(job)), page)
+		return
+	}
+
+	jobs := iface.visibleJobs()
+	selectedIndex := -1
+	for i, visibleJob := range jobs {
+		if visibleJob.service == iface.selected {
+			selectedIndex = i
+		}
+	}
+	switch {
+	case ev.Key() == tcell.KeyUp, ev.Rune() == 'k':
+		if selectedIndex > 0 {
+			iface.selected = jobs[selectedIndex-1].service
+		} else if len(jobs) > 0 {
+			iface.selected = jobs[0].service
+		}
+	case ev.Key() == tcell.KeyDown, ev.Rune() == 'j':
+		if selectedIndex+1 < len(jobs) {
+			iface.selected = jobs[selectedIndex+1].service
+		}
+	case ev.Key() == tcell.KeyEnter, ev.Key() == tcell.KeyRight:
+		if selectedIndex != -1 {
+			iface.expanded = true
+			iface.fullLog = nil
+			iface.fullLogOffset = 0
+			iface.scroll = 0
+			iface.search = ""
+			iface.searchMatch = -1
+			iface.searchStatus = ""
+		}
+	case ev.Rune() == 'c':
+		cancelSelected()
+	case iface.inspecting && (ev.Key() == tcell.KeyEsc || ev.Rune() == 'q'):
+		quit()
+	case ev.Key() == tcell.KeyEsc:
+		cancelBuild = true
+		iface.cancelled = true
+	}
+}
+
+//findMatch finds the closest line of the job's log which contains the search, starting at the line from and going
+//backwards (direction -1) or forwards (direction 1), and scrolls the full-log view (which is height lines) to it.
+//The caller must hold the mutex.
+func (iface *interactiveInterface) findMatch(job *interactiveInterfaceJob, from int, direction int, height int) {
+	lines := iface.fullLogLines(job)
+	for i := from; i >= 0 && i < len(lines); i += direction {
+		if strings.Contains(lines[i], iface.search) {
+			iface.searchMatch = i
+			iface.searchStatus = ""
+			start, end := logWindow(len(lines), height, iface.scroll)
+			if i < start || i >= end {
+				//center the match
+				end = i + height/2 + 1
+				if end > len(lines) {
+					end = len(lines)
+				}
+				iface.scroll = clampScroll(len(lines)-end, len(lines), height)
+			}
+			return
+		}
+	}
+	if direction < 0 {
+		iface.searchStatus = "no earlier matches"
+	} else {
+		iface.searchStatus = "no later matches"
+	}
+}
+
+//readFullLog reads the lines which were added to the log file of the job in the full-log view since it was last read.
+//The caller must hold the mutex.
+func (iface *interactiveInterface) readFullLog(job *interactiveInterfaceJob) {
+	if iface.logPath == nil {
+		return
+	}
+	f, err := os.Open(iface.logPath(job.service))
+	if err != nil {
+		return //nothing was logged yet, e.g., for a skipped job
+	}
+	defer f.Close()
+	if _, err := f.Seek(iface.fullLogOffset, io.SeekStart); err != nil {
+		return
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return
+	}
+	//only whole lines, the rest is read once it is written
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+	iface.fullLogOffset += int64(len(data))
+	newLines := logFileLines(data, iface.logPath(job.service))
+	iface.fullLog = append(iface.fullLog, newLines...)
+	if iface.scroll > 0 {
+		//keep the lines that are being read in place
+		iface.scroll += len(newLines)
+	}
+}
+
+//fullLogLines returns the lines of the log of the job in the full-log view: the lines of its log file, or the latest
+//lines of its log if its log file cannot be read. The caller must hold the mutex.
+func (iface *interactiveInterface) fullLogLines(job *interactiveInterfaceJob) []string {
+	if len(iface.fullLog) > 0 {
+		return iface.fullLog
+	}
+	return job.recentLines.Peek(job.recentLines.Usage())
+}
+
+//drawFullLog draws the whole screen with the log of a single job, scrolled by iface.scroll.
+//The caller must hold the mutex.
+func (iface *interactiveInterface) drawFullLog(job *interactiveInterfaceJob, width, height int, display func(y int, s string, style tcell.Style)) {
+	var header string
+	var headerStyle tcell.Style
+	switch job.status {
+	case "failed":
+		header, headerStyle = "[failed] "+job.image, iface.screenStyle.Foreground(tcell.NewRGBColor(190, 0, 0))
+	case "":
+		header, headerStyle = "[building] "+jobDescription(job), iface.screenStyle.Foreground(tcell.NewRGBColor(190, 190, 0))
+	default:
+		header, headerStyle = "["+job.status+"] "+job.image, iface.screenStyle.Foreground(tcell.NewRGBColor(190, 190, 190))
+	}
+	display(0, header, headerStyle)
+
+	iface.readFullLog(job)
+	lines := iface.fullLogLines(job)
+	logHeight := height - 2
+	iface.scroll = clampScroll(iface.scroll, len(lines), logHeight)
+	start, end := logWindow(len(lines), logHeight, iface.scroll)
+	matchStyle := iface.screenStyle.Background(tcell.NewRGBColor(90, 90, 0))
+	matches := 0
+	if iface.search != "" {
+		for _, line := range lines {
+			if strings.Contains(line, iface.search) {
+				matches++
+			}
+		}
+	}
+	for y := 1; y <= logHeight; y++ {
+		i := start + y - 1
+		if i >= end {
+			display(y, "", iface.screenStyle)
+			continue
+		}
+		style := iface.screenStyle
+		if i == iface.searchMatch {
+			style = style.Reverse(true)
+		} else if iface.search != "" && strings.Contains(lines[i], iface.search) {
+			style = matchStyle
+		}
+		display(y, lines[i], style)
+	}
+
+	statusStyle := iface.screenStyle.Foreground(tcell.NewRGBColor(190, 190, 190))
+	if iface.searching {
+		display(height-1, "/"+iface.searchInput+"_", statusStyle)
+		return
+	}
+	status := fmt.Sprintf("lines %d-%d of %d", start+1, end, len(lines))
+	if iface.search != "" {
+		status += fmt.Sprintf(" - %d matches of \"%s\"", matches, iface.search)
+		if iface.searchStatus != "" {
+			status += " (" + iface.searchStatus + ")"
+		}
+	}
+	status += " - ↑/↓/pgup/pgdn: scroll, /: search, n/N: previous/next match"
+	if job.status == "" {
+		status += ", c: cancel this build"
+	}
+	status += ", esc: back"
+	display(height-1, status, statusStyle)
+}
+
+//selectedStyle highlights the header of the selected job
+func (iface *interactiveInterface) selectedStyle(job *interactiveInterfaceJob, style tcell.Style) tcell.Style {
+	if job.service == iface.selected {
+		return style.Reverse(true)
+	}
+	return style
+}
+
+//jobDescription describes a job which is being built, e.g., "registry/web:abc (linux/amd64 2/5) - [2/5] RUN make"
+func jobDescription(job *interactiveInterfaceJob) string {
+	description := job.image
+	if len(job.platformSteps) > 0 {
+		description += " (" + formatPlatformSteps(job.platformSteps) + ")"
+	}
+	if job.currentStep != "" {
+		description += " - " + job.currentStep
+	}
+	return description
+}
+
+//lastLines returns the last n lines, padded at the start with empty lines if there are fewer than n
+func lastLines(lines []string, n int) []string {
+	if len(lines) >= n {
+		return lines[len(lines)-n:]
+	}
+	return append(make([]string, n-len(lines)), lines...)
+}
+
+//newInteractiveInterfaceJob returns a job which has not started
+func newInteractiveInterfaceJob(service, image string) *interactiveInterfaceJob {
+	return &interactiveInterfaceJob{
+		service:     service,
+		image:       image,
+		recentLines: util.CreateStringRingBuffer(recentLogLines),
+	}
+}
+
+//lastLogLines returns the last n lines of the log of the job, with empty lines before them if there are fewer
+func (job *interactiveInterfaceJob) lastLogLines(n int) []string {
+	recent := n
+	if recent > recentLogLines {
+		recent = recentLogLines
+	}
+	return lastLines(job.recentLines.Peek(recent), n)
+}
+
+//clampScroll limits how far a log of numLines can be scrolled up in a view of height lines
+func clampScroll(scroll, numLines, height int) int {
+	if scroll > numLines-height {
+		scroll = numLines - height
+	}
+	if scroll < 0 {
+		scroll = 0
+	}
+	return scroll
+}
+
+//logWindow returns the range [start, end) of the lines of a log of numLines that a view of height lines shows,
+//when it is scrolled up by scroll lines
+func logWindow(numLines, height, scroll int) (int, int) {
+	end := numLines - scroll
+	start := end - height
+	if start < 0 {
+		start = 0
+	}
+	return start, end
+}
@@ -0,0 +1,426 @@
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/webappio/sanic/pkg/bridge/registry"
+	"github.com/webappio/sanic/pkg/util"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//kanikoImage is the image of the kaniko executor which builds images in the cluster
+const kanikoImage = "gcr.io/kaniko-project/executor:v1.23.2"
+
+//kanikoDockerfile is where the Dockerfile is put in the build context sent to kaniko, if it is not already in it
+const kanikoDockerfile = ".sanic.Dockerfile"
+
+//kanikoBackend builds images in the kubernetes cluster of the environment, as jobs which run kaniko.
+//The build context is streamed to the job's pod with "kubectl attach", and the image is always pushed.
+type kanikoBackend struct{}
+
+func (kanikoBackend) ImageStore() string {
+	return ""
+}
+
+func (kanikoBackend) Build(ctx context.Context, builder *Builder, service util.BuildableService, dockerfile string, imageNames []string) error {
+	if !builder.DoPush {
+		return errors.New("the kaniko backend builds images in the cluster, so they can only be built with --push")
+	}
+	if builder.KubectlCommand == nil {
+		return errors.New("the kaniko backend needs an environment with a kubernetes cluster")
+	}
+	serviceConfig := builder.serviceConfig(service)
+	if len(serviceConfig.Platforms) > 1 {
+		return fmt.Errorf("the kaniko backend can only build for one platform, but %s is built for %s",
+			service.Name, strings.Join(serviceConfig.Platforms, ", "))
+	}
+	if serviceConfig.Network != "" {
+		builder.Logger.Log(service.Name, time.Now(), "the kaniko backend does not support the network build setting, ignoring it")
+	}
+
+	jobName, err := kanikoJobName(service)
+	if err != nil {
+		return err
+	}
+	builder.Interface.SetPushing(service.Name)
+
+	dockerConfigJSON, err := builder.kanikoDockerConfig(service)
+	if err != nil {
+		return err
+	}
+	if dockerConfigJSON != nil {
+		if err := builder.kubectlApply(ctx, kanikoSecret(jobName, dockerConfigJSON)); err != nil {
+			return errors.Wrap(err, "could not create the secret with the registry credentials")
+		}
+		defer builder.kubectlCleanup(service, "secret", jobName)
+	}
+	if err := builder.kubectlApply(ctx, kanikoJob(jobName, builder.kanikoArgs(service, dockerfile, imageNames), dockerConfigJSON != nil)); err != nil {
+		return errors.Wrap(err, "could not create the build job")
+	}
+	defer func() {
+		builder.kubectlCleanup(service, "job", jobName)
+		if ctx.Err() != nil {
+			builder.kanikoStop(service, jobName)
+		}
+	}()
+	builder.Logger.Log(service.Name, time.Now(), "started the build job ", jobName)
+
+	pod, err := builder.kanikoPod(ctx, jobName)
+	if err != nil {
+		return err
+	}
+	if err := builder.kanikoSendContext(ctx, service, dockerfile, pod); err != nil {
+		return err
+	}
+	exitCode, message, err := builder.kanikoResult(ctx, pod)
+	if err != nil {
+		return err
+	}
+	if exitCode != "0" {
+		return fmt.Errorf("the build job %s failed with exit code %s, see the logs for details", jobName, exitCode)
+	}
+	if strings.HasPrefix(message, "sha256:") {
+		builder.Interface.SetDigest(service.Name, strings.TrimSpace(message))
+	}
+	return nil
+}
+
+//kanikoDockerConfig returns the docker config.json which kaniko pulls and pushes with, or nil if there is none: the
+//builder's DockerConfig, or else the user's, with the credentials of its credential helpers (which kaniko cannot run)
+//written into it
+func (builder *Builder) kanikoDockerConfig(service util.BuildableService) ([]byte, error) {
+	path := filepath.Join(builder.DockerConfig, "config.json")
+	if builder.DockerConfig == "" {
+		var err error
+		if path, err = registry.UserDockerConfig(); err != nil {
+			return nil, err
+		}
+	}
+	dockerConfigJSON, unresolved, err := registry.ResolveDockerConfig(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read the registry credentials")
+	}
+	if len(unresolved) > 0 {
+		builder.Logger.Log(service.Name, time.Now(), "could not get the credentials for ", strings.Join(unresolved, ", "),
+			", so kaniko accesses them anonymously")
+	}
+	return dockerConfigJSON, nil
+}
+
+//kanikoJobName returns a unique name for a service's build job, which is a valid kubernetes name
+func kanikoJobName(service util.BuildableService) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	name := "sanic-build-" + strings.ToLower(service.Name)
+	if len(name) > 54 {
+		name = name[:54]
+	}
+	return strings.TrimRight(name, "-.") + "-" + hex.EncodeToString(suffix), nil
+}
+
+//kanikoArgs returns the arguments of the kaniko executor for a service's build
+func (builder *Builder) kanikoArgs(service util.BuildableService, dockerfile string, imageNames []string) []string {
+	serviceConfig := builder.serviceConfig(service)
+	contextDockerfile := kanikoDockerfile
+	if relPath, err := filepath.Rel(builder.buildContext(service), dockerfile); err == nil && !strings.HasPrefix(relPath, "..") {
+		contextDockerfile = filepath.ToSlash(relPath)
+	}
+	args := []string{
+		"--context=tar://stdin",
+		"--dockerfile=" + contextDockerfile,
+		//the pod's termination message is the pushed digest
+		"--digest-file=/dev/termination-log",
+	}
+	for _, imageName := range imageNames {
+		args = append(args, "--destination="+imageName)
+	}
+	if len(serviceConfig.Platforms) == 1 {
+		args = append(args, "--custom-platform="+serviceConfig.Platforms[0])
+	}
+	for _, buildArg := range builder.buildArgs(service) {
+		if !strings.Contains(buildArg, "=") {
+			value, ok := os.LookupEnv(buildArg)
+			if !ok {
+				continue
+			}
+			buildArg += "=" + value
+		}
+		args = append(args, "--build-arg="+buildArg)
+	}
+	if serviceConfig.Target != "" {
+		args = append(args, "--target="+serviceConfig.Target)
+	}
+	labels := builder.imageLabels(service)
+	for _, name := range sortedKeys(labels) {
+		args = append(args, "--label="+name+"="+labels[name])
+	}
+	if builder.importsCache() || builder.exportsCache() {
+		args = append(args, "--cache=true", "--cache-repo="+builder.cacheRepository(service))
+	}
+	if builder.RegistryInsecure {
+		args = append(args, "--insecure", "--insecure-pull")
+	}
+	return args
+}
+
+//kanikoSecret returns a secret with a docker config.json, which kaniko uses to push
+func kanikoSecret(name string, dockerConfigJSON []byte) interface{} {
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]interface{}{"name": name, "labels": map[string]string{"app.kubernetes.io/managed-by": "sanic"}},
+		"data":       map[string]string{"config.json": base64.StdEncoding.EncodeToString(dockerConfigJSON)},
+	}
+}
+
+//kanikoJob returns a job which runs kaniko with the given arguments, and waits for the build context on its stdin
+func kanikoJob(name string, args []string, withDockerConfig bool) interface{} {
+	container := map[string]interface{}{
+		"name":      "kaniko",
+		"image":     kanikoImage,
+		"args":      args,
+		"stdin":     true,
+		"stdinOnce": true,
+	}
+	podSpec := map[string]interface{}{
+		"restartPolicy": "Never",
+		"containers":    []interface{}{container},
+	}
+	if withDockerConfig {
+		container["volumeMounts"] = []interface{}{map[string]interface{}{"name": "docker-config", "mountPath": "/kaniko/.docker"}}
+		podSpec["volumes"] = []interface{}{map[string]interface{}{"name": "docker-config", "secret": map[string]interface{}{"secretName": name}}}
+	}
+	return map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata":   map[string]interface{}{"name": name, "labels": map[string]string{"app.kubernetes.io/managed-by": "sanic"}},
+		"spec": map[string]interface{}{
+			"backoffLimit":            0,
+			"ttlSecondsAfterFinished": 600,
+			"template":                map[string]interface{}{"spec": podSpec},
+		},
+	}
+}
+
+//kubectl creates a kubectl command in the builder's namespace
+func (builder *Builder) kubectl(args ...string) (*exec.Cmd, error) {
+	if builder.NameSpace != "" {
+		args = append(args, "--namespace="+builder.NameSpace)
+	}
+	return builder.KubectlCommand(args...)
+}
+
+//kubectlOutput runs kubectl, and returns what it printed to stdout
+func (builder *Builder) kubectlOutput(ctx context.Context, args ...string) (string, error) {
+	cmd, err := builder.kubectl(args...)
+	if err != nil {
+		return "", err
+	}
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	if err := util.WaitCmdContextually(ctx, cmd); err != nil {
+		return "", errors.Wrap(err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func (builder *Builder) kubectlApply(ctx context.Context, resource interface{}) error {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	cmd, err := builder.kubectl("apply", "-f", "-")
+	if err != nil {
+		return err
+	}
+	out := &bytes.Buffer{}
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := util.WaitCmdContextually(ctx, cmd); err != nil {
+		return errors.Wrap(err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+//kubectlCleanup deletes a resource of a build, even if the build was cancelled
+func (builder *Builder) kubectlCleanup(service util.BuildableService, kind, name string) {
+	if _, err := builder.kubectlOutput(context.Background(), "delete", kind, name, "--ignore-not-found", "--wait=false"); err != nil {
+		builder.Logger.Log(service.Name, time.Now(), "could not delete the ", kind, " ", name, ": ", err.Error())
+	}
+}
+
+//kanikoStop force-deletes the pod of a cancelled build job, so that kaniko stops right away instead of building (and
+//pushing) until the deletion of the job reaches it
+func (builder *Builder) kanikoStop(service util.BuildableService, jobName string) {
+	_, err := builder.kubectlOutput(context.Background(), "delete", "pods", "--selector=job-name="+jobName,
+		"--ignore-not-found", "--grace-period=0", "--force")
+	if err != nil {
+		builder.Logger.Log(service.Name, time.Now(), "could not stop the build job ", jobName, ": ", err.Error())
+	}
+}
+
+//kanikoPod waits for the pod of a build job to be ready to receive the build context, and returns its name
+func (builder *Builder) kanikoPod(ctx context.Context, jobName string) (string, error) {
+	for {
+		pod, err := builder.kubectlOutput(ctx, "get", "pods", "--selector=job-name="+jobName,
+			"--output=jsonpath={.items[0].metadata.name}")
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if err == nil && strings.TrimSpace(pod) != "" {
+			pod = strings.TrimSpace(pod)
+			if _, err := builder.kubectlOutput(ctx, "wait", "--for=condition=Ready", "pod/"+pod, "--timeout=10m"); err != nil {
+				return "", errors.Wrapf(err, "the pod of the build job %s did not start", jobName)
+			}
+			return pod, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+//kanikoSendContext streams the build context of a service to kaniko, as a gzipped tar, and logs kaniko's output
+func (builder *Builder) kanikoSendContext(ctx context.Context, service util.BuildableService, dockerfile, pod string) error {
+	cmd, err := builder.kubectl("attach", "--stdin", "--container=kaniko", "pod/"+pod)
+	if err != nil {
+		return err
+	}
+	contextReader, contextWriter := io.Pipe()
+	cmd.Stdin = contextReader
+	go func() {
+		contextWriter.CloseWithError(builder.writeKanikoContext(contextWriter, service, dockerfile))
+	}()
+	defer contextReader.Close()
+
+	err = builder.runCommandAndOutput(cmd, ctx, service.Name)
+	if err != nil {
+		return errors.Wrap(err, "could not send the build context to kaniko")
+	}
+	return nil
+}
+
+//writeKanikoContext writes the build context of a service as a gzipped tar, with its Dockerfile at kanikoDockerfile
+//if it is not in the context
+func (builder *Builder) writeKanikoContext(w io.Writer, service util.BuildableService, dockerfilePath string) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	contextDir := builder.buildContext(service)
+	err := filepath.Walk(contextDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(contextDir, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tarWriter, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if relPath, err := filepath.Rel(contextDir, dockerfilePath); err != nil || strings.HasPrefix(relPath, "..") {
+		dockerfile, err := ioutil.ReadFile(dockerfilePath)
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{Name: kanikoDockerfile, Mode: 0644, Size: int64(len(dockerfile)), ModTime: time.Now()}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tarWriter.Write(dockerfile); err != nil {
+			return err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+//kanikoResult waits for kaniko to exit, and returns its exit code and termination message (the pushed digest)
+func (builder *Builder) kanikoResult(ctx context.Context, pod string) (string, string, error) {
+	for {
+		out, err := builder.kubectlOutput(ctx, "get", "pod/"+pod, "--output=jsonpath="+
+			`{.status.containerStatuses[0].state.terminated.exitCode}{"\n"}{.status.containerStatuses[0].state.terminated.message}`)
+		if ctx.Err() != nil {
+			return "", "", ctx.Err()
+		}
+		if err != nil {
+			return "", "", errors.Wrapf(err, "could not get the status of the build pod %s", pod)
+		}
+		scanner := bufio.NewScanner(strings.NewReader(out))
+		exitCode, message := "", ""
+		if scanner.Scan() {
+			exitCode = strings.TrimSpace(scanner.Text())
+		}
+		if scanner.Scan() {
+			message = strings.TrimSpace(scanner.Text())
+		}
+		if exitCode != "" {
+			return exitCode, message, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", "", ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
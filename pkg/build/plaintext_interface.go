@@ -14,6 +14,7 @@ type plaintextInterfaceJob struct {
 	totalJobLogs strings.Builder
 	startTime    time.Time
 	image        string
+	upToDate     bool
 }
 
 type plaintextInterface struct {
@@ -50,6 +51,10 @@ func (iface *plaintextInterface) Close() {
 	//do nothing
 }
 
+func (iface *plaintextInterface) InspectAndClose() {
+	iface.Close()
+}
+
 func (iface *plaintextInterface) StartJob(service string, image string) {
 	iface.mutex.Lock()
 	defer iface.mutex.Unlock()
@@ -82,7 +87,9 @@ func (iface *plaintextInterface) SucceedJob(service string) {
 
 	if job, ok := iface.jobs[service]; ok {
 		logs := job.totalJobLogs.String()
-		if logs != "" {
+		if job.upToDate {
+			fmt.Printf("[%s] Service is up to date.\n", service)
+		} else if logs != "" {
 			fmt.Printf("[%s] Logs for successfully built service:\n", job.image)
 			fmt.Print(logs)
 			fmt.Printf("[%s] End of logs.\n\n", service)
@@ -92,10 +99,51 @@ func (iface *plaintextInterface) SucceedJob(service string) {
 	}
 }
 
+func (iface *plaintextInterface) CancelJob(service string) {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+
+	if _, ok := iface.jobs[service]; !ok {
+		iface.jobs[service] = &plaintextInterfaceJob{image: service}
+	}
+	fmt.Printf("[%s] Build cancelled.\n", service)
+}
+
+func (iface *plaintextInterface) SkipJob(service string, reason string) {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+
+	iface.jobs[service] = &plaintextInterfaceJob{image: service}
+	fmt.Printf("[%s] Service skipped: %s\n", service, reason)
+}
+
 func (iface *plaintextInterface) SetPushing(service string) {
 	//plaintext interface does not show statuses, ignore
 }
 
+func (iface *plaintextInterface) SetDigest(service string, digest string) {
+	//digests are only used in build reports, ignore
+}
+
+func (iface *plaintextInterface) SetWaiting(reason string) {
+	if reason != "" {
+		fmt.Println(reason)
+	}
+}
+
+func (iface *plaintextInterface) SetUpToDate(service string) {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+
+	if job, ok := iface.jobs[service]; ok {
+		job.upToDate = true
+	}
+}
+
+func (iface *plaintextInterface) ProcessVertex(service string, vertex Vertex) {
+	//plaintext interface does not show statuses, ignore (steps are already logged by the builder)
+}
+
 func (iface *plaintextInterface) ProcessLog(service, logLine string) {
 	iface.mutex.Lock()
 	defer iface.mutex.Unlock()
@@ -112,3 +160,15 @@ func (iface *plaintextInterface) ProcessLog(service, logLine string) {
 func (iface *plaintextInterface) AddCancelListener(cancelFunc func()) {
 	iface.cancelListeners = append(iface.cancelListeners, cancelFunc)
 }
+
+func (iface *plaintextInterface) SetImageSize(service string, size *ImageSize) {
+	//the size is already in the job's logs, ignore
+}
+
+func (iface *plaintextInterface) SetEstimates(estimates map[string]time.Duration, parallelism int) {
+	//plaintext output has no status line to show estimates in, ignore
+}
+
+func (iface *plaintextInterface) AddJobCancelListener(cancelFunc func(service string)) {
+	//single jobs cannot be cancelled without an interactive terminal, ignore
+}
@@ -0,0 +1,292 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/containerd/containerd/platforms"
+	"github.com/pkg/errors"
+	"github.com/webappio/sanic/pkg/util"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+//checkPlatforms makes sure that the builder can build every platform that a service needs, i.e., that it runs on
+//them or can emulate them, according to supportedPlatforms (which is not checked if it is nil).
+//Images for more than one platform cannot be loaded into docker, so they have to be pushed.
+func (builder *Builder) checkPlatforms(service util.BuildableService, supportedPlatforms func() ([]string, error)) error {
+	platforms := builder.serviceConfig(service).Platforms
+	if len(platforms) == 0 {
+		return nil
+	}
+	if len(platforms) > 1 && !builder.DoPush {
+		return fmt.Errorf("%s is built for more than one platform (%s), which docker cannot load: build it with --push instead",
+			service.Name, strings.Join(platforms, ", "))
+	}
+	if supportedPlatforms == nil {
+		return nil
+	}
+
+	supported, err := supportedPlatforms()
+	if err != nil {
+		return err
+	}
+	var unsupported []string
+	for _, platform := range platforms {
+		if !platformSupported(platform, supported) {
+			unsupported = append(unsupported, platform)
+		}
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("%s is built for %s, but the builder can only build for %s. "+
+			"To emulate other platforms with QEMU, run: docker run --privileged --rm tonistiigi/binfmt --install all",
+			service.Name, strings.Join(unsupported, ", "), strings.Join(supported, ", "))
+	}
+	return nil
+}
+
+//buildkitPlatforms returns the platforms that the buildkitd daemon can build, which are only listed once per Builder.
+//It must only be called once checkBuildkit succeeded.
+func (builder *Builder) buildkitPlatforms() ([]string, error) {
+	state := builder.shared()
+	state.buildkitPlatformsCheck.Do(func() {
+		state.buildkitPlatformList, state.buildkitPlatformsErr = builder.listBuildkitPlatforms()
+	})
+	return state.buildkitPlatformList, state.buildkitPlatformsErr
+}
+
+func (builder *Builder) listBuildkitPlatforms() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	workers, err := builder.shared().buildkit.client.ListWorkers(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list the platforms that buildkitd can build")
+	}
+	var platformList []string
+	seen := make(map[string]bool)
+	for _, worker := range workers {
+		for _, platform := range worker.Platforms {
+			name := platforms.Format(platform)
+			if !seen[name] {
+				seen[name] = true
+				platformList = append(platformList, name)
+			}
+		}
+	}
+	if len(platformList) == 0 {
+		return nil, errors.New("buildkitd did not list any platforms that it can build")
+	}
+	return platformList, nil
+}
+
+//buildxPlatforms returns the platforms that the current buildx builder can build, which are only listed once per Builder
+func (builder *Builder) buildxPlatforms() ([]string, error) {
+	state := builder.shared()
+	state.buildxPlatformsCheck.Do(func() {
+		state.buildxPlatformList, state.buildxPlatformsErr = builder.workerPlatforms("docker", "buildx", "inspect", "--bootstrap")
+	})
+	return state.buildxPlatformList, state.buildxPlatformsErr
+}
+
+//workerPlatforms runs "docker buildx inspect" and returns the platforms in its output
+func (builder *Builder) workerPlatforms(name string, args ...string) ([]string, error) {
+	cmd := builder.command(name, args...)
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("could not list the platforms that %s %s can build: %s", name, args[0], strings.TrimSpace(out.String()))
+	}
+	platforms := parsePlatforms(out.String())
+	if len(platforms) == 0 {
+		return nil, fmt.Errorf("%s %s did not list any platforms that it can build", name, args[0])
+	}
+	return platforms, nil
+}
+
+//parsePlatforms returns the platforms in the "Platforms:" lines of buildx output, without duplicates
+func parsePlatforms(output string) []string {
+	var platforms []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "Platforms:") {
+			continue
+		}
+		for _, platform := range strings.Split(strings.TrimPrefix(line, "Platforms:"), ",") {
+			platform = strings.TrimSuffix(strings.TrimSpace(platform), "*")
+			if platform != "" && !seen[platform] {
+				seen[platform] = true
+				platforms = append(platforms, platform)
+			}
+		}
+	}
+	return platforms
+}
+
+//platformSupported checks if a platform is in the list of platforms that a builder supports.
+//A platform without a variant (e.g., linux/arm) matches any variant of it (e.g., linux/arm/v7).
+func platformSupported(platform string, supported []string) bool {
+	for _, s := range supported {
+		if s == platform || strings.HasPrefix(s, platform+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+//buildWithBuildx builds a service with "docker buildx build", for the platforms in its configuration and with the
+//builder's cache import and export. If DoPush is set, every platform is pushed as a single multi-platform image,
+//otherwise it is loaded into docker.
+func (builder *Builder) buildWithBuildx(ctx context.Context, service util.BuildableService, dockerfile string, imageNames []string) error {
+	serviceConfig := builder.serviceConfig(service)
+	if len(serviceConfig.Platforms) > 0 {
+		//multi-platform builds run in a buildx builder with its own buildkitd
+		if err := builder.checkParentsPushed(service, "buildx"); err != nil {
+			return err
+		}
+	}
+	args := []string{"buildx", "build", "--progress", "plain"}
+	if len(serviceConfig.Platforms) > 0 {
+		args = append(args, "--platform", strings.Join(serviceConfig.Platforms, ","))
+	}
+	for _, buildArg := range builder.buildArgs(service) {
+		args = append(args, "--build-arg", buildArg)
+	}
+	if serviceConfig.Target != "" {
+		args = append(args, "--target", serviceConfig.Target)
+	}
+	if serviceConfig.Network != "" {
+		args = append(args, "--network", serviceConfig.Network)
+	}
+	if builder.NoCache {
+		args = append(args, "--no-cache")
+	}
+	if builder.importsCache() {
+		args = append(args, "--cache-from", builder.cacheImport(service))
+	}
+	if builder.exportsCache() {
+		args = append(args, "--cache-to", builder.cacheExport(service))
+	}
+	labels := builder.imageLabels(service)
+	var labelNames []string
+	for name := range labels {
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+	for _, name := range labelNames {
+		args = append(args, "--label", name+"="+labels[name])
+	}
+	for _, imageName := range imageNames {
+		args = append(args, "--tag", imageName)
+	}
+
+	var metadataFile string
+	if builder.DoPush {
+		builder.Interface.SetPushing(service.Name)
+		dir, err := ioutil.TempDir("", "sanic-buildx-metadata")
+		if err != nil {
+			return errors.Wrap(err, "could not create a directory for the build metadata")
+		}
+		defer os.RemoveAll(dir)
+		metadataFile = filepath.Join(dir, "metadata.json")
+		args = append(args, "--push", "--metadata-file", metadataFile)
+	} else {
+		args = append(args, "--load")
+	}
+	args = append(args,
+		"--file", dockerfile,
+		builder.buildContext(service))
+
+	cmd := builder.command("docker", args...)
+	cmd.Dir = service.Dir
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return errors.Wrap(err, "could not pipe stderr from docker buildx build command")
+	}
+	cmd.Stdout = ioutil.Discard
+
+	var errorLines []string
+	progressDone := make(chan interface{})
+	go func() {
+		defer close(progressDone)
+		progress := &plainProgress{vertices: make(map[string]*Vertex)}
+		scanner := bufio.NewScanner(stderr)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			builder.Logger.LogStream(service.Name, StreamStderr, time.Now(), line)
+			if vertex, ok := progress.update(line); ok {
+				builder.Interface.ProcessVertex(service.Name, vertex)
+			}
+			if strings.HasPrefix(line, "ERROR") || strings.Contains(line, " ERROR") {
+				errorLines = append(errorLines, line)
+			}
+		}
+	}()
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	err = util.WaitCmdContextually(ctx, cmd)
+	<-progressDone
+	if err != nil {
+		return errors.Wrapf(err, "error: %s", strings.Join(errorLines, "\n"))
+	}
+	if metadataFile != "" {
+		metadata := make(map[string]interface{})
+		if data, err := ioutil.ReadFile(metadataFile); err == nil && json.Unmarshal(data, &metadata) == nil {
+			if digest, ok := metadata["containerimage.digest"].(string); ok {
+				builder.Interface.SetDigest(service.Name, digest)
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	plainProgressStartRegex = regexp.MustCompile(`^#(\d+) (\[.*)$`)
+	plainProgressEndRegex   = regexp.MustCompile(`^#(\d+) (DONE|CACHED|ERROR)`)
+)
+
+//plainProgress turns "--progress plain" output of docker buildx into vertices, e.g.,
+//"#7 [linux/arm64 2/5] RUN pip install -r requirements.txt" starts a step and "#7 DONE 1.2s" completes it
+type plainProgress struct {
+	vertices map[string]*Vertex //step number -> vertex
+}
+
+func (progress *plainProgress) update(line string) (Vertex, bool) {
+	if match := plainProgressStartRegex.FindStringSubmatch(line); match != nil {
+		if _, ok := progress.vertices[match[1]]; ok {
+			return Vertex{}, false
+		}
+		now := time.Now()
+		vertex := &Vertex{Digest: match[1], Name: match[2], Started: &now}
+		vertex.Platform, vertex.Step = vertexPlatformStep(match[2])
+		progress.vertices[match[1]] = vertex
+		return *vertex, true
+	}
+	if match := plainProgressEndRegex.FindStringSubmatch(line); match != nil {
+		vertex, ok := progress.vertices[match[1]]
+		if !ok {
+			return Vertex{}, false
+		}
+		now := time.Now()
+		vertex.Completed = &now
+		switch match[2] {
+		case "CACHED":
+			vertex.Cached = true
+		case "ERROR":
+			vertex.Error = strings.TrimSpace(strings.TrimPrefix(line, match[0]))
+		}
+		return *vertex, true
+	}
+	return Vertex{}, false
+}
@@ -0,0 +1,64 @@
+package build
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePlatforms(t *testing.T) {
+	tests := []struct {
+		name      string
+		output    string
+		platforms []string
+	}{
+		{
+			name: "buildx inspect",
+			output: `Name:   default
+Driver: docker
+
+Nodes:
+Name:      default
+Endpoint:  default
+Status:    running
+Platforms: linux/amd64, linux/amd64/v2, linux/386, linux/arm64*, linux/arm/v7*
+`,
+			platforms: []string{"linux/amd64", "linux/amd64/v2", "linux/386", "linux/arm64", "linux/arm/v7"},
+		},
+		{
+			name:      "several nodes",
+			output:    "Platforms: linux/amd64, linux/arm64\nPlatforms: linux/arm64, linux/s390x\n",
+			platforms: []string{"linux/amd64", "linux/arm64", "linux/s390x"},
+		},
+		{name: "no platforms", output: "Name: default\nPlatforms:\n"},
+		{name: "empty", output: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if platforms := parsePlatforms(test.output); !reflect.DeepEqual(platforms, test.platforms) {
+				t.Errorf("got %v, want %v", platforms, test.platforms)
+			}
+		})
+	}
+}
+
+func TestPlatformSupported(t *testing.T) {
+	supported := []string{"linux/amd64", "linux/arm64", "linux/arm/v7"}
+	tests := []struct {
+		platform  string
+		supported bool
+	}{
+		{platform: "linux/amd64", supported: true},
+		{platform: "linux/arm64", supported: true},
+		{platform: "linux/arm", supported: true},
+		{platform: "linux/arm/v7", supported: true},
+		{platform: "linux/arm/v6"},
+		{platform: "linux/amd"},
+		{platform: "linux/s390x"},
+		{platform: "windows/amd64"},
+	}
+	for _, test := range tests {
+		if got := platformSupported(test.platform, supported); got != test.supported {
+			t.Errorf("platformSupported(%s) is %t, want %t", test.platform, got, test.supported)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/webappio/sanic/pkg/util"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+//podmanBackend builds images with "podman build", which does not need a daemon or root
+type podmanBackend struct{}
+
+func (podmanBackend) ImageStore() string {
+	return "podman"
+}
+
+func (podmanBackend) Build(ctx context.Context, builder *Builder, service util.BuildableService, dockerfile string, imageNames []string) error {
+	if err := builder.checkPlatforms(service, nil); err != nil {
+		return err
+	}
+	serviceConfig := builder.serviceConfig(service)
+	multiPlatform := len(serviceConfig.Platforms) > 1
+
+	args := []string{"build", "--layers"}
+	if len(serviceConfig.Platforms) > 0 {
+		args = append(args, "--platform", strings.Join(serviceConfig.Platforms, ","))
+	}
+	for _, buildArg := range builder.buildArgs(service) {
+		args = append(args, "--build-arg", buildArg)
+	}
+	if serviceConfig.Target != "" {
+		args = append(args, "--target", serviceConfig.Target)
+	}
+	if serviceConfig.Network != "" {
+		args = append(args, "--network", serviceConfig.Network)
+	}
+	if builder.NoCache {
+		args = append(args, "--no-cache")
+	}
+	if builder.importsCache() {
+		args = append(args, "--cache-from", builder.cacheRepository(service))
+	}
+	if builder.exportsCache() {
+		args = append(args, "--cache-to", builder.cacheRepository(service))
+	}
+	labels := builder.imageLabels(service)
+	var labelNames []string
+	for name := range labels {
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+	for _, name := range labelNames {
+		args = append(args, "--label", name+"="+labels[name])
+	}
+	if multiPlatform {
+		//the image of every platform is added to a manifest list, which is pushed as each of the names
+		args = append(args, "--manifest", imageNames[0])
+	} else {
+		for _, imageName := range imageNames {
+			args = append(args, "--tag", imageName)
+		}
+	}
+	args = append(args,
+		"--file", dockerfile,
+		builder.buildContext(service))
+
+	if multiPlatform {
+		//podman adds to an existing manifest list of the same name, instead of replacing it
+		builder.command("podman", "manifest", "rm", imageNames[0]).Run()
+	}
+	if err := builder.runPodman(ctx, service, args, true); err != nil {
+		return err
+	}
+
+	if !builder.DoPush {
+		return nil
+	}
+	builder.Interface.SetPushing(service.Name)
+	builder.Logger.Log(service.Name, time.Now(), "pushing image to registry...")
+	for _, imageName := range imageNames {
+		pushArgs := []string{"push", fmt.Sprintf("--tls-verify=%t", !builder.RegistryInsecure), imageName}
+		if multiPlatform {
+			pushArgs = []string{"manifest", "push", "--all", fmt.Sprintf("--tls-verify=%t", !builder.RegistryInsecure),
+				imageNames[0], "docker://" + imageName}
+		}
+		if err := builder.runPodman(ctx, service, pushArgs, false); err != nil {
+			return errors.Wrap(err, "could not push")
+		}
+	}
+	if !multiPlatform {
+		if digest := pushedDigest("podman", imageNames[0]); digest != "" {
+			builder.Interface.SetDigest(service.Name, digest)
+		}
+	}
+	return nil
+}
+
+//runPodman runs podman with the given arguments, logging everything it outputs.
+//If showSteps is set, the steps of the build in its output are sent to the Interface.
+func (builder *Builder) runPodman(ctx context.Context, service util.BuildableService, args []string, showSteps bool) error {
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "could not create a pipe for the output of podman")
+	}
+	defer stdoutReader.Close()
+	defer stdoutWriter.Close()
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "could not create a pipe for the errors of podman")
+	}
+	defer stderrReader.Close()
+	defer stderrWriter.Close()
+
+	cmd := builder.command("podman", args...)
+	cmd.Dir = service.Dir
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+
+	//podman writes the steps of a build to stdout, and its errors to stderr
+	progress := &podmanProgress{}
+	stdoutDone := builder.logOutput(stdoutReader, service.Name, StreamStdout, func(line string) {
+		if showSteps {
+			for _, vertex := range progress.update(line) {
+				builder.Interface.ProcessVertex(service.Name, vertex)
+			}
+		}
+	})
+	var errorLines []string
+	stderrDone := builder.logOutput(stderrReader, service.Name, StreamStderr, func(line string) {
+		if strings.HasPrefix(line, "Error:") {
+			errorLines = append(errorLines, line)
+		}
+	})
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	//podman has its own copies of the pipes, so close ours to see EOF when it exits
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	err = util.WaitCmdContextually(ctx, cmd)
+	<-stdoutDone
+	<-stderrDone
+	if showSteps {
+		for _, vertex := range progress.finish() {
+			builder.Interface.ProcessVertex(service.Name, vertex)
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error: %s", strings.Join(errorLines, "\n"))
+	}
+	return nil
+}
+
+var podmanStepRegex = regexp.MustCompile(`^STEP (\d+/\d+): (.*)$`)
+
+//podmanProgress turns the output of podman build into vertices, e.g., "STEP 2/5: RUN pip install -r requirements.txt"
+//starts a step (which completes the previous one), and "--> Using cache ..." means that it was cached
+type podmanProgress struct {
+	current *Vertex
+	steps   int
+}
+
+func (progress *podmanProgress) update(line string) []Vertex {
+	if match := podmanStepRegex.FindStringSubmatch(line); match != nil {
+		changed := progress.finish()
+		progress.steps++
+		now := time.Now()
+		progress.current = &Vertex{
+			Digest:  fmt.Sprintf("podman-step-%d", progress.steps),
+			Name:    fmt.Sprintf("[%s] %s", match[1], match[2]),
+			Step:    match[1],
+			Started: &now,
+		}
+		return append(changed, *progress.current)
+	}
+	if progress.current != nil && strings.HasPrefix(line, "--> Using cache") {
+		progress.current.Cached = true
+	}
+	return nil
+}
+
+//finish completes the current step, if there is one
+func (progress *podmanProgress) finish() []Vertex {
+	if progress.current == nil {
+		return nil
+	}
+	now := time.Now()
+	progress.current.Completed = &now
+	vertex := *progress.current
+	progress.current = nil
+	return []Vertex{vertex}
+}
@@ -0,0 +1,71 @@
+package build
+
+import (
+	"github.com/webappio/sanic/pkg/util"
+	"path/filepath"
+	"time"
+)
+
+//The labels that Builder stamps on every image, see Provenance.
+//The sanic ones are not part of the OCI image spec, so they are in sanic's own namespace.
+const (
+	LabelTitle       = "org.opencontainers.image.title"
+	LabelRevision    = "org.opencontainers.image.revision"
+	LabelSource      = "org.opencontainers.image.source"
+	LabelCreated     = "org.opencontainers.image.created"
+	LabelVersion     = "io.webapp.sanic.version"
+	LabelEnvironment = "io.webapp.sanic.environment"
+	LabelTreeHash    = "io.webapp.sanic.tree"
+)
+
+//Provenance describes where built images come from. Builder stamps it on every image as labels (see Labels),
+//so that "sanic image inspect" can find the service directory and commit of an image.
+type Provenance struct {
+	//GitRoot is the root of the git repository which contains the services, or empty if they are not in one
+	GitRoot string
+	//Revision is the HEAD commit, and TreeHash the tree which was built: the commit's files plus any uncommitted changes.
+	//They are empty if the services are not in a git repository with at least one commit.
+	Revision string
+	TreeHash string
+	//Environment is the name of the environment the images are built in, or empty if not in one
+	Environment string
+	//Version is the version of sanic which builds the images
+	Version string
+}
+
+//Labels returns the labels to stamp on an image of the service, which is built at the given time
+func (provenance *Provenance) Labels(service util.BuildableService, created time.Time) map[string]string {
+	labels := map[string]string{
+		LabelTitle:   service.Name,
+		LabelCreated: created.UTC().Format(time.RFC3339),
+		LabelVersion: provenance.Version,
+	}
+	if provenance.GitRoot != "" {
+		if source, err := filepath.Rel(provenance.GitRoot, service.Dir); err == nil {
+			labels[LabelSource] = filepath.ToSlash(source)
+		}
+	}
+	if provenance.Revision != "" {
+		labels[LabelRevision] = provenance.Revision
+	}
+	if provenance.TreeHash != "" {
+		labels[LabelTreeHash] = provenance.TreeHash
+	}
+	if provenance.Environment != "" {
+		labels[LabelEnvironment] = provenance.Environment
+	}
+	return labels
+}
+
+//imageLabels returns the labels of a service's image: its provenance, and the labels in its build configuration
+//(which take precedence)
+func (builder *Builder) imageLabels(service util.BuildableService) map[string]string {
+	labels := make(map[string]string)
+	if builder.Provenance != nil {
+		labels = builder.Provenance.Labels(service, time.Now())
+	}
+	for name, value := range builder.serviceConfig(service).Labels {
+		labels[name] = value
+	}
+	return labels
+}
@@ -0,0 +1,298 @@
+package build
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+//ReportJob is the record of a single service's job in a Report.
+//Its Status is "unfinished" if the build ended (e.g., was cancelled) before the job did.
+type ReportJob struct {
+	Service   string     `json:"service"`
+	Status    JobStatus  `json:"status"`
+	UpToDate  bool       `json:"upToDate"`
+	Image     string     `json:"image,omitempty"`
+	Digest    string     `json:"digest,omitempty"`
+	StartTime *time.Time `json:"startTime,omitempty"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	LogFile   string     `json:"logFile,omitempty"`
+	//Steps is the number of Dockerfile steps which finished, and CachedSteps how many of them were cached
+	//(only known for builds with buildkit or buildx)
+	Steps       int `json:"steps,omitempty"`
+	CachedSteps int `json:"cachedSteps,omitempty"`
+	//ImageSize is the size of the image and of its layers, if it was built and could be measured
+	ImageSize *ImageSize `json:"imageSize,omitempty"`
+}
+
+//Report is a machine-readable record of a build, which can be written as JSON or JUnit XML
+type Report struct {
+	StartTime time.Time    `json:"startTime"`
+	EndTime   time.Time    `json:"endTime"`
+	Jobs      []*ReportJob `json:"jobs"`
+	//Steps and CachedSteps are the totals of the Steps and CachedSteps of every job
+	Steps       int `json:"steps"`
+	CachedSteps int `json:"cachedSteps"`
+}
+
+//ReportInterface is an Interface which records every job into a Report, and passes everything through to another Interface
+type ReportInterface struct {
+	Interface
+	mutex     sync.Mutex
+	startTime time.Time
+	jobs      map[string]*ReportJob
+	steps     map[string]map[string]bool //service -> digests of its finished steps
+}
+
+//NewReportInterface wraps the given Interface to record a Report of the build
+func NewReportInterface(iface Interface) *ReportInterface {
+	return &ReportInterface{
+		Interface: iface,
+		startTime: time.Now(),
+		jobs:      make(map[string]*ReportJob),
+		steps:     make(map[string]map[string]bool),
+	}
+}
+
+func (iface *ReportInterface) job(service string) *ReportJob {
+	job, ok := iface.jobs[service]
+	if !ok {
+		job = &ReportJob{Service: service}
+		iface.jobs[service] = job
+	}
+	return job
+}
+
+func (iface *ReportInterface) end(service string, status JobStatus) *ReportJob {
+	now := time.Now()
+	job := iface.job(service)
+	job.Status = status
+	job.EndTime = &now
+	return job
+}
+
+func (iface *ReportInterface) StartJob(service string, image string) {
+	iface.mutex.Lock()
+	now := time.Now()
+	job := iface.job(service)
+	job.Image = image
+	job.StartTime = &now
+	iface.mutex.Unlock()
+
+	iface.Interface.StartJob(service, image)
+}
+
+func (iface *ReportInterface) FailJob(service string, err error) {
+	iface.mutex.Lock()
+	iface.end(service, JobFailed).Error = err.Error()
+	iface.mutex.Unlock()
+
+	iface.Interface.FailJob(service, err)
+}
+
+func (iface *ReportInterface) SucceedJob(service string) {
+	iface.mutex.Lock()
+	iface.end(service, JobSucceeded)
+	iface.mutex.Unlock()
+
+	iface.Interface.SucceedJob(service)
+}
+
+func (iface *ReportInterface) CancelJob(service string) {
+	iface.mutex.Lock()
+	iface.end(service, JobCancelled)
+	iface.mutex.Unlock()
+
+	iface.Interface.CancelJob(service)
+}
+
+func (iface *ReportInterface) SkipJob(service string, reason string) {
+	iface.mutex.Lock()
+	iface.end(service, JobSkipped).Error = reason
+	iface.mutex.Unlock()
+
+	iface.Interface.SkipJob(service, reason)
+}
+
+func (iface *ReportInterface) SetUpToDate(service string) {
+	iface.mutex.Lock()
+	iface.job(service).UpToDate = true
+	iface.mutex.Unlock()
+
+	iface.Interface.SetUpToDate(service)
+}
+
+func (iface *ReportInterface) SetImageSize(service string, size *ImageSize) {
+	iface.mutex.Lock()
+	iface.job(service).ImageSize = size
+	iface.mutex.Unlock()
+
+	iface.Interface.SetImageSize(service, size)
+}
+
+func (iface *ReportInterface) SetDigest(service string, digest string) {
+	iface.mutex.Lock()
+	iface.job(service).Digest = digest
+	iface.mutex.Unlock()
+
+	iface.Interface.SetDigest(service, digest)
+}
+
+//ProcessVertex counts the finished Dockerfile steps of each job, and how many of them were cached
+func (iface *ReportInterface) ProcessVertex(service string, vertex Vertex) {
+	if vertex.Step != "" && (vertex.Completed != nil || vertex.Cached) {
+		iface.mutex.Lock()
+		if iface.steps[service] == nil {
+			iface.steps[service] = make(map[string]bool)
+		}
+		if !iface.steps[service][vertex.Digest] {
+			iface.steps[service][vertex.Digest] = true
+			job := iface.job(service)
+			job.Steps++
+			if vertex.Cached {
+				job.CachedSteps++
+			}
+		}
+		iface.mutex.Unlock()
+	}
+
+	iface.Interface.ProcessVertex(service, vertex)
+}
+
+//Report returns the Report of everything recorded so far, with the log file of each job from the given Logger
+func (iface *ReportInterface) Report(logger Logger) *Report {
+	iface.mutex.Lock()
+	defer iface.mutex.Unlock()
+
+	report := &Report{
+		StartTime: iface.startTime,
+		EndTime:   time.Now(),
+	}
+	for _, job := range iface.jobs {
+		jobCopy := *job
+		if jobCopy.Status == "" {
+			jobCopy.Status = "unfinished"
+		}
+		if logger != nil && job.StartTime != nil {
+			jobCopy.LogFile = logger.LogPath(job.Service)
+		}
+		report.Jobs = append(report.Jobs, &jobCopy)
+		report.Steps += job.Steps
+		report.CachedSteps += job.CachedSteps
+	}
+	sort.Slice(report.Jobs, func(i, j int) bool {
+		return report.Jobs[i].Service < report.Jobs[j].Service
+	})
+	return report
+}
+
+//WriteJSON writes the report as indented JSON
+func (report *Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr,omitempty"`
+	Body    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+func junitDuration(start, end *time.Time) string {
+	if start == nil || end == nil {
+		return "0"
+	}
+	return fmt.Sprintf("%.3f", end.Sub(*start).Seconds())
+}
+
+//WriteJUnit writes the report as JUnit XML, with a test case for each service
+func (report *Report) WriteJUnit(w io.Writer) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report.junitSuite("sanic build", "sanic.build")); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+//junitSuite returns the JUnit test suite of the report, with a test case for each service
+func (report *Report) junitSuite(name, className string) junitTestSuite {
+	suite := junitTestSuite{
+		Name:      name,
+		Tests:     len(report.Jobs),
+		Time:      junitDuration(&report.StartTime, &report.EndTime),
+		Timestamp: report.StartTime.Format("2006-01-02T15:04:05"),
+	}
+	for _, job := range report.Jobs {
+		testCase := junitTestCase{
+			ClassName: className,
+			Name:      job.Service,
+			Time:      junitDuration(job.StartTime, job.EndTime),
+		}
+		if job.Image != "" {
+			testCase.SystemOut = "image: " + job.Image + "\n"
+		}
+		if job.Digest != "" {
+			testCase.SystemOut += "digest: " + job.Digest + "\n"
+		}
+		if job.UpToDate {
+			testCase.SystemOut += "up to date\n"
+		}
+		if job.Steps > 0 {
+			testCase.SystemOut += fmt.Sprintf("cache: %d of %d steps cached\n", job.CachedSteps, job.Steps)
+		}
+		if job.ImageSize != nil {
+			testCase.SystemOut += fmt.Sprintf("image size: %s in %d layers\n", job.ImageSize, len(job.ImageSize.Layers))
+		}
+		if job.LogFile != "" {
+			testCase.SystemOut += "[[ATTACHMENT|" + job.LogFile + "]]\n"
+		}
+		switch job.Status {
+		case JobSkipped:
+			suite.Skipped++
+			testCase.Skipped = &junitMessage{Message: job.Error}
+		case JobCancelled:
+			suite.Skipped++
+			testCase.Skipped = &junitMessage{Message: "the build was cancelled"}
+		case JobSucceeded:
+		default:
+			suite.Failures++
+			message := job.Error
+			if message == "" {
+				message = "the build did not finish"
+			}
+			testCase.Failure = &junitMessage{Message: message, Body: message}
+		}
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+	return suite
+}
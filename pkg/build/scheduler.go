@@ -0,0 +1,323 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"github.com/webappio/sanic/pkg/util"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+//JobStatus is the final state of a job run by a Scheduler
+type JobStatus string
+
+const (
+	//JobSucceeded means the job ran and did not return an error
+	JobSucceeded JobStatus = "succeeded"
+	//JobFailed means the job ran and returned an error
+	JobFailed JobStatus = "failed"
+	//JobSkipped means the job was never run, because a service it depends on did not succeed
+	JobSkipped JobStatus = "skipped"
+	//JobCancelled means the build was cancelled (by the user, or by another job failing with FailFast)
+	//before the job finished, or before it started
+	JobCancelled JobStatus = "cancelled"
+)
+
+//JobResult is the outcome of running a job for a single service
+type JobResult struct {
+	Service string
+	Status  JobStatus
+	Err     error
+}
+
+//Scheduler runs a job for each service in dependency order:
+//a service's job starts only after the jobs of all of its parents (see Graph) have succeeded
+type Scheduler struct {
+	Graph          *Graph
+	MaxParallelism int
+	Interface      Interface
+	//FailFast cancels every other job as soon as one fails, instead of letting them keep going
+	FailFast bool
+	//Estimates are how long each service's job is expected to take (see BuildHistory). When more jobs are ready than
+	//MaxParallelism allows, the ones on the longest path of expected time through the Graph start first.
+	Estimates map[string]time.Duration
+
+	mutex      sync.Mutex
+	jobCancels map[string]context.CancelFunc //service -> cancels its job, for the jobs of the current Run
+}
+
+//CancelJob cancels the job of a single service in the current Run, whether or not it has started.
+//Jobs which depend on it are cancelled as well, the rest keep going.
+func (scheduler *Scheduler) CancelJob(service string) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	if cancel, ok := scheduler.jobCancels[service]; ok {
+		cancel()
+	}
+}
+
+//Parallelism returns how many jobs run at once, i.e., MaxParallelism, or the number of CPUs if it is not set
+func (scheduler *Scheduler) Parallelism() int {
+	if scheduler.MaxParallelism <= 0 {
+		return runtime.NumCPU()
+	}
+	return scheduler.MaxParallelism
+}
+
+//Run runs job for each of the given services, with at most MaxParallelism jobs running at once.
+//Parents which are not in services are assumed to be up to date, and are not waited for.
+//If a parent's job does not succeed, the service's job is skipped (and marked as such in the Interface).
+//If ctx is cancelled, jobs which have not finished yet are marked as cancelled.
+//It returns the results for each service, in the same order as services.
+func (scheduler *Scheduler) Run(ctx context.Context, services []util.BuildableService, job func(context.Context, util.BuildableService) error) []JobResult {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	maxParallelism := scheduler.Parallelism()
+	priorities := scheduler.criticalPaths(services)
+
+	results := make([]JobResult, len(services))
+	resultIndices := make(map[string]int)
+	jobsDone := make(map[string]chan interface{})
+	jobContexts := make(map[string]context.Context)
+	jobCancels := make(map[string]context.CancelFunc)
+	for i, service := range services {
+		resultIndices[service.Name] = i
+		jobsDone[service.Name] = make(chan interface{})
+		jobContexts[service.Name], jobCancels[service.Name] = context.WithCancel(ctx)
+		defer jobCancels[service.Name]()
+	}
+	scheduler.mutex.Lock()
+	scheduler.jobCancels = jobCancels
+	scheduler.mutex.Unlock()
+
+	//the jobs which do not wait for any parents all start at once, and get their credits in order of priority
+	var initialJobs int
+	for _, service := range services {
+		initialJobs++
+		if scheduler.Graph != nil {
+			for _, parent := range scheduler.Graph.Parents(service.Name) {
+				if _, ok := jobsDone[parent]; ok {
+					initialJobs--
+					break
+				}
+			}
+		}
+	}
+	parallelismCredits := newPrioritySemaphore(maxParallelism, initialJobs)
+
+	var funcs []func(context.Context) error
+	for i, service := range services {
+		finalIndex := i
+		finalService := service
+		funcs = append(funcs, func(context.Context) error {
+			defer close(jobsDone[finalService.Name])
+			ctx := jobContexts[finalService.Name]
+			result := &results[finalIndex]
+			result.Service = finalService.Name
+
+			if scheduler.Graph != nil {
+				for _, parent := range scheduler.Graph.Parents(finalService.Name) {
+					parentDone, ok := jobsDone[parent]
+					if !ok {
+						continue
+					}
+					<-parentDone
+					switch results[resultIndices[parent]].Status {
+					case JobSucceeded:
+					case JobCancelled:
+						scheduler.cancelJob(result)
+						return nil
+					default:
+						result.Status = JobSkipped
+						result.Err = fmt.Errorf("%s depends on %s, which did not build", finalService.Name, parent)
+						scheduler.Interface.SkipJob(finalService.Name, result.Err.Error())
+						return nil
+					}
+				}
+			}
+
+			if !parallelismCredits.acquire(ctx, priorities[finalService.Name]) {
+				scheduler.cancelJob(result)
+				return nil
+			}
+			if ctx.Err() != nil {
+				parallelismCredits.release()
+				scheduler.cancelJob(result)
+				return nil
+			}
+			err := job(ctx, finalService)
+			parallelismCredits.release()
+
+			if err != nil && ctx.Err() != nil {
+				scheduler.cancelJob(result)
+			} else if err != nil {
+				result.Status = JobFailed
+				result.Err = err
+				if scheduler.FailFast {
+					cancel()
+				}
+			} else {
+				result.Status = JobSucceeded
+			}
+			return nil
+		})
+	}
+
+	util.RunContextuallyInParallel(ctx, funcs...)
+	return results
+}
+
+//criticalPaths returns, for each of the services, the longest expected time (see Estimates) of it and the services
+//built from it, i.e., how long the build takes at least once it starts.
+//Services without an estimate are expected to take as long as the average of the others.
+func (scheduler *Scheduler) criticalPaths(services []util.BuildableService) map[string]time.Duration {
+	selected := make(map[string]bool)
+	var total time.Duration
+	var estimated int
+	for _, service := range services {
+		selected[service.Name] = true
+		if estimate, ok := scheduler.Estimates[service.Name]; ok {
+			total += estimate
+			estimated++
+		}
+	}
+	var defaultEstimate time.Duration
+	if estimated > 0 {
+		defaultEstimate = total / time.Duration(estimated)
+	}
+
+	paths := make(map[string]time.Duration)
+	var criticalPath func(service string) time.Duration
+	criticalPath = func(service string) time.Duration {
+		if path, ok := paths[service]; ok {
+			return path
+		}
+		var longestChild time.Duration
+		if scheduler.Graph != nil {
+			for _, child := range scheduler.Graph.Children(service) {
+				if childPath := criticalPath(child); selected[child] && childPath > longestChild {
+					longestChild = childPath
+				}
+			}
+		}
+		estimate, ok := scheduler.Estimates[service]
+		if !ok {
+			estimate = defaultEstimate
+		}
+		paths[service] = estimate + longestChild
+		return paths[service]
+	}
+	for _, service := range services {
+		criticalPath(service.Name)
+	}
+	return paths
+}
+
+//prioritySemaphore hands out a fixed number of credits, to the waiter with the highest priority first
+//(or the one which has waited the longest, among those with the same priority).
+//No credits are handed out until the first gathering waiters are all waiting, so that they get them in order too.
+type prioritySemaphore struct {
+	mutex     sync.Mutex
+	available int
+	gathering int
+	waiters   []*semaphoreWaiter
+}
+
+type semaphoreWaiter struct {
+	priority time.Duration
+	ready    chan interface{} //closed once the waiter has a credit
+}
+
+func newPrioritySemaphore(credits, gathering int) *prioritySemaphore {
+	return &prioritySemaphore{available: credits, gathering: gathering}
+}
+
+//acquire waits for a credit, and returns whether it got one before ctx was cancelled
+func (semaphore *prioritySemaphore) acquire(ctx context.Context, priority time.Duration) bool {
+	semaphore.mutex.Lock()
+	if semaphore.available > 0 && semaphore.gathering <= 0 {
+		semaphore.available--
+		semaphore.mutex.Unlock()
+		return true
+	}
+	waiter := &semaphoreWaiter{priority: priority, ready: make(chan interface{})}
+	semaphore.waiters = append(semaphore.waiters, waiter)
+	semaphore.gathering--
+	if semaphore.gathering == 0 {
+		for semaphore.available > 0 && len(semaphore.waiters) > 0 {
+			semaphore.available--
+			semaphore.releaseLocked()
+		}
+	}
+	semaphore.mutex.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return true
+	case <-ctx.Done():
+	}
+
+	semaphore.mutex.Lock()
+	defer semaphore.mutex.Unlock()
+	for i, other := range semaphore.waiters {
+		if other == waiter {
+			semaphore.waiters = append(semaphore.waiters[:i], semaphore.waiters[i+1:]...)
+			return false
+		}
+	}
+	//the credit was handed out at the same time as ctx was cancelled, so give it to someone else
+	semaphore.releaseLocked()
+	return false
+}
+
+//release returns a credit, which goes to the waiter with the highest priority if there is one
+func (semaphore *prioritySemaphore) release() {
+	semaphore.mutex.Lock()
+	defer semaphore.mutex.Unlock()
+	semaphore.releaseLocked()
+}
+
+func (semaphore *prioritySemaphore) releaseLocked() {
+	if len(semaphore.waiters) == 0 {
+		semaphore.available++
+		return
+	}
+	next := 0
+	for i, waiter := range semaphore.waiters {
+		if waiter.priority > semaphore.waiters[next].priority {
+			next = i
+		}
+	}
+	close(semaphore.waiters[next].ready)
+	semaphore.waiters = append(semaphore.waiters[:next], semaphore.waiters[next+1:]...)
+}
+
+func (scheduler *Scheduler) cancelJob(result *JobResult) {
+	result.Status = JobCancelled
+	result.Err = context.Canceled
+	scheduler.Interface.CancelJob(result.Service)
+}
+
+//SummarizeResults describes which services failed, were cancelled or were skipped, one line for each of those statuses.
+//It returns nothing if every job succeeded.
+func SummarizeResults(results []JobResult) []string {
+	servicesByStatus := make(map[JobStatus][]string)
+	for _, result := range results {
+		servicesByStatus[result.Status] = append(servicesByStatus[result.Status], result.Service)
+	}
+	var summary []string
+	if failed := servicesByStatus[JobFailed]; len(failed) > 0 {
+		summary = append(summary, fmt.Sprintf("Failed to build: %s (see the logs folder for details)", strings.Join(failed, ", ")))
+	}
+	if cancelled := servicesByStatus[JobCancelled]; len(cancelled) > 0 {
+		summary = append(summary, fmt.Sprintf("Cancelled: %s", strings.Join(cancelled, ", ")))
+	}
+	if skipped := servicesByStatus[JobSkipped]; len(skipped) > 0 {
+		summary = append(summary, fmt.Sprintf("Skipped, because a service they depend on did not build: %s", strings.Join(skipped, ", ")))
+	}
+	return summary
+}
@@ -0,0 +1,110 @@
+package build
+
+import (
+	"context"
+	"github.com/webappio/sanic/pkg/util"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+//schedulerTestServices are services where app is built from base, and lib and tool are built from nothing
+func schedulerTestServices(t *testing.T) ([]util.BuildableService, *Graph) {
+	services := writeServices(t, map[string]string{
+		"base": "FROM alpine\n",
+		"app":  "FROM base\n",
+		"lib":  "FROM alpine\n",
+		"tool": "FROM alpine\n",
+	})
+	graph, err := NewGraph(services, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return services, graph
+}
+
+func TestCriticalPaths(t *testing.T) {
+	services, graph := schedulerTestServices(t)
+	tests := []struct {
+		name      string
+		selected  []string
+		estimates map[string]time.Duration
+		paths     map[string]time.Duration
+	}{
+		{
+			name:      "a parent's path includes its child",
+			selected:  []string{"app", "base", "lib", "tool"},
+			estimates: map[string]time.Duration{"base": time.Minute, "app": 5 * time.Minute, "lib": 2 * time.Minute, "tool": 4 * time.Minute},
+			paths:     map[string]time.Duration{"base": 6 * time.Minute, "app": 5 * time.Minute, "lib": 2 * time.Minute, "tool": 4 * time.Minute},
+		},
+		{
+			name:      "services without an estimate take the average",
+			selected:  []string{"app", "base", "lib", "tool"},
+			estimates: map[string]time.Duration{"base": time.Minute, "app": 5 * time.Minute},
+			paths:     map[string]time.Duration{"base": 6 * time.Minute, "app": 5 * time.Minute, "lib": 3 * time.Minute, "tool": 3 * time.Minute},
+		},
+		{
+			name:      "children which are not selected do not count",
+			selected:  []string{"base", "lib"},
+			estimates: map[string]time.Duration{"base": time.Minute, "app": 5 * time.Minute, "lib": 2 * time.Minute},
+			paths:     map[string]time.Duration{"base": time.Minute, "app": 5 * time.Minute, "lib": 2 * time.Minute},
+		},
+		{
+			name:     "no estimates",
+			selected: []string{"app", "base", "lib", "tool"},
+			paths:    map[string]time.Duration{"base": 0, "app": 0, "lib": 0, "tool": 0},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var selected []util.BuildableService
+			for _, service := range services {
+				if util.StringInSlice(service.Name, test.selected) {
+					selected = append(selected, service)
+				}
+			}
+			scheduler := &Scheduler{Graph: graph, Estimates: test.estimates}
+			if paths := scheduler.criticalPaths(selected); !reflect.DeepEqual(paths, test.paths) {
+				t.Errorf("got %v, want %v", paths, test.paths)
+			}
+		})
+	}
+}
+
+//schedulerTestInterface is the part of an Interface which a Scheduler uses
+type schedulerTestInterface struct {
+	Interface
+}
+
+func (schedulerTestInterface) SkipJob(service string, reason string) {}
+
+func (schedulerTestInterface) CancelJob(service string) {}
+
+func TestSchedulerStartsTheLongestPathFirst(t *testing.T) {
+	services, graph := schedulerTestServices(t)
+	scheduler := &Scheduler{
+		Graph:          graph,
+		MaxParallelism: 1,
+		Interface:      schedulerTestInterface{},
+		//base takes the least time on its own, but app can only start once it is done
+		Estimates: map[string]time.Duration{"base": time.Minute, "app": 5 * time.Minute, "lib": 2 * time.Minute, "tool": 4 * time.Minute},
+	}
+	var mutex sync.Mutex
+	var started []string
+	results := scheduler.Run(context.Background(), services, func(ctx context.Context, service util.BuildableService) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		started = append(started, service.Name)
+		return nil
+	})
+	for _, result := range results {
+		if result.Status != JobSucceeded {
+			t.Errorf("%s: %s", result.Service, result.Status)
+		}
+	}
+	//whether app or lib goes third depends on whether app is waiting for a credit by the time tool is done
+	if len(started) != 4 || !reflect.DeepEqual(started[:2], []string{"base", "tool"}) {
+		t.Errorf("the jobs started in the order %v, want base (6m with app) and then tool (4m) first", started)
+	}
+}
@@ -0,0 +1,358 @@
+package build
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/webappio/sanic/pkg/config"
+	"github.com/webappio/sanic/pkg/util"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//TestOutputDir is the directory in which tests (a TestTarget stage, or a TestCommand in its container) write the files
+//to collect, e.g., JUnit XML reports
+const TestOutputDir = "/test-output"
+
+//TestExitCodeFile is where (in TestOutputDir) a TestTarget stage can write the exit code of its tests instead of
+//failing, e.g., RUN npm test; echo $? > /test-output/exit-code, so that its results can be copied out even if they fail
+const TestExitCodeFile = "exit-code"
+
+//testTagSuffix is added to the tags of the images of TestTarget stages, so that they are not mistaken for the service's image
+const testTagSuffix = "-test"
+
+//TestError is the error of tests which ran, but exited with a non-zero code: a TestCommand, or the tests of a
+//TestTarget stage which wrote their exit code to TestExitCodeFile
+type TestError struct {
+	ExitCode int
+}
+
+func (err *TestError) Error() string {
+	return fmt.Sprintf("the tests exited with code %d", err.ExitCode)
+}
+
+//HasTests returns whether sanic test has anything to run for a service, i.e., it has a TestTarget or a TestCommand
+func (builder *Builder) HasTests(service util.BuildableService) bool {
+	serviceConfig := builder.serviceConfig(service)
+	return serviceConfig.TestTarget != "" || serviceConfig.TestCommand != ""
+}
+
+//TestService runs the tests of a service as a single job of the Interface, and copies the files they write to
+//TestOutputDir into outputDir. If it has a TestTarget, that stage is built (without pushing it) and the tests pass if
+//it builds, unless it wrote a non-zero exit code to TestExitCodeFile (then a TestError is returned). If the stage fails
+//to build, nothing is copied. Otherwise, the service is built (or is up to date, see SkipUpToDate) and its TestCommand runs in its image,
+//and the tests pass if it exits with 0 (otherwise a TestError is returned). Anything already in outputDir is removed first.
+func (builder *Builder) TestService(ctx context.Context, service util.BuildableService, outputDir string) error {
+	serviceConfig := builder.serviceConfig(service)
+	err := os.RemoveAll(outputDir)
+	if err == nil {
+		err = os.MkdirAll(outputDir, 0755)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not create the test output directory %s", outputDir)
+	}
+	switch {
+	case serviceConfig.TestTarget != "":
+		if builder.backend().ImageStore() == "" {
+			return fmt.Errorf("the %s backend cannot build the testTarget of %s, as it can only push images", builder.Backend, service.Name)
+		}
+		return builder.testBuilder(service).buildService(ctx, service, false, func(ctx context.Context, image string) error {
+			if err := builder.copyTestOutput(ctx, service, image, outputDir); err != nil {
+				return err
+			}
+			return readTestExitCode(outputDir)
+		})
+	case serviceConfig.TestCommand != "":
+		return builder.buildService(ctx, service, builder.SkipUpToDate, func(ctx context.Context, image string) error {
+			return builder.runTestCommand(ctx, service, image, outputDir)
+		})
+	default:
+		return fmt.Errorf("%s has neither a testTarget nor a testCommand", service.Name)
+	}
+}
+
+//testBuilder returns a Builder which builds the TestTarget of a service instead of its Target, for the local platform,
+//and tags it with testTagSuffix. It does not push the image, nor add the service's extra tags, check its size or run
+//its postBuild hook.
+func (builder *Builder) testBuilder(service util.BuildableService) *Builder {
+	serviceConfig := builder.serviceConfig(service)
+	serviceConfig.Target = serviceConfig.TestTarget
+	serviceConfig.Platforms = nil
+	serviceConfig.Tags = nil
+	serviceConfig.MaxImageSize = ""
+	serviceConfig.MaxImageGrowth = nil
+	serviceConfig.Hooks.PostBuild = ""
+
+	//the copy shares the state of the builder (e.g., its buildkit session, which the builder closes)
+	builder.shared()
+	tb := *builder
+	tb.BuildTag = builder.BuildTag + testTagSuffix
+	tb.DoPush = false
+	tb.History = nil
+	tb.ServiceConfigs = map[string]config.ServiceBuild{service.Name: serviceConfig}
+	tb.ServiceTags = make(map[string]string)
+	if tag, ok := builder.ServiceTags[service.Name]; ok {
+		tb.ServiceTags[service.Name] = tag + testTagSuffix
+	}
+	if builder.Graph != nil {
+		//the services it is built from keep their tags, so that their images are passed to the build
+		for _, parent := range builder.Graph.Parents(service.Name) {
+			tb.ServiceTags[parent] = builder.ServiceTag(util.BuildableService{Name: parent})
+		}
+	}
+	return &tb
+}
+
+//copyTestOutput copies TestOutputDir out of a built TestTarget image into outputDir.
+//If the image has no TestOutputDir, nothing is copied.
+func (builder *Builder) copyTestOutput(ctx context.Context, service util.BuildableService, image, outputDir string) error {
+	imageStore := builder.backend().ImageStore()
+	//the container is never started, so its command does not need to exist in the image
+	out, err := exec.CommandContext(ctx, imageStore, "create", image, "true").Output()
+	if err != nil {
+		return errors.Wrapf(err, "could not create a container from %s", image)
+	}
+	container := strings.TrimSpace(string(out))
+	defer exec.Command(imageStore, "rm", container).Run()
+
+	out, err = exec.CommandContext(ctx, imageStore, "cp", container+":"+TestOutputDir+"/.", outputDir).CombinedOutput()
+	if err != nil {
+		builder.Logger.Log(service.Name, time.Now(), "No test output copied from ", TestOutputDir, ": ", strings.TrimSpace(string(out)))
+	}
+	return ctx.Err()
+}
+
+//readTestExitCode returns a TestError if the tests of a TestTarget stage wrote a non-zero exit code to TestExitCodeFile
+//in their output, which was copied to outputDir
+func readTestExitCode(outputDir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(outputDir, TestExitCodeFile))
+	if os.IsNotExist(err) {
+		return nil //the stage did not build if its tests failed
+	}
+	if err != nil {
+		return err
+	}
+	exitCode, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("%s/%s should contain the exit code of the tests, was: '%s'",
+			TestOutputDir, TestExitCodeFile, strings.TrimSpace(string(data)))
+	}
+	if exitCode != 0 {
+		return &TestError{ExitCode: exitCode}
+	}
+	return nil
+}
+
+//runTestCommand runs the TestCommand of a service with sh in a container of its image, with outputDir mounted at
+//TestOutputDir, and logs its output
+func (builder *Builder) runTestCommand(ctx context.Context, service util.BuildableService, image, outputDir string) error {
+	imageStore := builder.backend().ImageStore()
+	if imageStore == "" {
+		//the image was pushed, so docker pulls it to run it
+		imageStore = "docker"
+	}
+	absOutputDir, err := filepath.Abs(outputDir)
+	if err != nil {
+		return err
+	}
+	args := []string{"run", "--rm",
+		"--volume", absOutputDir + ":" + TestOutputDir,
+		"--env", "TEST_OUTPUT=" + TestOutputDir,
+		"--env", "SANIC_SERVICE=" + service.Name,
+		"--entrypoint", "sh"}
+	args = append(args, testUserArgs(imageStore)...)
+	args = append(args, image, "-c", builder.serviceConfig(service).TestCommand)
+	builder.Logger.Log(service.Name, time.Now(), "Running the test command...")
+	cmd := builder.command(imageStore, args...)
+	err = builder.runCommandAndOutput(cmd, ctx, service.Name)
+	if exitErr, ok := errors.Cause(err).(*exec.ExitError); ok && ctx.Err() == nil {
+		return &TestError{ExitCode: exitErr.ExitCode()}
+	}
+	return err
+}
+
+//testUserArgs returns the arguments which run a test command as the user running sanic, so that the files it writes
+//to its output directory are owned by them (and can be removed by the next sanic test), rather than by root
+func testUserArgs(imageStore string) []string {
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid < 0 {
+		return nil //e.g., on windows
+	}
+	if imageStore == "podman" {
+		//rootless podman maps the user to root in the container, and other users to subordinate ids on the host
+		return []string{"--userns=keep-id"}
+	}
+	return []string{"--user", fmt.Sprintf("%d:%d", uid, gid)}
+}
+
+//junitRawSuite is a testsuite element of a JUnit XML file written by tests, which is copied as is into merged reports
+type junitRawSuite struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+//junitSuiteCounts counts the test cases of a testsuite element
+type junitSuiteCounts struct {
+	TestCases []struct {
+		Failure *struct{} `xml:"failure"`
+		Error   *struct{} `xml:"error"`
+		Skipped *struct{} `xml:"skipped"`
+	} `xml:"testcase"`
+}
+
+//TestResults are the JUnit XML reports that the tests of a service wrote to their output directory
+type TestResults struct {
+	Service string
+	//Files are the JUnit XML files that were found
+	Files []string
+	//Tests, Failures (including errors) and Skipped count the test cases in Files
+	Tests    int
+	Failures int
+	Skipped  int
+
+	suites []junitRawSuite
+}
+
+//ReadTestResults finds every JUnit XML file (with a testsuite or testsuites root element) in the output directory of the
+//tests of a service, recursively. Other files are ignored.
+func ReadTestResults(service, outputDir string) (*TestResults, error) {
+	results := &TestResults{Service: service}
+	err := filepath.Walk(outputDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == outputDir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.EqualFold(filepath.Ext(path), ".xml") {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		suites := parseJUnit(data)
+		if suites == nil {
+			return nil
+		}
+		results.Files = append(results.Files, path)
+		for _, suite := range suites {
+			counts := junitSuiteCounts{}
+			xml.Unmarshal([]byte("<testsuite>"+suite.Inner+"</testsuite>"), &counts)
+			for _, testCase := range counts.TestCases {
+				results.Tests++
+				if testCase.Failure != nil || testCase.Error != nil {
+					results.Failures++
+				} else if testCase.Skipped != nil {
+					results.Skipped++
+				}
+			}
+			results.suites = append(results.suites, suite)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read the test results of %s", service)
+	}
+	return results, nil
+}
+
+//parseJUnit returns the test suites of a JUnit XML file, or nil if it is not one
+func parseJUnit(data []byte) []junitRawSuite {
+	root := struct {
+		XMLName xml.Name
+	}{}
+	if xml.Unmarshal(data, &root) != nil {
+		return nil
+	}
+	switch root.XMLName.Local {
+	case "testsuite":
+		suite := junitRawSuite{}
+		if xml.Unmarshal(data, &suite) != nil {
+			return nil
+		}
+		return []junitRawSuite{suite}
+	case "testsuites":
+		suites := struct {
+			Suites []junitRawSuite `xml:"testsuite"`
+		}{}
+		if xml.Unmarshal(data, &suites) != nil {
+			return nil
+		}
+		if suites.Suites == nil {
+			return []junitRawSuite{}
+		}
+		return suites.Suites
+	default:
+		return nil
+	}
+}
+
+//WriteTestJUnit writes the report of sanic test as JUnit XML: a testsuites element with a "sanic test" test suite,
+//which has a test case for the job of each service, followed by every test suite in the given results.
+//Those are prefixed with the name of their service.
+func (report *Report) WriteTestJUnit(w io.Writer, results []*TestResults) error {
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Service < results[j].Service
+	})
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	testSuites := xml.StartElement{Name: xml.Name{Local: "testsuites"}}
+	if err := encoder.EncodeToken(testSuites); err != nil {
+		return err
+	}
+	if err := encoder.Encode(report.junitSuite("sanic test", "sanic.test")); err != nil {
+		return err
+	}
+	for _, result := range results {
+		for _, suite := range result.suites {
+			suite.XMLName = xml.Name{Local: "testsuite"}
+			suite.Attrs = prefixJUnitSuiteName(suite.Attrs, result.Service)
+			if err := encoder.Encode(suite); err != nil {
+				return err
+			}
+		}
+	}
+	if err := encoder.EncodeToken(testSuites.End()); err != nil {
+		return err
+	}
+	if err := encoder.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+//prefixJUnitSuiteName returns the attributes of a test suite with its name prefixed by the name of a service.
+//Namespaced attributes (and namespace declarations) are dropped, since encoding/xml cannot write them back as they were.
+func prefixJUnitSuiteName(attrs []xml.Attr, service string) []xml.Attr {
+	var prefixed []xml.Attr
+	named := false
+	for _, attr := range attrs {
+		if attr.Name.Space != "" || attr.Name.Local == "xmlns" {
+			continue
+		}
+		if attr.Name.Local == "name" {
+			attr.Value = service + ": " + attr.Value
+			named = true
+		}
+		prefixed = append(prefixed, attr)
+	}
+	if !named {
+		prefixed = append([]xml.Attr{{Name: xml.Name{Local: "name"}, Value: service}}, prefixed...)
+	}
+	return prefixed
+}
@@ -0,0 +1,103 @@
+package build
+
+import (
+	"context"
+	"github.com/webappio/sanic/pkg/bridge/registry"
+	"github.com/webappio/sanic/pkg/util"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+//registry returns a client for the Registry, shared by every service in the build
+func (builder *Builder) registry() *registry.Client {
+	state := builder.shared()
+	state.registryClientOnce.Do(func() {
+		state.registryClient = registry.NewClient(builder.Registry, builder.RegistryInsecure, builder.RegistryCredentials)
+	})
+	return state.registryClient
+}
+
+//localImageExists returns whether an image is in the image store of a Backend (see Backend.ImageStore)
+func localImageExists(imageStore, image string) bool {
+	if imageStore == "" {
+		return false
+	}
+	return exec.Command(imageStore, "image", "inspect", image).Run() == nil
+}
+
+//isUpToDate checks whether the first of imageNames already exists, so that the service does not need to be built.
+//If it does, it makes sure the rest of imageNames point at it too (pushing them if DoPush is set).
+func (builder *Builder) isUpToDate(ctx context.Context, service util.BuildableService, imageNames []string) bool {
+	imageStore := builder.backend().ImageStore()
+	existsLocally := localImageExists(imageStore, imageNames[0])
+
+	if builder.DoPush && builder.Registry != "" {
+		tag := imageNames[0][strings.LastIndex(imageNames[0], ":")+1:]
+		digest, err := builder.registry().ManifestDigest(ctx, builder.ImageName(service), tag)
+		if err != nil {
+			builder.Logger.Log(service.Name, time.Now(), "could not check the registry for an existing image, building it: ", err.Error())
+			return false
+		}
+		existsInRegistry := digest != ""
+		if existsInRegistry && !existsLocally {
+			//it is only in the registry, so it is tagged there without pulling it
+			for _, imageName := range imageNames[1:] {
+				newTag := imageName[strings.LastIndex(imageName, ":")+1:]
+				if err := builder.registry().Tag(ctx, builder.ImageName(service), digest, newTag); err != nil {
+					builder.Logger.Log(service.Name, time.Now(), "could not tag the existing image in the registry, building it: ", err.Error())
+					return false
+				}
+			}
+			builder.Interface.SetDigest(service.Name, digest)
+			return true
+		}
+		if !existsLocally {
+			return false
+		}
+		//it is built locally, so it only needs to be pushed
+		builder.Interface.SetPushing(service.Name)
+		if err := builder.tagAndPush(ctx, service, imageStore, imageNames, !existsInRegistry); err != nil {
+			builder.Logger.Log(service.Name, time.Now(), "could not push the existing image, building it: ", err.Error())
+			return false
+		}
+		return true
+	}
+
+	if !existsLocally {
+		return false
+	}
+	if err := builder.tagAndPush(ctx, service, imageStore, imageNames, false); err != nil {
+		builder.Logger.Log(service.Name, time.Now(), "could not tag the existing image, building it: ", err.Error())
+		return false
+	}
+	return true
+}
+
+//tagAndPush tags imageNames[0] in an image store (see Backend.ImageStore) with the rest of imageNames,
+//then pushes them if DoPush is set. imageNames[0] itself is only pushed if pushFirst is true.
+func (builder *Builder) tagAndPush(ctx context.Context, service util.BuildableService, imageStore string, imageNames []string, pushFirst bool) error {
+	for _, imageName := range imageNames[1:] {
+		cmd := builder.command(imageStore, "tag", imageNames[0], imageName)
+		if err := builder.runCommandAndOutput(cmd, ctx, service.Name); err != nil {
+			return err
+		}
+	}
+	if !builder.DoPush {
+		return nil
+	}
+	toPush := imageNames[1:]
+	if pushFirst {
+		toPush = imageNames
+	}
+	for _, imageName := range toPush {
+		cmd := builder.command(imageStore, "push", imageName)
+		if err := builder.runCommandAndOutput(cmd, ctx, service.Name); err != nil {
+			return err
+		}
+	}
+	if digest := pushedDigest(imageStore, imageNames[0]); digest != "" {
+		builder.Interface.SetDigest(service.Name, digest)
+	}
+	return nil
+}
@@ -11,14 +11,13 @@ import (
 	"github.com/urfave/cli"
 	"os"
 	"path/filepath"
-	"runtime"
 	"sync"
 	"time"
 )
 
-func createBuildInterface(forceNoninteractive bool) build.Interface {
+func createBuildInterface(forceNoninteractive bool, logger build.Logger) build.Interface {
 	if !forceNoninteractive {
-		interactiveInterface, err := build.NewInteractiveInterface()
+		interactiveInterface, err := build.NewInteractiveInterface(logger.LogPath)
 		if err == nil {
 			return interactiveInterface
 		}
@@ -27,11 +26,62 @@ func createBuildInterface(forceNoninteractive bool) build.Interface {
 	return build.NewPlaintextInterface()
 }
 
+//writeBuildReport writes a build report in the given format (json or junit) to reportFile,
+//or to logs/build-report.(json|xml) in buildRoot if reportFile is empty
+func writeBuildReport(report *build.Report, format, reportFile, buildRoot string) error {
+	if reportFile == "" {
+		extension := "json"
+		if format == "junit" {
+			extension = "xml"
+		}
+		reportFile = filepath.Join(buildRoot, "logs", "build-report."+extension)
+	}
+	if err := os.MkdirAll(filepath.Dir(reportFile), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(reportFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if format == "junit" {
+		return report.WriteJUnit(f)
+	}
+	return report.WriteJSON(f)
+}
+
+//unchangedServicesSince returns which of the given services have not changed since the git ref (see
+//git.ChangedFilesSince), nor have any of the services they are built from. It returns nil if ref is empty.
+func unchangedServicesSince(plan *buildPlan, services []util.BuildableService, ref string) (map[string]bool, error) {
+	if ref == "" {
+		return nil, nil
+	}
+	if plan.serviceTags == nil {
+		return nil, fmt.Errorf("--changed-since finds the existing images of unchanged services by their content hashes, " +
+			"so it cannot be used with --tag, or outside of a git repository")
+	}
+	changedFiles, err := git.ChangedFilesSince(plan.root, ref)
+	if err != nil {
+		return nil, err
+	}
+	changedServices := plan.affectedServices(services, changedFiles)
+	unchangedServices := make(map[string]bool)
+	for _, service := range services {
+		unchangedServices[service.Name] = true
+	}
+	for _, service := range changedServices {
+		delete(unchangedServices, service.Name)
+	}
+	fmt.Fprintf(os.Stderr, "%d of %d services changed since %s, the rest will only be retagged\n", len(changedServices), len(services), ref)
+	return unchangedServices, nil
+}
+
 //adapted from
 //https://web.archive.org/web/20190516153923/https://raw.githubusercontent.com/moby/buildkit/master/examples/build-using-dockerfile/main.go
 func buildCommandAction(cliContext *cli.Context) error {
 	registry := ""
 	registryInsecure := false
+	usingEnvironmentRegistry := false
 	if addr := cliContext.String("registry"); addr != "" {
 		registry = addr
 	} else if cliContext.Bool("push") {
@@ -44,6 +94,7 @@ func buildCommandAction(cliContext *cli.Context) error {
 		if err != nil {
 			return cli.NewExitError(fmt.Sprintf("you specified --push, but a registry was not found: %s. Try \"sanic deploy\" first.", err.Error()), 1)
 		}
+		usingEnvironmentRegistry = true
 
 		if registryInsecure {
 			err := provisioner.CheckRegistryInsecureOK()
@@ -53,116 +104,172 @@ func buildCommandAction(cliContext *cli.Context) error {
 		}
 	}
 
-	var buildRoot string
-	s, err := shell.Current()
+	plan, err := loadBuildPlan(cliContext.String("tag"))
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "[WARNING] sanic is building dockerfiles recursively in your current directory. It's recommended to use a sanic environment for consistency.")
-		buildRoot, err = os.Getwd()
-		if err != nil {
-			return cli.NewExitError(fmt.Sprintf("error while getting current directory: %s", err.Error()), 1)
-		}
-	} else {
-		buildRoot = s.GetSanicRoot()
+		return cli.NewExitError(err.Error(), 1)
 	}
+	buildRoot := plan.root
 
-	var ignorePaths []string
-	if cfg, err := config.Read(); err == nil {
-		ignorePaths = cfg.Build.IgnoreDirs
-	}
-	services, err := util.FindServices(buildRoot, ignorePaths)
+	services, err := plan.selectServices(cliContext.Args())
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
 
-	if len(services) == 0 {
-		return cli.NewExitError(fmt.Sprintf("%s (or some of its subdirectories) should contain a Dockerfile"), 1)
+	unchangedServices, err := unchangedServicesSince(plan, services, cliContext.String("changed-since"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
 	}
 
-
-	buildTag := cliContext.String("tag")
-	if buildTag == "" {
-		var serviceDirs []string
-		for _, service := range services {
-			serviceDirs = append(serviceDirs, service.Dir)
-		}
-		buildTag, err = git.GetCurrentTreeHash(buildRoot, serviceDirs...)
+	builder := plan.builder(registry, registryInsecure)
+	defer builder.Close()
+	builder.Provenance, err = plan.provenance(cliContext.App.Version)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("could not find the git commit of the services: %s", err.Error()), 1)
+	}
+	if s, err := shell.Current(); err == nil {
+		builder.Shell = s
+	}
+	if builder.Backend == build.BackendKaniko && plan.env != nil {
+		provisioner, err := environmentProvisioner(plan.envName, plan.env)
 		if err != nil {
 			return cli.NewExitError(err.Error(), 1)
 		}
+		builder.KubectlCommand = provisioner.KubectlCommand
+	}
+	if usingEnvironmentRegistry {
+		//the environment's credentials are only for its own registry, not one given with --registry
+		builder.RegistryCredentials, err = registryCredentials(plan.env, registry)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("could not get the credentials for the registry %s: %s", registry, err.Error()), 1)
+		}
+		var removeDockerConfig func()
+		builder.DockerConfig, removeDockerConfig, err = temporaryDockerConfig(registry, builder.RegistryCredentials)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("could not write the credentials for the registry %s: %s", registry, err.Error()), 1)
+		}
+		defer removeDockerConfig()
+	}
+	for _, warning := range serviceWarnings(plan.root, plan.services, builder) {
+		fmt.Fprintf(os.Stderr, "[WARNING] %s\n", warning)
+	}
+
+	if cliContext.Bool("fail-fast") && cliContext.Bool("keep-going") {
+		return cli.NewExitError("only one of --fail-fast and --keep-going can be specified", 1)
+	}
+
+	reportFormat := cliContext.String("report")
+	if reportFormat != "" && reportFormat != "json" && reportFormat != "junit" {
+		return cli.NewExitError(fmt.Sprintf("--report must be json or junit, was: '%s'", reportFormat), 1)
+	}
+
+	history, err := build.LoadBuildHistory(buildHistoryPath(buildRoot))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[WARNING] could not read the durations of previous builds, starting over: %s\n", err.Error())
+	}
+
+	//without a sanic.yaml, the defaults of the build block are not filled in
+	logFormat, logHistory := plan.cfg.Build.LogFormat, plan.cfg.Build.LogHistory
+	if logFormat == "" {
+		logFormat = build.LogFormatText
+	}
+	if logHistory == 0 {
+		logHistory = config.DefaultLogHistory
 	}
+	if cliContext.String("log-format") != "" {
+		logFormat = cliContext.String("log-format")
+	}
+	if logFormat != build.LogFormatText && logFormat != build.LogFormatJSON {
+		return cli.NewExitError(fmt.Sprintf("--log-format must be text or json, was: '%s'", logFormat), 1)
+	}
+	runTree := "untracked"
+	if builder.Provenance.TreeHash != "" {
+		runTree = builder.Provenance.TreeHash
+	}
+	buildLogger := build.NewFlatfileLogger(filepath.Join(buildRoot, "logs"), build.NewBuildRunID(runTree),
+		logFormat, logHistory, cliContext.Bool("verbose"))
+	defer buildLogger.Close()
 
-	buildInterface := createBuildInterface(cliContext.Bool("plaintext"))
+	reportInterface := build.NewReportInterface(createBuildInterface(cliContext.Bool("plaintext"), buildLogger))
+	var buildInterface build.Interface = build.NewHistoryInterface(reportInterface, history)
+	var closeInterface sync.Once
 	defer func() {
 		r := recover()
-		buildInterface.Close()
+		closeInterface.Do(buildInterface.Close)
 		if r != nil {
 			panic(r)
 		}
 	}()
 
-	buildLogger := build.NewFlatfileLogger(filepath.Join(buildRoot, "logs"), cliContext.Bool("verbose"))
 	buildLogger.AddLogLineListener(buildInterface.ProcessLog)
-	defer buildLogger.Close()
 
-	namespace, err = getNamespaceFromEnv()
-	if err != nil {
-		return cli.NewExitError(err.Error(), 1)
-	}
+	builder.Logger = buildLogger
+	builder.Interface = buildInterface
+	builder.History = history
+	builder.DoPush = cliContext.Bool("push")
+	builder.NoCache = cliContext.Bool("no-cache")
+	builder.SkipUpToDate = plan.serviceTags != nil && !cliContext.Bool("force")
 
-	builder := build.Builder{
-		Registry:         registry,
-		RegistryInsecure: registryInsecure,
-		BuildTag:         buildTag,
-		NameSpace:        namespace,
-		Logger:           buildLogger,
-		Interface:        buildInterface,
-		DoPush:           cliContext.Bool("push"),
+	scheduler := build.Scheduler{
+		Graph:          plan.graph,
+		MaxParallelism: cliContext.Int("max-parallelism"),
+		Interface:      buildInterface,
+		FailFast:       cliContext.Bool("fail-fast"),
 	}
-
-	maxParallelism := cliContext.Int("max-parallelism")
-	parallelismCredits := make(chan interface{}, 128)
-	if maxParallelism <= 0 {
-		maxParallelism = runtime.NumCPU()
-	}
-
-	for i := 0; i < maxParallelism; i += 1 {
-		parallelismCredits <- true
+	var serviceNames []string
+	for _, service := range services {
+		serviceNames = append(serviceNames, service.Name)
 	}
+	scheduler.Estimates = history.Estimates(serviceNames)
+	buildInterface.SetEstimates(scheduler.Estimates, scheduler.Parallelism())
 
-	buildFailed := false
+	ctx, cancelBuild := context.WithCancel(context.Background())
+	defer cancelBuild()
+	buildInterface.AddCancelListener(cancelBuild)
+	buildInterface.AddJobCancelListener(scheduler.CancelJob)
 
-	var wg sync.WaitGroup
-	for _, service := range services {
-		finalService := service
-		wg.Add(1)
-		go func() {
-			<-parallelismCredits
-			ctx, cancelJob := context.WithCancel(context.Background())
-			buildInterface.AddCancelListener(cancelJob)
-			err := builder.BuildService(
-				ctx,
-				finalService,
-			)
-			if err != nil {
-				buildFailed = true
-				buildLogger.Log(finalService.Name, time.Now(), "Error: ", err.Error())
-			}
-			parallelismCredits <- true
-			wg.Done()
-		}()
+	buildJob := func(ctx context.Context, service util.BuildableService) error {
+		var err error
+		if unchangedServices[service.Name] {
+			err = builder.RetagService(ctx, service)
+		} else {
+			err = builder.BuildService(ctx, service)
+		}
+		if err != nil {
+			buildLogger.Log(service.Name, time.Now(), "Error: ", err.Error())
+		}
+		return err
+	}
+	results := scheduler.Run(ctx, services, buildJob)
+	var watchErr error
+	if cliContext.Bool("watch") {
+		results, watchErr = watchAndRebuild(ctx, plan, builder, &scheduler, cliContext.Args(), unchangedServices, results, buildJob)
 	}
+	userCancelled := ctx.Err() != nil
+	closeInterface.Do(buildInterface.InspectAndClose)
 
-	userCancelledBuild := false
-	buildInterface.AddCancelListener(func() { userCancelledBuild = true })
+	if err := history.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "[WARNING] could not save the durations of the builds: %s\n", err.Error())
+	}
 
-	wg.Wait()
+	if reportFormat != "" {
+		err = writeBuildReport(reportInterface.Report(buildLogger), reportFormat, cliContext.String("report-file"), buildRoot)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("could not write the build report: %s", err.Error()), 1)
+		}
+	}
 
-	if userCancelledBuild {
+	if userCancelled {
 		fmt.Println() //clear the ^C
-		return cli.NewExitError("", 1)
+	}
+	if watchErr != nil {
+		return cli.NewExitError(fmt.Sprintf("could not watch for changes: %s", watchErr.Error()), 1)
 	}
 
-	if buildFailed {
+	summary := build.SummarizeResults(results)
+	for _, line := range summary {
+		fmt.Fprintln(os.Stderr, line)
+	}
+	if len(summary) > 0 {
 		return cli.NewExitError("", 1)
 	}
 
@@ -170,9 +277,10 @@ func buildCommandAction(cliContext *cli.Context) error {
 }
 
 var buildCommand = cli.Command{
-	Name:   "build",
-	Usage:  "build some (or all, by default) services",
-	Action: buildCommandAction,
+	Name:      "build",
+	Usage:     "build some (or all, by default) services",
+	ArgsUsage: "[service name, glob (svc-*) or path (services/backend/...)...]",
+	Action:    buildCommandAction,
 	Flags: []cli.Flag{
 		cli.BoolFlag{
 			Name:   "plaintext",
@@ -185,7 +293,15 @@ var buildCommand = cli.Command{
 		},
 		cli.StringFlag{
 			Name:  "tag,t",
-			Usage: "sets the tag of all built images to the specified one",
+			Usage: "sets the tag of all built images to the specified one (instead of their content hashes), and builds them even if they are up to date",
+		},
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "builds services even if an image with their content hash already exists",
+		},
+		cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "builds every step again, without using the local build cache or the environment's cacheFrom",
 		},
 		cli.StringFlag{
 			Name:  "registry",
@@ -199,5 +315,33 @@ var buildCommand = cli.Command{
 			Name: "max-parallelism,j",
 			Usage: "sets the maximum parallel builds that will occur",
 		},
+		cli.StringFlag{
+			Name:  "changed-since",
+			Usage: "only builds the services which changed since the given git ref (e.g., origin/main), and tags the existing images of the others",
+		},
+		cli.BoolFlag{
+			Name:  "watch,w",
+			Usage: "after building, keeps rebuilding the services affected by every change to their files, until interrupted",
+		},
+		cli.BoolFlag{
+			Name:  "fail-fast",
+			Usage: "cancels every other build as soon as one service fails to build",
+		},
+		cli.BoolFlag{
+			Name:  "keep-going",
+			Usage: "keeps building every other service when one fails to build (the default)",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Usage: "the format of the logs in logs/builds, text or json (default: the build.logFormat in sanic.yaml, or text)",
+		},
+		cli.StringFlag{
+			Name:  "report",
+			Usage: "writes a report of the build, in json or junit format",
+		},
+		cli.StringFlag{
+			Name:  "report-file",
+			Usage: "where to write the --report (default: logs/build-report.json or logs/build-report.xml)",
+		},
 	},
 }
@@ -0,0 +1,271 @@
+package commands
+
+import (
+	"fmt"
+	"github.com/webappio/sanic/pkg/bridge/git"
+	"github.com/webappio/sanic/pkg/build"
+	"github.com/webappio/sanic/pkg/config"
+	"github.com/webappio/sanic/pkg/shell"
+	"github.com/webappio/sanic/pkg/util"
+	"os"
+	"strings"
+)
+
+//buildPlan is what sanic knows about every service in the project before building them.
+//The tags are computed from every service (not just the selected ones), so that they match between commands.
+type buildPlan struct {
+	root           string
+	cfg            config.SanicConfig
+	env            *config.Environment //nil if not in an environment
+	envName        string
+	namespace      string
+	services       []util.BuildableService
+	graph          *build.Graph
+	explicitTag    string //the tag given by the user, if any
+	buildTag       string
+	serviceConfigs map[string]config.ServiceBuild
+	serviceTags    map[string]string //nil if the services could not be hashed, or an explicit tag was given
+}
+
+//loadBuildPlan finds the services of the current project (or the current directory, if not in an environment)
+//if tag is not empty, it is used as the tag for every service instead of their content hashes
+func loadBuildPlan(tag string) (*buildPlan, error) {
+	plan := &buildPlan{explicitTag: tag}
+
+	s, err := shell.Current()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[WARNING] sanic is using the dockerfiles in your current directory (recursively). It's recommended to use a sanic environment for consistency.")
+		plan.root, err = os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("error while getting current directory: %s", err.Error())
+		}
+	} else {
+		plan.root = s.GetSanicRoot()
+	}
+
+	plan.cfg, err = config.Read()
+	if err != nil {
+		plan.cfg = config.SanicConfig{}
+	}
+	if s != nil {
+		plan.env, err = plan.cfg.CurrentEnvironment(s)
+		if err != nil {
+			return nil, err
+		}
+		plan.namespace = plan.env.Namespace
+		plan.envName = s.GetSanicEnvironment()
+	}
+
+	if err = plan.findServices(); err != nil {
+		return nil, err
+	}
+	if err = plan.refreshTags(); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+//findServices finds the services beneath the root, along with their graph and build configurations.
+//It can be called again to find services which were added or removed since, but their tags are not refreshed.
+func (plan *buildPlan) findServices() error {
+	services, err := util.FindServices(plan.root, plan.cfg.Build.IgnoreDirs)
+	if err != nil {
+		return err
+	}
+	if len(services) == 0 {
+		return fmt.Errorf("%s (or some of its subdirectories) should contain a Dockerfile", plan.root)
+	}
+
+	graph, err := build.NewGraph(services, plan.namespace)
+	if err != nil {
+		return err
+	}
+
+	plan.services = services
+	plan.graph = graph
+	plan.serviceConfigs = serviceBuildConfigs(&plan.cfg, plan.env, plan.root, plan.services)
+	return nil
+}
+
+//refreshTags computes the tag of the whole repository and of every service from their current contents,
+//unless an explicit tag was given
+func (plan *buildPlan) refreshTags() error {
+	if plan.explicitTag != "" {
+		plan.buildTag = plan.explicitTag
+		return nil
+	}
+
+	var serviceDirs []string
+	for _, service := range plan.services {
+		serviceDirs = append(serviceDirs, service.Dir)
+	}
+	var err error
+	plan.buildTag, err = git.GetCurrentTreeHash(plan.root, serviceDirs...)
+	if err != nil {
+		return err
+	}
+	plan.serviceTags, err = serviceContentTags(plan.root, plan.envName, plan.services, plan.graph, plan.serviceConfigs)
+	return err
+}
+
+//provenance returns the provenance of the images that are built from the current contents of the services
+//(see build.Provenance), with the given version of sanic
+func (plan *buildPlan) provenance(version string) (*build.Provenance, error) {
+	provenance := &build.Provenance{Environment: plan.envName, Version: version}
+	var err error
+	provenance.Revision, err = git.GetHeadCommit(plan.root)
+	if err == git.ErrNotGitRepository || err == git.ErrNoCommits {
+		return provenance, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var serviceDirs []string
+	for _, service := range plan.services {
+		serviceDirs = append(serviceDirs, service.Dir)
+	}
+	provenance.GitRoot, provenance.TreeHash, err = git.GetTree(plan.root, serviceDirs...)
+	if err != nil {
+		return nil, err
+	}
+	return provenance, nil
+}
+
+//forEnvironment returns a copy of the plan for another environment in sanic.yaml,
+//with that environment's namespace, build configuration and tags
+func (plan *buildPlan) forEnvironment(name string) (*buildPlan, error) {
+	env, ok := plan.cfg.Environments[name]
+	if !ok {
+		return nil, fmt.Errorf("the environment %s does not exist in sanic.yaml", name)
+	}
+	envPlan := *plan
+	envPlan.env = &env
+	envPlan.envName = name
+	envPlan.namespace = env.Namespace
+
+	var err error
+	envPlan.graph, err = build.NewGraph(plan.services, env.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	envPlan.serviceConfigs = serviceBuildConfigs(&plan.cfg, envPlan.env, plan.root, plan.services)
+	if err = envPlan.refreshTags(); err != nil {
+		return nil, err
+	}
+	return &envPlan, nil
+}
+
+//envBuild returns the build configuration of the current environment, which is empty if not in an environment
+func (plan *buildPlan) envBuild() config.EnvironmentBuild {
+	if plan.env == nil {
+		return config.EnvironmentBuild{}
+	}
+	return plan.env.Build
+}
+
+//selectServices returns the services matched by selectors (or every service, if there are none),
+//excluding services which are disabled in sanic.yaml
+func (plan *buildPlan) selectServices(selectors []string) ([]util.BuildableService, error) {
+	services, err := selectServices(plan.root, plan.services, selectors)
+	if err != nil {
+		return nil, err
+	}
+	var enabledServices []util.BuildableService
+	for _, service := range services {
+		if !plan.serviceConfigs[service.Name].IsDisabled() {
+			enabledServices = append(enabledServices, service)
+		}
+	}
+	if len(enabledServices) == 0 {
+		return nil, fmt.Errorf("every selected service is disabled in sanic.yaml")
+	}
+	return enabledServices, nil
+}
+
+//builder returns a Builder for the plan's services, which pushes to the given registry if it is not empty
+func (plan *buildPlan) builder(registry string, registryInsecure bool) *build.Builder {
+	return &build.Builder{
+		Registry:         registry,
+		RegistryInsecure: registryInsecure,
+		BuildTag:         plan.buildTag,
+		NameSpace:        plan.namespace,
+		Backend:          plan.envBuild().Backend,
+		BuildkitAddr:     plan.envBuild().BuildkitAddr,
+		CacheFrom:        plan.envBuild().CacheFrom,
+		CacheTo:          plan.envBuild().CacheTo,
+		ServiceConfigs:   plan.serviceConfigs,
+		ServiceTags:      plan.serviceTags,
+		Graph:            plan.graph,
+	}
+}
+
+//isWithin returns whether path is dir or is beneath it
+func isWithin(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+//affectedServices returns the services (out of selected) whose directory or build context contains one of the
+//changed paths (or is beneath one, e.g., if a whole directory was moved), along with the services built from them.
+func (plan *buildPlan) affectedServices(selected []util.BuildableService, changedPaths []string) []util.BuildableService {
+	affected := make(map[string]bool)
+	var queue []string
+	for _, service := range plan.services {
+		dirs := []string{service.Dir}
+		if context := plan.serviceConfigs[service.Name].Context; context != "" {
+			dirs = append(dirs, context)
+		}
+		for _, path := range changedPaths {
+			for _, dir := range dirs {
+				if !affected[service.Name] && (isWithin(path, dir) || isWithin(dir, path)) {
+					affected[service.Name] = true
+					queue = append(queue, service.Name)
+				}
+			}
+		}
+	}
+	for len(queue) > 0 {
+		for _, child := range plan.graph.Children(queue[0]) {
+			if !affected[child] {
+				affected[child] = true
+				queue = append(queue, child)
+			}
+		}
+		queue = queue[1:]
+	}
+
+	var services []util.BuildableService
+	for _, service := range selected {
+		if affected[service.Name] {
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+//withParents returns the given services along with every service they are built from (recursively),
+//in the order of the plan's services
+func (plan *buildPlan) withParents(selected []util.BuildableService) []util.BuildableService {
+	included := make(map[string]bool)
+	var queue []string
+	for _, service := range selected {
+		included[service.Name] = true
+		queue = append(queue, service.Name)
+	}
+	for len(queue) > 0 {
+		for _, parent := range plan.graph.Parents(queue[0]) {
+			if !included[parent] {
+				included[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+		queue = queue[1:]
+	}
+
+	var services []util.BuildableService
+	for _, service := range plan.services {
+		if included[service.Name] {
+			services = append(services, service)
+		}
+	}
+	return services
+}
@@ -0,0 +1,87 @@
+package commands
+
+import (
+	"context"
+	"github.com/webappio/sanic/pkg/build"
+	"github.com/webappio/sanic/pkg/util"
+	"time"
+)
+
+//watchQuietPeriod is how long sanic build --watch waits for files to stop changing before rebuilding
+const watchQuietPeriod = 300 * time.Millisecond
+
+//watchAndRebuild rebuilds the services selected by selectors which are affected by every change to the files of the
+//project, until ctx is cancelled. The services are found again after every change, so new ones are built as well.
+//Services which are rebuilt are removed from unchangedServices, so that they are not only retagged.
+//results are the results of the first build, and the latest result of each service is returned.
+func watchAndRebuild(ctx context.Context, plan *buildPlan, builder *build.Builder, scheduler *build.Scheduler,
+	selectors []string, unchangedServices map[string]bool, results []build.JobResult,
+	job func(context.Context, util.BuildableService) error) ([]build.JobResult, error) {
+
+	//the build logs are written beneath the root, and should not trigger builds themselves
+	ignorePatterns := append([]string{"/logs/"}, plan.cfg.Build.IgnoreDirs...)
+	watcher, err := util.NewFileWatcher(plan.root, ignorePatterns)
+	if err != nil {
+		return results, err
+	}
+	defer watcher.Close()
+
+	resultIndices := make(map[string]int)
+	for i, result := range results {
+		resultIndices[result.Service] = i
+	}
+
+	for {
+		scheduler.Interface.SetWaiting("watching for changes...")
+		changedPaths, err := watcher.Next(ctx, watchQuietPeriod)
+		if ctx.Err() != nil {
+			return results, nil
+		}
+		if err != nil {
+			return results, err
+		}
+
+		if err := plan.findServices(); err != nil {
+			return results, err
+		}
+		builder.Graph = plan.graph
+		builder.ServiceConfigs = plan.serviceConfigs
+		scheduler.Graph = plan.graph
+		selected, err := plan.selectServices(selectors)
+		if err != nil {
+			return results, err
+		}
+
+		services := plan.affectedServices(selected, changedPaths)
+		if len(services) == 0 {
+			continue
+		}
+		for _, service := range services {
+			delete(unchangedServices, service.Name)
+		}
+		if plan.serviceTags != nil {
+			if err := plan.refreshTags(); err != nil {
+				return results, err
+			}
+			builder.BuildTag = plan.buildTag
+			builder.ServiceTags = plan.serviceTags
+		}
+		if builder.Provenance != nil {
+			provenance, err := plan.provenance(builder.Provenance.Version)
+			if err != nil {
+				return results, err
+			}
+			builder.Provenance = provenance
+		}
+
+		scheduler.Interface.SetWaiting("")
+		for _, result := range scheduler.Run(ctx, services, job) {
+			if i, ok := resultIndices[result.Service]; ok {
+				results[i] = result
+			} else {
+				resultIndices[result.Service] = len(results)
+				results = append(results, result)
+			}
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package commands
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"github.com/webappio/sanic/pkg/bridge/registry"
+	"github.com/webappio/sanic/pkg/config"
+	"github.com/webappio/sanic/pkg/shell"
+	"github.com/webappio/sanic/pkg/util"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//bundleVersion is the version of the bundle.json format, which sanic bundle install checks it understands
+const bundleVersion = 1
+
+//bundleIndex is the bundle.json at the root of a bundle, which describes what is in it
+type bundleIndex struct {
+	Version     int           `json:"version"`
+	Environment string        `json:"environment"`
+	Namespace   string        `json:"namespace,omitempty"`
+	Registry    string        `json:"registry"` //the registry that the images came from, and that the manifests refer to
+	BuildTag    string        `json:"buildTag"`
+	Created     time.Time     `json:"created"`
+	Images      []bundleImage `json:"images"`
+	Manifests   []string      `json:"manifests"` //paths in the bundle of the rendered deploy templates
+}
+
+//bundleImage is a service's image in a bundle, as an OCI image layout at Layout
+type bundleImage struct {
+	Service string   `json:"service"`
+	Image   string   `json:"image"` //the name of the image in the registry, without the registry
+	Tags    []string `json:"tags"`
+	Digest  string   `json:"digest"`
+	Layout  string   `json:"layout"`
+}
+
+//writeTarGz writes every file in dir to a gzipped tar at output
+func writeTarGz(dir, output string) error {
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gzipWriter := gzip.NewWriter(f)
+	tarWriter := tar.NewWriter(gzipWriter)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tarWriter, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+//extractTarGz extracts the directories and regular files of a gzipped tar into dir
+func extractTarGz(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s is not a gzipped tar: %s", archive, err.Error())
+	}
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if !isWithin(path, filepath.Clean(dir)) {
+			return fmt.Errorf("%s has a file outside of it: %s", archive, header.Name)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tarReader)
+			out.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+//listFiles returns the paths (relative to root) of the regular files in dir, sorted
+func listFiles(root, dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			relPath, err := filepath.Rel(root, filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, filepath.ToSlash(relPath))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func bundleCommandAction(cliContext *cli.Context) error {
+	if cliContext.Args().First() == "install" {
+		return bundleInstallCommandAction(cliContext)
+	}
+
+	plan, err := loadBuildPlan("")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	envName := cliContext.String("env")
+	if envName == "" {
+		envName = plan.envName
+	}
+	if envName == "" {
+		return cli.NewExitError("enter an environment with 'sanic env', or pass the environment to bundle with --env", 1)
+	}
+	envPlan, err := plan.forEnvironment(envName)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	services, err := envPlan.selectServices(cliContext.Args())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	registryAddr, registryInsecure, err := environmentRegistry(envPlan, envName)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	credentials, err := registryCredentials(envPlan.env, registryAddr)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("could not get the credentials for the registry %s: %s", registryAddr, err.Error()), 1)
+	}
+	builder := envPlan.builder(registryAddr, registryInsecure)
+	client := registry.NewClient(registryAddr, registryInsecure, credentials)
+
+	output := cliContext.String("output")
+	if output == "" {
+		tag := envPlan.buildTag
+		if len(tag) > 12 {
+			tag = tag[:12]
+		}
+		output = fmt.Sprintf("sanic-bundle-%s-%s.tgz", envName, tag)
+	}
+
+	bundleDir, err := ioutil.TempDir("", "sanicbundle")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer os.RemoveAll(bundleDir)
+
+	index := bundleIndex{
+		Version:     bundleVersion,
+		Environment: envName,
+		Namespace:   envPlan.namespace,
+		Registry:    registryAddr,
+		BuildTag:    envPlan.buildTag,
+		Created:     time.Now().UTC(),
+		Manifests:   []string{},
+	}
+	var failedServices []string
+	var mutex sync.Mutex
+	var funcs []func(context.Context) error
+	for _, service := range services {
+		finalService := service
+		funcs = append(funcs, func(ctx context.Context) error {
+			tag := builder.ServiceTag(finalService)
+			image := bundleImage{
+				Service: finalService.Name,
+				Image:   builder.ImageName(finalService),
+				Tags:    promotedTags(tag, envPlan, envPlan, builder, finalService),
+				Layout:  "images/" + finalService.Name,
+			}
+			layout, err := registry.NewOCILayout(filepath.Join(bundleDir, filepath.FromSlash(image.Layout)))
+			if err == nil {
+				image.Digest, err = registry.ExportImage(ctx, client, image.Image, tag, layout, image.Tags)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[%s] could not export %s:%s: %s\n",
+					finalService.Name, builder.ImageRepository(finalService), tag, err.Error())
+				failedServices = append(failedServices, finalService.Name)
+				return nil
+			}
+			fmt.Printf("[%s] %s:%s (%s)\n", finalService.Name, builder.ImageRepository(finalService), tag, image.Digest)
+			index.Images = append(index.Images, image)
+			return nil
+		})
+	}
+	util.RunContextuallyInParallel(context.Background(), funcs...)
+	if len(failedServices) > 0 {
+		return cli.NewExitError(fmt.Sprintf("could not export: %s. Were they built with sanic build --push in %s?",
+			strings.Join(failedServices, ", "), envName), 1)
+	}
+	sort.Slice(index.Images, func(i, j int) bool { return index.Images[i].Service < index.Images[j].Service })
+
+	folderIn := filepath.Join(plan.root, plan.cfg.Deploy.Folder, "in")
+	if _, err := os.Stat(folderIn); err != nil {
+		fmt.Fprintf(os.Stderr, "[WARNING] there are no deploy templates in %s, the bundle only has images\n", folderIn)
+	} else {
+		manifestsDir := filepath.Join(bundleDir, "manifests")
+		if err := os.MkdirAll(manifestsDir, 0755); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		if err := runTemplater(envPlan, folderIn, manifestsDir, plan.cfg.Deploy.TemplaterImage, nil); err != nil {
+			return cli.NewExitError(fmt.Sprintf("could not compile templates: %s", err.Error()), 1)
+		}
+		if index.Manifests, err = listFiles(bundleDir, manifestsDir); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bundleDir, "bundle.json"), data, 0644); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err := writeTarGz(bundleDir, output); err != nil {
+		return cli.NewExitError(fmt.Sprintf("could not write the bundle to %s: %s", output, err.Error()), 1)
+	}
+	fmt.Printf("[sanic] Bundled %d images and %d manifests for %s into %s\n",
+		len(index.Images), len(index.Manifests), envName, output)
+	return nil
+}
+
+//rewriteManifestRegistry replaces the registry that a bundle's images came from with the one they were installed
+//into, in the bundle's manifests
+func rewriteManifestRegistry(bundleDir string, manifests []string, fromRegistry, toRegistry string) error {
+	for _, manifest := range manifests {
+		path := filepath.Join(bundleDir, filepath.FromSlash(manifest))
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		data = []byte(strings.Replace(string(data), fromRegistry+"/", toRegistry+"/", -1))
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func bundleInstallCommandAction(cliContext *cli.Context) error {
+	if len(cliContext.Args().Tail()) != 1 {
+		return newUsageError(cliContext)
+	}
+	archive := cliContext.Args().Tail()[0]
+
+	cfg, err := config.Read()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	envName := cliContext.String("env")
+	if envName == "" {
+		s, err := shell.Current()
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		envName = s.GetSanicEnvironment()
+	}
+	env, ok := cfg.Environments[envName]
+	if !ok {
+		return cli.NewExitError(fmt.Sprintf("the environment %s does not exist in sanic.yaml", envName), 1)
+	}
+
+	bundleDir, err := ioutil.TempDir("", "sanicbundle")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	defer os.RemoveAll(bundleDir)
+	if err := extractTarGz(archive, bundleDir); err != nil {
+		return cli.NewExitError(fmt.Sprintf("could not read the bundle %s: %s", archive, err.Error()), 1)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(bundleDir, "bundle.json"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s is not a sanic bundle: %s", archive, err.Error()), 1)
+	}
+	index := bundleIndex{}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return cli.NewExitError(fmt.Sprintf("%s is not a valid sanic bundle: %s", archive, err.Error()), 1)
+	}
+	if index.Version != bundleVersion {
+		return cli.NewExitError(fmt.Sprintf("%s is a version %d bundle, this version of sanic can only install version %d",
+			archive, index.Version, bundleVersion), 1)
+	}
+
+	provisioner, err := environmentProvisioner(envName, &env)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err := provisioner.EnsureCluster(); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	registryAddr, registryInsecure, err := provisioner.Registry()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("could not find the registry of the environment %s: %s", envName, err.Error()), 1)
+	}
+	if registryAddr == "" {
+		return cli.NewExitError(fmt.Sprintf("the environment %s does not have a registry", envName), 1)
+	}
+	credentials, err := registryCredentials(&env, registryAddr)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("could not get the credentials for the registry %s: %s", registryAddr, err.Error()), 1)
+	}
+	client := registry.NewClient(registryAddr, registryInsecure, credentials)
+
+	var failedServices []string
+	var mutex sync.Mutex
+	var funcs []func(context.Context) error
+	for _, image := range index.Images {
+		finalImage := image
+		funcs = append(funcs, func(ctx context.Context) error {
+			layout, err := registry.NewOCILayout(filepath.Join(bundleDir, filepath.FromSlash(finalImage.Layout)))
+			digest := ""
+			if err == nil && len(finalImage.Tags) == 0 {
+				err = fmt.Errorf("the bundle does not have any tags for it")
+			}
+			if err == nil {
+				digest, err = registry.ImportImage(ctx, layout, finalImage.Tags[0], client, finalImage.Image, finalImage.Tags)
+			}
+			if err == nil && digest != finalImage.Digest {
+				err = fmt.Errorf("its digest is %s, but the bundle says it should be %s", digest, finalImage.Digest)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[%s] could not install %s/%s: %s\n", finalImage.Service, registryAddr, finalImage.Image, err.Error())
+				failedServices = append(failedServices, finalImage.Service)
+				return nil
+			}
+			fmt.Printf("[%s] %s/%s:%s (%s)\n",
+				finalImage.Service, registryAddr, finalImage.Image, strings.Join(finalImage.Tags, ","), digest)
+			return nil
+		})
+	}
+	util.RunContextuallyInParallel(context.Background(), funcs...)
+	if len(failedServices) > 0 {
+		return cli.NewExitError(fmt.Sprintf("could not install: %s", strings.Join(failedServices, ", ")), 1)
+	}
+
+	if len(index.Manifests) == 0 {
+		fmt.Println("[sanic] Bundle installed, it did not have any manifests to apply.")
+		return nil
+	}
+	if registryAddr != index.Registry {
+		fmt.Printf("[sanic] Pointing the manifests at %s instead of %s\n", registryAddr, index.Registry)
+		if err := rewriteManifestRegistry(bundleDir, index.Manifests, index.Registry, registryAddr); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	if env.Namespace != "" {
+		if err := createNamespace(env.Namespace, provisioner); err != nil {
+			return cli.NewExitError(fmt.Sprintf(
+				"namespace %s defined in sanic.yaml for this environment couldn't be created: %s",
+				env.Namespace, err.Error(),
+			), 1)
+		}
+	}
+	if env.RegistryAuth.ImagePullSecret != "" {
+		if err := applyImagePullSecret(&env, registryAddr, provisioner); err != nil {
+			return cli.NewExitError(fmt.Sprintf("could not create the image pull secret %s: %s", env.RegistryAuth.ImagePullSecret, err.Error()), 1)
+		}
+	}
+	manifestsDir := filepath.Join(bundleDir, "manifests")
+	if err := kubectlApplyFolder(manifestsDir, env.Namespace, provisioner); err != nil {
+		return cli.NewExitError(fmt.Sprintf("could not apply the manifests of the bundle: %s", err.Error()), 1)
+	}
+	fmt.Println("[sanic] Bundle installed.")
+	return nil
+}
+
+var bundleCommand = cli.Command{
+	Name: "bundle",
+	Usage: "packages the images of some (or all, by default) services, built with sanic build --push, and the rendered " +
+		"deploy templates of an environment into a single file, for clusters without access to its registry. " +
+		"sanic bundle install pushes the images of a bundle to an environment's registry and applies its manifests",
+	ArgsUsage: "[--env <environment>] [-o <file>] [service name, glob (svc-*) or path (services/backend/...)...]\n" +
+		"   sanic bundle install [--env <environment>] <file>",
+	Action: bundleCommandAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "env",
+			Usage: "the environment to bundle (or install the bundle into), instead of the current one",
+		},
+		cli.StringFlag{
+			Name:  "output,o",
+			Usage: "where to write the bundle (default: sanic-bundle-<environment>-<tag>.tgz)",
+		},
+	},
+}
@@ -5,9 +5,17 @@ import "github.com/urfave/cli"
 //Commands is the default list of commands for sanic (e.g., env, build, run, ...)
 var Commands = []cli.Command{
 	buildCommand,
+	bundleCommand,
 	deployCommand,
 	enterCommand,
 	environmentCommand,
+	gcCommand,
+	imageCommand,
 	kubectlCommand,
+	logsCommand,
+	promoteCommand,
 	runCommand,
+	servicesCommand,
+	statsCommand,
+	testCommand,
 }
@@ -5,11 +5,9 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
-	"github.com/webappio/sanic/pkg/bridge/git"
 	"github.com/webappio/sanic/pkg/config"
 	"github.com/webappio/sanic/pkg/provisioners/provisioner"
 	"github.com/webappio/sanic/pkg/shell"
-	"github.com/webappio/sanic/pkg/util"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -26,6 +24,18 @@ func getenv(key string, default_ ...string) string {
 	return strings.Join(default_, " ")
 }
 
+//imageTagEnvVar returns the name of the environment variable with the tag of a service's image,
+//e.g., IMAGE_TAG_PYTHON_BASE for python-base
+func imageTagEnvVar(service string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(service))
+	return "IMAGE_TAG_" + name
+}
+
 func clearYamlsFromDir(folderOut string) error {
 	files, err := filepath.Glob(folderOut + "/*.yaml")
 	if err != nil {
@@ -56,16 +66,9 @@ func pullImageIfNotExists(image string) error {
 	return cmd.Run()
 }
 
-func runTemplater(folderIn, folderOut, templaterImage, namespace string, args cli.Args) error {
-	cfg, err := config.Read()
-	if err != nil {
-		return cli.NewExitError(err.Error(), 1)
-	}
-	shl, err := shell.Current()
-	if err != nil {
-		return err
-	}
-	provisioner, err := getProvisioner()
+//runTemplater renders the templates in folderIn (or the ones named by args) into folderOut, for the plan's environment
+func runTemplater(plan *buildPlan, folderIn, folderOut, templaterImage string, args cli.Args) error {
+	provisioner, err := environmentProvisioner(plan.envName, plan.env)
 	if err != nil {
 		return err
 	}
@@ -73,18 +76,6 @@ func runTemplater(folderIn, folderOut, templaterImage, namespace string, args cl
 	if err != nil {
 		return err
 	}
-	services, err := util.FindServices(shl.GetSanicRoot(), cfg.Build.IgnoreDirs)
-	if err != nil {
-		return err
-	}
-	var serviceDirectories []string
-	for _, service := range services {
-		serviceDirectories = append(serviceDirectories, service.Dir)
-	}
-	buildTag, err := git.GetCurrentTreeHash(shl.GetSanicRoot(), serviceDirectories...)
-	if err != nil {
-		return err
-	}
 	err = clearYamlsFromDir(folderOut)
 	if err != nil {
 		return err
@@ -133,15 +124,23 @@ func runTemplater(folderIn, folderOut, templaterImage, namespace string, args cl
 
 	fmt.Printf("Templating %d config files (%d total found)...\n", len(files), len(allFiles))
 
-	if shl.GetSanicEnvironment() == "ci" {
+	if plan.envName == "ci" {
 		os.Setenv("SANIC_ENV","dev")
 	} else {
-		os.Setenv("SANIC_ENV",shl.GetSanicEnvironment())
+		os.Setenv("SANIC_ENV",plan.envName)
 	}
 	os.Setenv("REGISTRY_HOST",registry)
-	os.Setenv("IMAGE_TAG", buildTag)
-	os.Setenv("PROJECT_DIR", provisioner.InClusterDir(shl.GetSanicRoot()))
-	os.Setenv("NAMESPACE", namespace)
+	os.Setenv("IMAGE_PULL_SECRET", plan.env.RegistryAuth.ImagePullSecret)
+	os.Setenv("IMAGE_TAG", plan.buildTag)
+	for _, service := range plan.services {
+		serviceTag, ok := plan.serviceTags[service.Name]
+		if !ok {
+			serviceTag = plan.buildTag
+		}
+		os.Setenv(imageTagEnvVar(service.Name), serviceTag)
+	}
+	os.Setenv("PROJECT_DIR", provisioner.InClusterDir(plan.root))
+	os.Setenv("NAMESPACE", plan.namespace)
 
 	for _, templatepath := range files {
 		templateName := strings.TrimSuffix(filepath.Base(templatepath), ".tmpl")
@@ -247,7 +246,11 @@ func deployCommandAction(cliContext *cli.Context) error {
 	if err != nil {
 		return cli.NewExitError(err.Error(), 1)
 	}
-	err = runTemplater(folderIn, folderOut, cfg.Deploy.TemplaterImage, env.Namespace, cliContext.Args())
+	plan, err := loadBuildPlan("")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	err = runTemplater(plan, folderIn, folderOut, cfg.Deploy.TemplaterImage, cliContext.Args())
 	if err != nil {
 		return cli.NewExitError(fmt.Sprintf("could not compile templates: %s", err.Error()), 1)
 	}
@@ -260,6 +263,15 @@ func deployCommandAction(cliContext *cli.Context) error {
 			), 1)
 		}
 	}
+	if env.RegistryAuth.ImagePullSecret != "" {
+		registry, _, err := provisioner.Registry()
+		if err == nil {
+			err = applyImagePullSecret(env, registry, provisioner)
+		}
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("could not create the image pull secret %s: %s", env.RegistryAuth.ImagePullSecret, err.Error()), 1)
+		}
+	}
 	err = kubectlApplyFolder(folderOut, env.Namespace, provisioner)
 	if err != nil {
 		return cli.NewExitError(fmt.Sprintf("could not apply templates in %s: %s", folderOut, err.Error()), 1)
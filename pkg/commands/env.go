@@ -44,7 +44,7 @@ func checkConfigAndEnv(configFile, envName string) error {
 	}
 	env, ok := cfg.Environments[envName]
 	if !ok {
-		return fmt.Errorf("environment %s does not exist in project %s", env, projectName)
+		return fmt.Errorf("environment %s does not exist in project %s", envName, projectName)
 	}
 	if err := provisioners.ValidateProvisionerConfig(env.ClusterProvisioner, env.ClusterProvisionerArgs); err != nil {
 		return fmt.Errorf(
@@ -0,0 +1,404 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"github.com/webappio/sanic/pkg/bridge/registry"
+	"github.com/webappio/sanic/pkg/build"
+	"github.com/webappio/sanic/pkg/provisioners/provisioner"
+	"github.com/webappio/sanic/pkg/util"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+//gcImage is an image of a service, in the local image store or in the registry, with every tag that points at it
+type gcImage struct {
+	service    string
+	store      string //"local" or "registry"
+	repository string //e.g., registry.example.com/web
+	id         string //the image ID in the local image store, or the manifest digest in the registry
+	digests    []string
+	tags       []string
+	created    time.Time
+	keep       string //why the image is kept, or "" if it is deleted
+}
+
+//references returns the ways that a container can refer to the image, e.g., registry.example.com/web:abc,
+//registry.example.com/web@sha256:def or sha256:def
+func (image *gcImage) references() []string {
+	references := []string{image.id}
+	for _, tag := range image.tags {
+		references = append(references, image.repository+":"+tag)
+	}
+	for _, digest := range append([]string{image.id}, image.digests...) {
+		references = append(references, image.repository+"@"+digest)
+	}
+	return references
+}
+
+//gcPolicy decides which images sanic gc keeps
+type gcPolicy struct {
+	keep          int             //how many of the newest images of each service to keep
+	minAge        time.Duration   //images younger than this are kept
+	protectedTags map[string]bool //images with these tags are kept, e.g., the build cache and the current tags
+	inUse         map[string]bool //references of the images of pods (see gcImage.references)
+	now           time.Time
+}
+
+//apply sets why each image of a service (in one store) is kept, if it is. The images are sorted newest first.
+func (policy gcPolicy) apply(images []*gcImage) {
+	sort.SliceStable(images, func(i, j int) bool { return images[i].created.After(images[j].created) })
+	for i, image := range images {
+		for _, tag := range image.tags {
+			if policy.protectedTags[tag] {
+				image.keep = "tagged " + tag
+			}
+		}
+		for _, reference := range image.references() {
+			if image.keep == "" && policy.inUse[reference] {
+				image.keep = "used by a pod"
+			}
+		}
+		switch {
+		case image.keep != "":
+		case i < policy.keep:
+			image.keep = fmt.Sprintf("one of the %d newest", policy.keep)
+		case image.created.IsZero():
+			image.keep = "unknown age"
+		case policy.now.Sub(image.created) < policy.minAge:
+			image.keep = "too new"
+		}
+	}
+}
+
+//podImages returns the references of the images of every pod in the cluster (see gcImage.references)
+func podImages(provisioner provisioner.Provisioner) (map[string]bool, error) {
+	cmd, err := provisioner.KubectlCommand("get", "pods", "--all-namespaces", "--output=json")
+	if err != nil {
+		return nil, err
+	}
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	type container struct {
+		Image   string `json:"image"`
+		ImageID string `json:"imageID"`
+	}
+	pods := struct {
+		Items []struct {
+			Spec struct {
+				Containers     []container `json:"containers"`
+				InitContainers []container `json:"initContainers"`
+			} `json:"spec"`
+			Status struct {
+				ContainerStatuses     []container `json:"containerStatuses"`
+				InitContainerStatuses []container `json:"initContainerStatuses"`
+			} `json:"status"`
+		} `json:"items"`
+	}{}
+	if err := json.Unmarshal(stdout.Bytes(), &pods); err != nil {
+		return nil, fmt.Errorf("could not read the pods: %s", err.Error())
+	}
+	images := make(map[string]bool)
+	for _, pod := range pods.Items {
+		var containers []container
+		containers = append(containers, pod.Spec.Containers...)
+		containers = append(containers, pod.Spec.InitContainers...)
+		containers = append(containers, pod.Status.ContainerStatuses...)
+		containers = append(containers, pod.Status.InitContainerStatuses...)
+		for _, c := range containers {
+			images[c.Image] = true
+			//e.g., docker-pullable://registry.example.com/web@sha256:abc, or just sha256:abc for local images
+			imageID := strings.TrimPrefix(strings.TrimPrefix(c.ImageID, "docker-pullable://"), "docker://")
+			if imageID != "" {
+				images[imageID] = true
+			}
+		}
+	}
+	return images, nil
+}
+
+//localGCImages returns the images in the local image store (docker or podman) of each of the given repositories,
+//keyed by service name
+func localGCImages(imageStore string, repositories map[string]string) (map[string][]*gcImage, error) {
+	cmd := exec.Command(imageStore, "image", "ls", "--no-trunc",
+		"--format", "{{.Repository}}\t{{.Tag}}\t{{.ID}}\t{{.Digest}}\t{{.CreatedAt}}")
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("could not list the images in %s: %s", imageStore, strings.TrimSpace(stderr.String()))
+	}
+
+	images := make(map[string][]*gcImage)
+	byID := make(map[string]*gcImage)
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 5 {
+			continue
+		}
+		repository, tag, id, digest := fields[0], fields[1], fields[2], fields[3]
+		service, ok := repositories[repository]
+		if !ok || tag == "<none>" {
+			continue
+		}
+		image, ok := byID[repository+"@"+id]
+		if !ok {
+			//e.g., 2026-10-18 10:30:00 +0000 UTC (docker), or with fractions of a second (podman)
+			created, _ := time.Parse("2006-01-02 15:04:05 -0700 MST", fields[4])
+			image = &gcImage{service: service, store: "local", repository: repository, id: id, created: created}
+			byID[repository+"@"+id] = image
+			images[service] = append(images[service], image)
+		}
+		image.tags = append(image.tags, tag)
+		if digest != "<none>" && digest != "" && !util.StringInSlice(digest, image.digests) {
+			image.digests = append(image.digests, digest)
+		}
+	}
+	return images, nil
+}
+
+//registryGCImages returns the images in the registry of a service's repository, i.e., every manifest with a tag
+func registryGCImages(ctx context.Context, client *registry.Client, registryAddr, service, repository string) ([]*gcImage, error) {
+	tags, err := client.Tags(ctx, repository)
+	if err != nil {
+		return nil, err
+	}
+	var images []*gcImage
+	byDigest := make(map[string]*gcImage)
+	for _, tag := range tags {
+		digest, err := client.ManifestDigest(ctx, repository, tag)
+		if err != nil {
+			return nil, err
+		}
+		if digest == "" {
+			continue
+		}
+		image, ok := byDigest[digest]
+		if !ok {
+			//some manifests are not images (e.g., an exported build cache), which are kept since their age is unknown
+			created, _ := client.ImageCreated(ctx, repository, digest)
+			image = &gcImage{service: service, store: "registry", repository: registryAddr + "/" + repository, id: digest, created: created}
+			byDigest[digest] = image
+			images = append(images, image)
+		}
+		image.tags = append(image.tags, tag)
+	}
+	return images, nil
+}
+
+//deleteGCImage deletes an image from the local image store (by its tags, so that other repositories which have
+//the same image keep it), or its manifest from the registry
+func deleteGCImage(ctx context.Context, image *gcImage, imageStore string, client *registry.Client, registryAddr string) error {
+	if image.store == "registry" {
+		return client.DeleteManifest(ctx, strings.TrimPrefix(image.repository, registryAddr+"/"), image.id)
+	}
+	args := []string{"image", "rm"}
+	for _, tag := range image.tags {
+		args = append(args, image.repository+":"+tag)
+	}
+	cmd := exec.Command(imageStore, args...)
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s", strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+func formatAge(now, created time.Time) string {
+	if created.IsZero() {
+		return "-"
+	}
+	age := now.Sub(created)
+	if age >= 48*time.Hour {
+		return fmt.Sprintf("%dd", int(age.Hours()/24))
+	}
+	return age.Round(time.Minute).String()
+}
+
+func gcCommandAction(cliContext *cli.Context) error {
+	if cliContext.Int("keep") < 0 || cliContext.Int("keep-days") < 0 {
+		return cli.NewExitError("--keep and --keep-days cannot be negative", 1)
+	}
+	doLocal, doRegistry := cliContext.Bool("local"), cliContext.Bool("registry")
+	if !doLocal && !doRegistry {
+		doLocal, doRegistry = true, true
+	}
+
+	plan, err := loadBuildPlan("")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	services, err := selectServices(plan.root, plan.services, cliContext.Args())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	registryAddr, registryInsecure := "", false
+	policy := gcPolicy{
+		keep:          cliContext.Int("keep"),
+		minAge:        time.Duration(cliContext.Int("keep-days")) * 24 * time.Hour,
+		protectedTags: map[string]bool{build.CacheTag: true},
+		inUse:         make(map[string]bool),
+		now:           time.Now(),
+	}
+	if plan.env != nil {
+		provisioner, err := environmentProvisioner(plan.envName, plan.env)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		registryAddr, registryInsecure, err = provisioner.Registry()
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("could not find the registry of the environment %s: %s", plan.envName, err.Error()), 1)
+		}
+		policy.inUse, err = podImages(provisioner)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("could not list the images of the pods in the cluster, so nothing was deleted: %s", err.Error()), 1)
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, "[WARNING] not in an environment, so only the local images are collected, without checking which ones pods use")
+		doRegistry = false
+	}
+	if registryAddr == "" {
+		doRegistry = false
+	}
+
+	builder := plan.builder(registryAddr, registryInsecure)
+	repositories := make(map[string]string) //local repository -> service
+	for _, service := range services {
+		repositories[builder.ImageRepository(service)] = service.Name
+		for _, tag := range append([]string{builder.ServiceTag(service), builder.BuildTag}, plan.serviceConfigs[service.Name].Tags...) {
+			policy.protectedTags[tag] = true
+		}
+	}
+
+	imageStore := "docker"
+	if plan.envBuild().Backend == build.BackendPodman {
+		imageStore = "podman"
+	}
+	var images []*gcImage
+	if doLocal {
+		localImages, err := localGCImages(imageStore, repositories)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		for _, serviceImages := range localImages {
+			policy.apply(serviceImages)
+			images = append(images, serviceImages...)
+		}
+	}
+	ctx := context.Background()
+	var client *registry.Client
+	if doRegistry {
+		credentials, err := registryCredentials(plan.env, registryAddr)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("could not get the credentials for the registry %s: %s", registryAddr, err.Error()), 1)
+		}
+		client = registry.NewClient(registryAddr, registryInsecure, credentials)
+		for _, service := range services {
+			serviceImages, err := registryGCImages(ctx, client, registryAddr, service.Name, builder.ImageName(service))
+			if err != nil {
+				return cli.NewExitError(fmt.Sprintf("could not list the images of %s in %s: %s", service.Name, registryAddr, err.Error()), 1)
+			}
+			policy.apply(serviceImages)
+			images = append(images, serviceImages...)
+		}
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		if images[i].service != images[j].service {
+			return images[i].service < images[j].service
+		}
+		return images[i].store < images[j].store
+	})
+
+	dryRun := cliContext.Bool("dry-run")
+	var garbage []*gcImage
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tSTORE\tIMAGE\tTAGS\tAGE\tACTION")
+	for _, image := range images {
+		action := "keep (" + image.keep + ")"
+		if image.keep == "" {
+			garbage = append(garbage, image)
+			action = "delete"
+			if dryRun {
+				action = "would delete"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", image.service, image.store, image.repository,
+			strings.Join(image.tags, ","), formatAge(policy.now, image.created), action)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if dryRun || len(garbage) == 0 {
+		fmt.Printf("[sanic] %d of %d images would be deleted.\n", len(garbage), len(images))
+		return nil
+	}
+
+	var failed int
+	deletedFromRegistry := false
+	for _, image := range garbage {
+		if err := deleteGCImage(ctx, image, imageStore, client, registryAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "[%s] could not delete %s:%s: %s\n",
+				image.service, image.repository, strings.Join(image.tags, ","), err.Error())
+			failed++
+			continue
+		}
+		deletedFromRegistry = deletedFromRegistry || image.store == "registry"
+	}
+	fmt.Printf("[sanic] Deleted %d of %d images.\n", len(garbage)-failed, len(images))
+	if deletedFromRegistry {
+		fmt.Printf("[sanic] The registry %s only frees the disk space of deleted images when its garbage collector runs.\n", registryAddr)
+	}
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("could not delete %d images", failed), 1)
+	}
+	return nil
+}
+
+var gcCommand = cli.Command{
+	Name: "gc",
+	Usage: "deletes old images of some (or all, by default) services from the local image store and the environment's " +
+		"registry, except for the newest ones of each service, recent ones, ones that pods use, and ones with the " +
+		"current, configured or build cache tags",
+	ArgsUsage: "[service name, glob (svc-*) or path (services/backend/...)...]",
+	Action:    gcCommandAction,
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "keep",
+			Usage: "how many of the newest images of each service to keep",
+			Value: 10,
+		},
+		cli.IntFlag{
+			Name:  "keep-days",
+			Usage: "keep images which were built less than this many days ago",
+			Value: 7,
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only lists which images would be deleted",
+		},
+		cli.BoolFlag{
+			Name:  "local",
+			Usage: "only collects the images in the local image store",
+		},
+		cli.BoolFlag{
+			Name:  "registry",
+			Usage: "only collects the images in the environment's registry",
+		},
+	},
+}
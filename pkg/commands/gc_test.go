@@ -0,0 +1,86 @@
+package commands
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGCPolicyApply(t *testing.T) {
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) time.Time { return now.Add(-time.Duration(days) * 24 * time.Hour) }
+	newImages := func() []*gcImage {
+		//in no particular order, apply sorts them
+		return []*gcImage{
+			{repository: "registry.example.com/web", id: "sha256:d", created: daysAgo(20)},
+			{repository: "registry.example.com/web", id: "sha256:a", created: daysAgo(1), tags: []string{"aaa"}},
+			{repository: "registry.example.com/web", id: "sha256:c", created: daysAgo(10), tags: []string{"buildcache"}},
+			{repository: "registry.example.com/web", id: "sha256:e"},
+			{repository: "registry.example.com/web", id: "sha256:b", created: daysAgo(5), digests: []string{"sha256:f"}},
+		}
+	}
+	tests := []struct {
+		name   string
+		policy gcPolicy
+		keep   map[string]string
+	}{
+		{
+			name:   "nothing protected",
+			policy: gcPolicy{},
+			keep:   map[string]string{"sha256:e": "unknown age"},
+		},
+		{
+			name:   "newest",
+			policy: gcPolicy{keep: 2},
+			keep:   map[string]string{"sha256:a": "one of the 2 newest", "sha256:b": "one of the 2 newest", "sha256:e": "unknown age"},
+		},
+		{
+			name:   "minimum age",
+			policy: gcPolicy{minAge: 7 * 24 * time.Hour},
+			keep:   map[string]string{"sha256:a": "too new", "sha256:b": "too new", "sha256:e": "unknown age"},
+		},
+		{
+			name:   "protected tags",
+			policy: gcPolicy{protectedTags: map[string]bool{"buildcache": true}},
+			keep:   map[string]string{"sha256:c": "tagged buildcache", "sha256:e": "unknown age"},
+		},
+		{
+			name: "in use, by tag or digest",
+			policy: gcPolicy{inUse: map[string]bool{
+				"registry.example.com/web:aaa":        true,
+				"registry.example.com/web@sha256:f":   true,
+				"registry.example.com/other@sha256:d": true,
+			}},
+			keep: map[string]string{"sha256:a": "used by a pod", "sha256:b": "used by a pod", "sha256:e": "unknown age"},
+		},
+		{
+			name: "a protected tag is the reason over being in use or new",
+			policy: gcPolicy{
+				keep:          1,
+				protectedTags: map[string]bool{"aaa": true},
+				inUse:         map[string]bool{"sha256:a": true},
+			},
+			keep: map[string]string{"sha256:a": "tagged aaa", "sha256:e": "unknown age"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.policy.now = now
+			images := newImages()
+			test.policy.apply(images)
+			var order []string
+			for _, image := range images {
+				order = append(order, image.id)
+				if image.keep != test.keep[image.id] {
+					t.Errorf("%s: kept as %q, want %q", image.id, image.keep, test.keep[image.id])
+				}
+			}
+			//images without a creation time are the oldest
+			want := []string{"sha256:a", "sha256:b", "sha256:c", "sha256:d", "sha256:e"}
+			for i := range want {
+				if order[i] != want[i] {
+					t.Fatalf("the images are in the order %v, want the newest first: %v", order, want)
+				}
+			}
+		})
+	}
+}
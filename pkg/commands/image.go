@@ -0,0 +1,208 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"github.com/webappio/sanic/pkg/bridge/git"
+	"github.com/webappio/sanic/pkg/bridge/registry"
+	"github.com/webappio/sanic/pkg/build"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+type imageInfo struct {
+	Image        string            `json:"image"`
+	Service      string            `json:"service"`
+	Source       string            `json:"source,omitempty"`
+	Dir          string            `json:"dir,omitempty"`
+	Revision     string            `json:"revision,omitempty"`
+	Subject      string            `json:"subject,omitempty"`
+	TreeHash     string            `json:"tree,omitempty"`
+	Uncommitted  bool              `json:"uncommitted"`
+	Environment  string            `json:"environment,omitempty"`
+	Created      string            `json:"created,omitempty"`
+	SanicVersion string            `json:"sanicVersion,omitempty"`
+	Labels       map[string]string `json:"labels"`
+}
+
+//localImageLabels returns the labels of an image in the local docker daemon, or false if it does not have the image
+func localImageLabels(image string) (map[string]string, bool) {
+	cmd := exec.Command("docker", "image", "inspect", "--format", "{{json .Config.Labels}}", image)
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	if cmd.Run() != nil {
+		return nil, false
+	}
+	labels := make(map[string]string)
+	if json.Unmarshal(out.Bytes(), &labels) != nil {
+		return nil, false
+	}
+	return labels, true
+}
+
+//splitImageReference splits an image reference into its registry, repository and tag (or digest),
+//e.g., registry.example.com/team/web:abc -> registry.example.com, team/web, abc
+func splitImageReference(image string) (string, string, string) {
+	name, reference := image, "latest"
+	if idx := strings.Index(name, "@"); idx != -1 {
+		name, reference = name[:idx], name[idx+1:]
+	} else if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		name, reference = name[:idx], name[idx+1:]
+	}
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0], parts[1], reference
+	}
+	if len(parts) == 1 {
+		return "docker.io", "library/" + name, reference
+	}
+	return "docker.io", name, reference
+}
+
+//registryImageLabels returns the labels of an image in its registry, with the credentials in the user's docker config
+func registryImageLabels(image string, insecure bool) (map[string]string, error) {
+	registryAddr, repository, reference := splitImageReference(image)
+	dockerConfig, err := registry.UserDockerConfig()
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := registry.CredentialsFromDockerConfig(dockerConfig, registryAddr)
+	if err != nil {
+		credentials = nil //try anonymously
+	}
+	client := registry.NewClient(registryAddr, insecure, credentials)
+	return client.ImageLabels(context.Background(), repository, reference)
+}
+
+//describeImage maps the provenance labels of an image (see build.Provenance) to its service directory and commit
+//in the current repository, if they are in it
+func describeImage(image string, labels map[string]string) (*imageInfo, error) {
+	info := &imageInfo{
+		Image:        image,
+		Service:      labels[build.LabelTitle],
+		Source:       labels[build.LabelSource],
+		Revision:     labels[build.LabelRevision],
+		TreeHash:     labels[build.LabelTreeHash],
+		Environment:  labels[build.LabelEnvironment],
+		Created:      labels[build.LabelCreated],
+		SanicVersion: labels[build.LabelVersion],
+		Labels:       labels,
+	}
+	if info.SanicVersion == "" {
+		return nil, fmt.Errorf("%s does not have the labels that sanic adds to the images it builds", image)
+	}
+
+	root, err := projectRoot()
+	if err != nil {
+		return nil, err
+	}
+	gitRoot, err := git.GetGitRoot(root)
+	if err != nil {
+		return info, nil //not in a repository, so only the labels are known
+	}
+	if info.Source != "" {
+		dir := filepath.Join(gitRoot, filepath.FromSlash(info.Source))
+		if _, err := os.Stat(dir); err == nil {
+			info.Dir = dir
+		}
+	}
+	if info.Revision != "" {
+		commitTree, subject, err := git.DescribeCommit(gitRoot, info.Revision)
+		if err == nil {
+			info.Subject = subject
+			info.Uncommitted = info.TreeHash != "" && info.TreeHash != commitTree
+		}
+	}
+	return info, nil
+}
+
+func imageInspectCommandAction(cliContext *cli.Context) error {
+	if cliContext.NArg() != 1 {
+		return newUsageError(cliContext)
+	}
+	format := cliContext.String("format")
+	if format != "table" && format != "json" {
+		return cli.NewExitError(fmt.Sprintf("--format must be table or json, was: '%s'", format), 1)
+	}
+
+	image := cliContext.Args().First()
+	labels, ok := localImageLabels(image)
+	if !ok {
+		var err error
+		labels, err = registryImageLabels(image, cliContext.Bool("insecure"))
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("could not find %s in the local docker daemon or in its registry: %s", image, err.Error()), 1)
+		}
+	}
+	info, err := describeImage(image, labels)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(info)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Image:\t%s\n", info.Image)
+	fmt.Fprintf(w, "Service:\t%s\n", info.Service)
+	switch {
+	case info.Dir != "":
+		fmt.Fprintf(w, "Directory:\t%s\n", info.Dir)
+	case info.Source != "":
+		fmt.Fprintf(w, "Directory:\t%s (not in this repository)\n", info.Source)
+	}
+	switch {
+	case info.Revision == "":
+		fmt.Fprintf(w, "Commit:\tunknown (it was not built in a git repository)\n")
+	case info.Subject != "":
+		fmt.Fprintf(w, "Commit:\t%s %s\n", info.Revision, info.Subject)
+	default:
+		fmt.Fprintf(w, "Commit:\t%s (not in this repository)\n", info.Revision)
+	}
+	if info.TreeHash != "" {
+		if info.Uncommitted {
+			fmt.Fprintf(w, "Tree:\t%s (the commit, with uncommitted changes)\n", info.TreeHash)
+		} else {
+			fmt.Fprintf(w, "Tree:\t%s\n", info.TreeHash)
+		}
+	}
+	if info.Environment != "" {
+		fmt.Fprintf(w, "Environment:\t%s\n", info.Environment)
+	}
+	fmt.Fprintf(w, "Created:\t%s\n", info.Created)
+	fmt.Fprintf(w, "Sanic version:\t%s\n", info.SanicVersion)
+	return w.Flush()
+}
+
+var imageCommand = cli.Command{
+	Name:  "image",
+	Usage: "commands for the images that sanic builds",
+	Subcommands: []cli.Command{
+		{
+			Name:      "inspect",
+			Usage:     "shows the service directory, git commit and environment that an image was built from",
+			ArgsUsage: "<image, e.g., registry.example.com/web:abc123>",
+			Action:    imageInspectCommandAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "the output format, table or json",
+					Value: "table",
+				},
+				cli.BoolFlag{
+					Name:  "insecure",
+					Usage: "uses plain HTTP to read the image from its registry, if it is not in the local docker daemon",
+				},
+			},
+		},
+	},
+}
@@ -0,0 +1,218 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"github.com/webappio/sanic/pkg/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+//buildRunLogs returns the log file of each service in a build run, keyed by service name
+func buildRunLogs(logDirectory, runID string) (map[string]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(logDirectory, "builds", runID))
+	if err != nil {
+		return nil, err
+	}
+	logs := make(map[string]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		for _, extension := range []string{".log", ".jsonl"} {
+			if !entry.IsDir() && strings.HasSuffix(name, extension) {
+				logs[strings.TrimSuffix(name, extension)] = filepath.Join(logDirectory, "builds", runID, name)
+			}
+		}
+	}
+	return logs, nil
+}
+
+//selectBuildRun returns the ID of the build run that --run refers to, i.e., the Nth most recent run (1 being the
+//latest) or a run ID (or the start of one, from its date onwards, e.g., 20261018-1030).
+//If run is empty, the latest run is returned, or the latest one which built service.
+func selectBuildRun(logDirectory string, runIDs []string, run, service string) (string, error) {
+	if run == "" {
+		for _, runID := range runIDs {
+			logs, err := buildRunLogs(logDirectory, runID)
+			if err != nil {
+				return "", err
+			}
+			if _, ok := logs[service]; ok || service == "" {
+				return runID, nil
+			}
+		}
+		return "", fmt.Errorf("none of the last %d builds built %s", len(runIDs), service)
+	}
+	//run IDs start with an 8 digit date, so shorter numbers are positions
+	if n, err := strconv.Atoi(run); err == nil && len(run) < 8 {
+		if n < 1 || n > len(runIDs) {
+			return "", fmt.Errorf("--run must be between 1 (the latest build) and %d, was: %d", len(runIDs), n)
+		}
+		return runIDs[n-1], nil
+	}
+	var matches []string
+	for _, runID := range runIDs {
+		if strings.HasPrefix(runID, run) {
+			matches = append(matches, runID)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("there are no logs of a build with the ID %s", run)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%s could be any of the builds %s", run, strings.Join(matches, ", "))
+	}
+}
+
+//printBuildLog prints the lines of a build log (in either of the build.LogFormats) which match pattern, if it is not nil.
+//Each line is prefixed with prefix.
+func printBuildLog(logFile string, pattern *regexp.Regexp, prefix string) error {
+	f, err := os.Open(logFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	jsonLines := strings.HasSuffix(logFile, ".jsonl")
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if jsonLines {
+			logLine := build.LogLine{}
+			if err := json.Unmarshal(scanner.Bytes(), &logLine); err != nil {
+				return fmt.Errorf("%s is not a valid JSON lines log: %s", logFile, err.Error())
+			}
+			if pattern != nil && !pattern.MatchString(logLine.Message) {
+				continue
+			}
+			line = fmt.Sprintf("[%s] [%s] %s", logLine.Time.In(time.Local), logLine.Stream, logLine.Message)
+		} else if pattern != nil && !pattern.MatchString(line) {
+			continue
+		}
+		fmt.Println(prefix + line)
+	}
+	return scanner.Err()
+}
+
+func logsBuildCommandAction(cliContext *cli.Context) error {
+	if cliContext.NArg() > 1 {
+		return newUsageError(cliContext)
+	}
+	service := cliContext.Args().First()
+	var pattern *regexp.Regexp
+	if cliContext.String("grep") != "" {
+		var err error
+		pattern, err = regexp.Compile(cliContext.String("grep"))
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("--grep is not a valid regular expression: %s", err.Error()), 1)
+		}
+	}
+
+	root, err := projectRoot()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	logDirectory := filepath.Join(root, "logs")
+	runIDs, err := build.BuildRunIDs(logDirectory)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("could not read the build logs: %s", err.Error()), 1)
+	}
+	if len(runIDs) == 0 {
+		return cli.NewExitError(fmt.Sprintf("there are no build logs in %s, run sanic build first", logDirectory), 1)
+	}
+
+	if service == "" && pattern == nil && cliContext.String("run") == "" {
+		//list the runs, so that one can be picked with --run
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "RUN\tID\tSERVICES")
+		for i, runID := range runIDs {
+			logs, err := buildRunLogs(logDirectory, runID)
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			var services []string
+			for name := range logs {
+				services = append(services, name)
+			}
+			sort.Strings(services)
+			fmt.Fprintf(w, "%d\t%s\t%s\n", i+1, runID, strings.Join(services, ", "))
+		}
+		return w.Flush()
+	}
+
+	runID, err := selectBuildRun(logDirectory, runIDs, cliContext.String("run"), service)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	logs, err := buildRunLogs(logDirectory, runID)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if service != "" {
+		logFile, ok := logs[service]
+		if !ok {
+			return cli.NewExitError(fmt.Sprintf("the build %s did not build %s", runID, service), 1)
+		}
+		if err := printBuildLog(logFile, pattern, ""); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		return nil
+	}
+
+	var services []string
+	for name := range logs {
+		services = append(services, name)
+	}
+	sort.Strings(services)
+	if pattern == nil {
+		//list the services of the run, so that one can be picked
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SERVICE\tLOG")
+		for _, name := range services {
+			fmt.Fprintf(w, "%s\t%s\n", name, logs[name])
+		}
+		return w.Flush()
+	}
+	for _, name := range services {
+		if err := printBuildLog(logs[name], pattern, name+": "); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	return nil
+}
+
+var logsCommand = cli.Command{
+	Name:  "logs",
+	Usage: "commands for the logs that sanic keeps",
+	Subcommands: []cli.Command{
+		{
+			Name: "build",
+			Usage: "shows the log of a service from a recent build. Without a service, lists the recent builds " +
+				"(or the services of the --run), or searches every service of the build with --grep",
+			ArgsUsage: "[service]",
+			Action:    logsBuildCommandAction,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "run",
+					Usage: "which build to show, either N for the Nth most recent one (1 is the latest) or (the start of) its ID",
+				},
+				cli.StringFlag{
+					Name:  "grep",
+					Usage: "only shows the lines which match this regular expression",
+				},
+			},
+		},
+	},
+}
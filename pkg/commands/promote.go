@@ -0,0 +1,162 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"github.com/urfave/cli"
+	"github.com/webappio/sanic/pkg/bridge/registry"
+	"github.com/webappio/sanic/pkg/build"
+	"github.com/webappio/sanic/pkg/util"
+	"os"
+	"strings"
+	"sync"
+)
+
+//environmentRegistry returns the registry of the given environment's provisioner, and whether it uses HTTP
+func environmentRegistry(plan *buildPlan, envName string) (string, bool, error) {
+	provisioner, err := environmentProvisioner(envName, plan.env)
+	if err != nil {
+		return "", false, err
+	}
+	registryAddr, registryInsecure, err := provisioner.Registry()
+	if err != nil {
+		return "", false, fmt.Errorf("could not find the registry of the environment %s: %s", envName, err.Error())
+	}
+	if registryAddr == "" {
+		return "", false, fmt.Errorf("the environment %s does not have a registry", envName)
+	}
+	return registryAddr, registryInsecure, nil
+}
+
+//sameBuild returns whether a service, and every service it is built from, has the same build configuration in both
+//plans (see build.BuildConfigHash), so that an image built for one would be the same if it was built for the other
+func sameBuild(fromPlan, toPlan *buildPlan, service string) bool {
+	if build.BuildConfigHash(fromPlan.serviceConfigs[service]) != build.BuildConfigHash(toPlan.serviceConfigs[service]) {
+		return false
+	}
+	for _, parent := range toPlan.graph.Parents(service) {
+		if !sameBuild(fromPlan, toPlan, parent) {
+			return false
+		}
+	}
+	return true
+}
+
+//promotedTags returns the tags that a service's image gets in the environment it is promoted to:
+//the tag it was promoted from, the tag of the whole repository and the service's configured tags in that environment.
+//Its content hash in that environment is only added if the service is built the same way in both (see sameBuild),
+//since otherwise building it there would skip the build and keep the image built with the other configuration.
+func promotedTags(fromTag string, fromPlan, toPlan *buildPlan, toBuilder *build.Builder, service util.BuildableService) []string {
+	tags := []string{fromTag}
+	candidates := []string{toBuilder.BuildTag}
+	if sameBuild(fromPlan, toPlan, service.Name) {
+		candidates = append([]string{toBuilder.ServiceTag(service)}, candidates...)
+	}
+	for _, tag := range append(candidates, toPlan.serviceConfigs[service.Name].Tags...) {
+		if !util.StringInSlice(tag, tags) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func promoteCommandAction(cliContext *cli.Context) error {
+	fromEnv := cliContext.String("from")
+	toEnv := cliContext.String("to")
+	if fromEnv == "" || toEnv == "" {
+		return newUsageError(cliContext)
+	}
+
+	plan, err := loadBuildPlan(cliContext.String("tag"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fromPlan, err := plan.forEnvironment(fromEnv)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	toPlan, err := plan.forEnvironment(toEnv)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	services, err := fromPlan.selectServices(cliContext.Args())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	fromRegistry, fromInsecure, err := environmentRegistry(fromPlan, fromEnv)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	toRegistry, toInsecure, err := environmentRegistry(toPlan, toEnv)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fromCredentials, err := registryCredentials(fromPlan.env, fromRegistry)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("could not get the credentials for the registry %s: %s", fromRegistry, err.Error()), 1)
+	}
+	toCredentials, err := registryCredentials(toPlan.env, toRegistry)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("could not get the credentials for the registry %s: %s", toRegistry, err.Error()), 1)
+	}
+	fromBuilder := fromPlan.builder(fromRegistry, fromInsecure)
+	toBuilder := toPlan.builder(toRegistry, toInsecure)
+	fromClient := registry.NewClient(fromRegistry, fromInsecure, fromCredentials)
+	toClient := registry.NewClient(toRegistry, toInsecure, toCredentials)
+
+	var failedServices []string
+	var mutex sync.Mutex
+	var funcs []func(context.Context) error
+	for _, service := range services {
+		finalService := service
+		funcs = append(funcs, func(ctx context.Context) error {
+			fromTag := fromBuilder.ServiceTag(finalService)
+			toTags := promotedTags(fromTag, fromPlan, toPlan, toBuilder, finalService)
+			digest, err := registry.CopyImage(ctx,
+				fromClient, fromBuilder.ImageName(finalService), fromTag,
+				toClient, toBuilder.ImageName(finalService), toTags)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[%s] could not promote %s:%s: %s\n",
+					finalService.Name, fromBuilder.ImageRepository(finalService), fromTag, err.Error())
+				failedServices = append(failedServices, finalService.Name)
+				return nil
+			}
+			fmt.Printf("[%s] %s:%s -> %s:%s (%s)\n",
+				finalService.Name, fromBuilder.ImageRepository(finalService), fromTag,
+				toBuilder.ImageRepository(finalService), strings.Join(toTags, ","), digest)
+			return nil
+		})
+	}
+	util.RunContextuallyInParallel(context.Background(), funcs...)
+
+	if len(failedServices) > 0 {
+		return cli.NewExitError(fmt.Sprintf("could not promote: %s", strings.Join(failedServices, ", ")), 1)
+	}
+	return nil
+}
+
+var promoteCommand = cli.Command{
+	Name:      "promote",
+	Usage:     "copies the images of some (or all, by default) services from one environment's registry to another's, without rebuilding them",
+	ArgsUsage: "--from <environment> --to <environment> [service name, glob (svc-*) or path (services/backend/...)...]",
+	Action:    promoteCommandAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "from",
+			Usage: "the environment to copy the images from, e.g., staging",
+		},
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "the environment to copy the images to, e.g., prod",
+		},
+		cli.StringFlag{
+			Name:  "tag,t",
+			Usage: "the tag of the images to promote (default: the tags of the services as they are in the current directory)",
+		},
+	},
+}
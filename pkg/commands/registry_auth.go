@@ -0,0 +1,126 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/webappio/sanic/pkg/bridge/registry"
+	"github.com/webappio/sanic/pkg/config"
+	"github.com/webappio/sanic/pkg/provisioners/provisioner"
+	"github.com/webappio/sanic/pkg/util"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//registryCredentials returns the credentials that an environment configures for its registry (see config.RegistryAuth),
+//or nil if it does not configure any, so that whatever "docker login" stored is used
+func registryCredentials(env *config.Environment, registryAddr string) (*registry.Credentials, error) {
+	if env == nil || !env.RegistryAuth.IsSet() {
+		return nil, nil
+	}
+	auth := env.RegistryAuth
+	switch {
+	case auth.DockerConfig != "":
+		path, err := util.ExpandUser(auth.DockerConfig)
+		if err != nil {
+			return nil, err
+		}
+		return registry.CredentialsFromDockerConfig(path, registryAddr)
+	case auth.CredentialHelper != "":
+		return registry.CredentialsFromHelper(auth.CredentialHelper, registryAddr)
+	case auth.TokenEnv != "":
+		token := os.Getenv(auth.TokenEnv)
+		if token == "" {
+			return nil, fmt.Errorf("the registry token should be in $%s, but it is not set", auth.TokenEnv)
+		}
+		if auth.Username != "" {
+			return &registry.Credentials{Username: auth.Username, Password: token}, nil
+		}
+		return &registry.Credentials{RegistryToken: token}, nil
+	default:
+		path, err := util.ExpandUser(auth.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		password, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the registry password: %s", err.Error())
+		}
+		return &registry.Credentials{Username: auth.Username, Password: strings.TrimRight(string(password), "\r\n")}, nil
+	}
+}
+
+//temporaryDockerConfig writes a copy of the user's docker config with the given credentials for the registry, for
+//Builder.DockerConfig, so that the logins and credential helpers for other registries (e.g., of base images) still work.
+//It returns its directory ("" if credentials is nil) and a function which removes it.
+func temporaryDockerConfig(registryAddr string, credentials *registry.Credentials) (string, func(), error) {
+	if credentials == nil {
+		return "", func() {}, nil
+	}
+	dir, err := ioutil.TempDir("", "sanicdocker")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	basePath, err := registry.UserDockerConfig()
+	if err == nil {
+		err = registry.WriteDockerConfig(dir, basePath, registryAddr, credentials)
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
+
+//applyImagePullSecret creates (or updates) the environment's image pull secret in the namespace, from its registry
+//credentials, and sets up the namespace's default service account to use it
+func applyImagePullSecret(env *config.Environment, registryAddr string, provisioner provisioner.Provisioner) error {
+	secretName := env.RegistryAuth.ImagePullSecret
+	credentials, err := registryCredentials(env, registryAddr)
+	if err != nil {
+		return err
+	}
+	dockerConfigJSON, err := registry.PullSecretConfig(registryAddr, credentials)
+	if err != nil {
+		return err
+	}
+	secret := fmt.Sprintf(`{
+  "apiVersion": "v1",
+  "kind": "Secret",
+  "metadata": {"name": %q},
+  "type": "kubernetes.io/dockerconfigjson",
+  "data": {".dockerconfigjson": %q}
+}`, secretName, base64.StdEncoding.EncodeToString(dockerConfigJSON))
+
+	namespaceArgs := []string{}
+	if env.Namespace != "" {
+		namespaceArgs = append(namespaceArgs, "--namespace="+env.Namespace)
+	}
+	cmd, err := provisioner.KubectlCommand(append([]string{"apply", "-f", "-"}, namespaceArgs...)...)
+	if err != nil {
+		return err
+	}
+	out := &bytes.Buffer{}
+	cmd.Stdin = strings.NewReader(secret)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return errors.New(strings.TrimSpace(out.String()))
+	}
+
+	cmd, err = provisioner.KubectlCommand(append([]string{"patch", "serviceaccount", "default",
+		"-p", fmt.Sprintf(`{"imagePullSecrets": [{"name": %q}]}`, secretName)}, namespaceArgs...)...)
+	if err != nil {
+		return err
+	}
+	out = &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return errors.New(strings.TrimSpace(out.String()))
+	}
+	return nil
+}
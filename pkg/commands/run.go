@@ -26,15 +26,19 @@ func mostSimilarCommands(commands map[string]config.Command, requestedCommand st
 	for _, cmd := range commands {
 		commandList = append(commandList, cmd.Name)
 	}
-	sort.Slice(commandList, func(i, j int) bool {
-		distI := levenshtein.ComputeDistance(commandList[i], requestedCommand)
-		distJ := levenshtein.ComputeDistance(commandList[j], requestedCommand)
+	return mostSimilarStrings(commandList, requestedCommand, num)
+}
+
+func mostSimilarStrings(options []string, requested string, num int) []string {
+	sort.Slice(options, func(i, j int) bool {
+		distI := levenshtein.ComputeDistance(options[i], requested)
+		distJ := levenshtein.ComputeDistance(options[j], requested)
 		return distI < distJ
 	})
-	if len(commandList) <= num {
-		return commandList
+	if len(options) <= num {
+		return options
 	}
-	return commandList[:num]
+	return options[:num]
 }
 
 func runCommandAction(cliCtx *cli.Context) error {
@@ -0,0 +1,138 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"github.com/webappio/sanic/pkg/build"
+	"github.com/webappio/sanic/pkg/util"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+//imageNameRegexp is what docker accepts as a single component of an image name
+var imageNameRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*$`)
+
+type serviceInfo struct {
+	Name       string   `json:"name"`
+	Dir        string   `json:"dir"`
+	Dockerfile string   `json:"dockerfile"`
+	Image      string   `json:"image"`
+	Tag        string   `json:"tag"`
+	DependsOn  []string `json:"dependsOn"`
+	Disabled   bool     `json:"disabled"`
+}
+
+//serviceWarnings returns problems with the given services which would make building or deploying them misbehave,
+//e.g., two directories named api, which would both be built as the same image
+func serviceWarnings(root string, services []util.BuildableService, builder *build.Builder) []string {
+	var warnings []string
+	servicesByImage := make(map[string][]string)
+	var images []string
+	for _, service := range services {
+		image := builder.ImageName(service)
+		if _, ok := servicesByImage[image]; !ok {
+			images = append(images, image)
+		}
+		dir, err := filepath.Rel(root, filepath.Join(service.Dir, service.Dockerfile))
+		if err != nil {
+			dir = filepath.Join(service.Dir, service.Dockerfile)
+		}
+		servicesByImage[image] = append(servicesByImage[image], dir)
+
+		if !imageNameRegexp.MatchString(service.Name) {
+			warnings = append(warnings, fmt.Sprintf(
+				"%s is not a valid image name (it should be lowercase letters, digits and separators), so %s cannot be built",
+				service.Name, dir))
+		}
+	}
+	sort.Strings(images)
+	for _, image := range images {
+		if dirs := servicesByImage[image]; len(dirs) > 1 {
+			warnings = append(warnings, fmt.Sprintf(
+				"%s all produce the image %s, so they will overwrite each other. Rename the directories, or ignore all but one with build.ignoreDirs",
+				strings.Join(dirs, ", "), image))
+		}
+	}
+	return warnings
+}
+
+func servicesCommandAction(cliContext *cli.Context) error {
+	format := cliContext.String("format")
+	if format != "table" && format != "json" {
+		return cli.NewExitError(fmt.Sprintf("--format must be table or json, was: '%s'", format), 1)
+	}
+
+	plan, err := loadBuildPlan("")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	services, err := selectServices(plan.root, plan.services, cliContext.Args())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	registry := ""
+	if provisioner, err := getProvisioner(); err == nil {
+		registry, _, _ = provisioner.Registry()
+	}
+	builder := plan.builder(registry, false)
+
+	var infos []serviceInfo
+	for _, service := range services {
+		dir, err := filepath.Rel(plan.root, service.Dir)
+		if err != nil {
+			dir = service.Dir
+		}
+		infos = append(infos, serviceInfo{
+			Name:       service.Name,
+			Dir:        dir,
+			Dockerfile: service.Dockerfile,
+			Image:      builder.ImageRepository(service),
+			Tag:        builder.ServiceTag(service),
+			DependsOn:  append([]string{}, plan.graph.Parents(service.Name)...),
+			Disabled:   plan.serviceConfigs[service.Name].IsDisabled(),
+		})
+	}
+
+	for _, warning := range serviceWarnings(plan.root, plan.services, builder) {
+		fmt.Fprintf(os.Stderr, "[WARNING] %s\n", warning)
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(infos)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDIRECTORY\tDOCKERFILE\tIMAGE\tTAG\tDEPENDS ON")
+	for _, info := range infos {
+		name := info.Name
+		if info.Disabled {
+			name += " (disabled)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			name, info.Dir, info.Dockerfile, info.Image, info.Tag, strings.Join(info.DependsOn, ","))
+	}
+	return w.Flush()
+}
+
+var servicesCommand = cli.Command{
+	Name:      "services",
+	Usage:     "list the services that sanic would build, with their images and tags",
+	ArgsUsage: "[service name, glob (svc-*) or path (services/backend/...)...]",
+	Action:    servicesCommandAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "table or json",
+			Value: "table",
+		},
+	},
+}
@@ -0,0 +1,194 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"github.com/webappio/sanic/pkg/build"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	//statsRecentBuilds is how many of the latest builds of a service are compared against the ones before them
+	statsRecentBuilds = 3
+	//statsBaselineBuilds is how many builds before the recent ones they are compared against
+	statsBaselineBuilds = 10
+	//statsTrendBuilds is how many of the latest builds are shown in the trend
+	statsTrendBuilds = 12
+	//statsMinimumRegression is how much slower the recent builds of a service need to be to count as a regression,
+	//however large the percentage is, so that builds which take a few seconds are not flagged for noise
+	statsMinimumRegression = 5 * time.Second
+)
+
+//buildHistoryPath is where sanic build records how long each service took, see build.BuildHistory
+func buildHistoryPath(root string) string {
+	return filepath.Join(root, "logs", "build-history.json")
+}
+
+type serviceBuildStats struct {
+	Service         string    `json:"service"`
+	Builds          int       `json:"builds"`
+	LatestSeconds   float64   `json:"latestSeconds"`
+	RecentSeconds   float64   `json:"recentSeconds"`
+	BaselineSeconds float64   `json:"baselineSeconds,omitempty"`
+	ChangePercent   float64   `json:"changePercent,omitempty"`
+	Regression      bool      `json:"regression"`
+	Trend           []float64 `json:"trend"`
+}
+
+//computeBuildStats compares the median of the recent builds of a service to the median of the builds before them,
+//and flags it as a regression if it is more than threshold percent (and statsMinimumRegression) slower
+func computeBuildStats(service string, timings []build.BuildTiming, threshold float64) serviceBuildStats {
+	stats := serviceBuildStats{Service: service, Builds: len(timings)}
+	recentStart := len(timings) - statsRecentBuilds
+	if recentStart < 0 {
+		recentStart = 0
+	}
+	baselineStart := recentStart - statsBaselineBuilds
+	if baselineStart < 0 {
+		baselineStart = 0
+	}
+	recent := build.MedianDuration(timings[recentStart:])
+	stats.LatestSeconds = timings[len(timings)-1].Seconds
+	stats.RecentSeconds = recent.Seconds()
+	if recentStart > 0 {
+		baseline := build.MedianDuration(timings[baselineStart:recentStart])
+		stats.BaselineSeconds = baseline.Seconds()
+		if baseline > 0 {
+			stats.ChangePercent = 100 * (recent.Seconds() - baseline.Seconds()) / baseline.Seconds()
+		}
+		stats.Regression = stats.ChangePercent > threshold && recent-baseline >= statsMinimumRegression
+	}
+	trendStart := len(timings) - statsTrendBuilds
+	if trendStart < 0 {
+		trendStart = 0
+	}
+	for _, timing := range timings[trendStart:] {
+		stats.Trend = append(stats.Trend, timing.Seconds)
+	}
+	return stats
+}
+
+//sparkline draws a series of durations as bars, e.g., "▂▃▃▅█"
+func sparkline(values []float64) string {
+	bars := []rune("▁▂▃▄▅▆▇█")
+	if len(values) == 0 {
+		return ""
+	}
+	min, max := values[0], values[0]
+	for _, value := range values {
+		if value < min {
+			min = value
+		}
+		if value > max {
+			max = value
+		}
+	}
+	var line []rune
+	for _, value := range values {
+		bar := 0
+		if max > min {
+			bar = int((value - min) / (max - min) * float64(len(bars)-1))
+		}
+		line = append(line, bars[bar])
+	}
+	return string(line)
+}
+
+func formatSeconds(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+}
+
+func statsCommandAction(cliContext *cli.Context) error {
+	format := cliContext.String("format")
+	if format != "table" && format != "json" {
+		return cli.NewExitError(fmt.Sprintf("--format must be table or json, was: '%s'", format), 1)
+	}
+	root, err := projectRoot()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	history, err := build.LoadBuildHistory(buildHistoryPath(root))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("could not read the durations of previous builds: %s", err.Error()), 1)
+	}
+
+	services := []string(cliContext.Args())
+	if len(services) == 0 {
+		for service := range history.Services {
+			services = append(services, service)
+		}
+		sort.Strings(services)
+	}
+	if len(services) == 0 {
+		return cli.NewExitError("no builds have been recorded yet, run sanic build first", 1)
+	}
+
+	var allStats []serviceBuildStats
+	var regressions []string
+	for _, service := range services {
+		timings := history.Timings(service)
+		if len(timings) == 0 {
+			return cli.NewExitError(fmt.Sprintf("no builds of %s have been recorded", service), 1)
+		}
+		stats := computeBuildStats(service, timings, cliContext.Float64("threshold"))
+		allStats = append(allStats, stats)
+		if stats.Regression {
+			regressions = append(regressions, service)
+		}
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(allStats)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tBUILDS\tLATEST\tRECENT\tBEFORE\tCHANGE\tTREND\t")
+	for _, stats := range allStats {
+		before, change := "-", "-"
+		if stats.BaselineSeconds > 0 {
+			before = formatSeconds(stats.BaselineSeconds)
+			change = fmt.Sprintf("%+.0f%%", stats.ChangePercent)
+		}
+		trend := sparkline(stats.Trend)
+		if stats.Regression {
+			trend += " slower"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t\n",
+			stats.Service, stats.Builds, formatSeconds(stats.LatestSeconds), formatSeconds(stats.RecentSeconds),
+			before, change, trend)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(regressions) > 0 {
+		fmt.Fprintf(os.Stderr, "Recently got slower: %s\n", strings.Join(regressions, ", "))
+	}
+	return nil
+}
+
+var statsCommand = cli.Command{
+	Name:      "stats",
+	Usage:     "show how long the recent builds of some (or all, by default) services took compared to the ones before them, and which services got slower",
+	ArgsUsage: "[service...]",
+	Action:    statsCommandAction,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "table or json",
+			Value: "table",
+		},
+		cli.Float64Flag{
+			Name:  "threshold",
+			Usage: "how many percent slower the recent builds of a service need to be to count as slower",
+			Value: 25,
+		},
+	},
+}
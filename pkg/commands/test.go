@@ -0,0 +1,260 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/webappio/sanic/pkg/build"
+	"github.com/webappio/sanic/pkg/config"
+	"github.com/webappio/sanic/pkg/shell"
+	"github.com/webappio/sanic/pkg/util"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+//writeTestReport writes the JUnit XML report of sanic test to reportFile, or to logs/test-report.xml in buildRoot if
+//reportFile is empty
+func writeTestReport(report *build.Report, results []*build.TestResults, reportFile, buildRoot string) error {
+	if reportFile == "" {
+		reportFile = filepath.Join(buildRoot, "logs", "test-report.xml")
+	}
+	if err := os.MkdirAll(filepath.Dir(reportFile), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(reportFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return report.WriteTestJUnit(f, results)
+}
+
+//printTestResults prints a table of the result, exit code and test counts of every tested service
+func printTestResults(services []util.BuildableService, jobResults []build.JobResult, testResults map[string]*build.TestResults) {
+	statuses := make(map[string]build.JobResult)
+	for _, result := range jobResults {
+		statuses[result.Service] = result
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tRESULT\tEXIT CODE\tTESTS\tFAILED\tSKIPPED")
+	for _, service := range services {
+		result := statuses[service.Name]
+		status, exitCode := string(result.Status), "-"
+		switch {
+		case result.Status == build.JobSucceeded:
+			status, exitCode = "passed", "0"
+		case result.Status == build.JobFailed:
+			if testErr, ok := errors.Cause(result.Err).(*build.TestError); ok {
+				exitCode = fmt.Sprint(testErr.ExitCode)
+			}
+		case status == "":
+			status = "not run"
+		}
+		tests, failed, skipped := "-", "-", "-"
+		if results := testResults[service.Name]; results != nil && len(results.Files) > 0 {
+			tests, failed, skipped = fmt.Sprint(results.Tests), fmt.Sprint(results.Failures), fmt.Sprint(results.Skipped)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", service.Name, status, exitCode, tests, failed, skipped)
+	}
+	w.Flush()
+}
+
+func testCommandAction(cliContext *cli.Context) error {
+	plan, err := loadBuildPlan("")
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	buildRoot := plan.root
+
+	selected, err := plan.selectServices(cliContext.Args())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	builder := plan.builder("", false)
+	defer builder.Close()
+	builder.Provenance, err = plan.provenance(cliContext.App.Version)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("could not find the git commit of the services: %s", err.Error()), 1)
+	}
+	if s, err := shell.Current(); err == nil {
+		builder.Shell = s
+	}
+
+	var testedServices []util.BuildableService
+	for _, service := range selected {
+		if builder.HasTests(service) {
+			testedServices = append(testedServices, service)
+		}
+	}
+	if len(testedServices) == 0 {
+		return cli.NewExitError("none of the selected services has a testTarget or a testCommand in sanic.yaml", 1)
+	}
+	//the services that tested services are built from need to be built (or up to date) first
+	services := plan.withParents(testedServices)
+	isTested := make(map[string]bool)
+	for _, service := range testedServices {
+		isTested[service.Name] = true
+	}
+
+	if cliContext.Bool("fail-fast") && cliContext.Bool("keep-going") {
+		return cli.NewExitError("only one of --fail-fast and --keep-going can be specified", 1)
+	}
+
+	outputRoot := cliContext.String("output-dir")
+	if outputRoot == "" {
+		outputRoot = filepath.Join(buildRoot, "logs", "tests")
+	}
+
+	//without a sanic.yaml, the defaults of the build block are not filled in
+	logFormat, logHistory := plan.cfg.Build.LogFormat, plan.cfg.Build.LogHistory
+	if logFormat == "" {
+		logFormat = build.LogFormatText
+	}
+	if logHistory == 0 {
+		logHistory = config.DefaultLogHistory
+	}
+	runTree := "untracked"
+	if builder.Provenance.TreeHash != "" {
+		runTree = builder.Provenance.TreeHash
+	}
+	buildLogger := build.NewFlatfileLogger(filepath.Join(buildRoot, "logs"), build.NewBuildRunID(runTree),
+		logFormat, logHistory, cliContext.Bool("verbose"))
+	defer buildLogger.Close()
+
+	reportInterface := build.NewReportInterface(createBuildInterface(cliContext.Bool("plaintext"), buildLogger))
+	var buildInterface build.Interface = reportInterface
+	var closeInterface sync.Once
+	defer func() {
+		r := recover()
+		closeInterface.Do(buildInterface.Close)
+		if r != nil {
+			panic(r)
+		}
+	}()
+
+	buildLogger.AddLogLineListener(buildInterface.ProcessLog)
+
+	builder.Logger = buildLogger
+	builder.Interface = buildInterface
+	builder.NoCache = cliContext.Bool("no-cache")
+	builder.SkipUpToDate = plan.serviceTags != nil && !cliContext.Bool("force")
+
+	scheduler := build.Scheduler{
+		Graph:          plan.graph,
+		MaxParallelism: cliContext.Int("max-parallelism"),
+		Interface:      buildInterface,
+		FailFast:       cliContext.Bool("fail-fast"),
+	}
+
+	ctx, cancelTests := context.WithCancel(context.Background())
+	defer cancelTests()
+	buildInterface.AddCancelListener(cancelTests)
+	buildInterface.AddJobCancelListener(scheduler.CancelJob)
+
+	testJob := func(ctx context.Context, service util.BuildableService) error {
+		var err error
+		if isTested[service.Name] {
+			err = builder.TestService(ctx, service, filepath.Join(outputRoot, service.Name))
+		} else {
+			err = builder.BuildService(ctx, service)
+		}
+		if err != nil {
+			buildLogger.Log(service.Name, time.Now(), "Error: ", err.Error())
+		}
+		return err
+	}
+	//the results of services whose tests do not run (e.g., because a build failed) must not be left from a previous run
+	for _, service := range testedServices {
+		if err := os.RemoveAll(filepath.Join(outputRoot, service.Name)); err != nil {
+			return cli.NewExitError(fmt.Sprintf("could not remove the previous test output of %s: %s", service.Name, err.Error()), 1)
+		}
+	}
+	results := scheduler.Run(ctx, services, testJob)
+	userCancelled := ctx.Err() != nil
+	closeInterface.Do(buildInterface.InspectAndClose)
+
+	testResults := make(map[string]*build.TestResults)
+	var allTestResults []*build.TestResults
+	for _, service := range testedServices {
+		serviceResults, err := build.ReadTestResults(service.Name, filepath.Join(outputRoot, service.Name))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[WARNING] %s\n", err.Error())
+			continue
+		}
+		testResults[service.Name] = serviceResults
+		allTestResults = append(allTestResults, serviceResults)
+	}
+	err = writeTestReport(reportInterface.Report(buildLogger), allTestResults, cliContext.String("report-file"), buildRoot)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("could not write the test report: %s", err.Error()), 1)
+	}
+
+	if userCancelled {
+		fmt.Println() //clear the ^C
+	}
+	printTestResults(testedServices, results, testResults)
+
+	summary := build.SummarizeResults(results)
+	for _, line := range summary {
+		fmt.Fprintln(os.Stderr, line)
+	}
+	if len(summary) > 0 {
+		return cli.NewExitError("", 1)
+	}
+
+	return nil
+}
+
+var testCommand = cli.Command{
+	Name:      "test",
+	Usage:     "run the tests of some (or all, by default) services, in their testTarget stage or their image",
+	ArgsUsage: "[service name, glob (svc-*) or path (services/backend/...)...]",
+	Description: "Services with a testTarget in sanic.yaml have that Dockerfile stage built, and services with a " +
+		"testCommand have it run in their freshly built image. The files the tests write to " + build.TestOutputDir +
+		" are copied into logs/tests/<service>, and every JUnit XML file among them is merged into logs/test-report.xml.",
+	Action: testCommandAction,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:   "plaintext",
+			Usage:  "use a plaintext interface",
+			EnvVar: "PLAINTEXT_INTERFACE",
+		},
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "builds the images of services with a testCommand even if they are up to date",
+		},
+		cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "builds every step again, without using the local build cache or the environment's cacheFrom",
+		},
+		cli.BoolFlag{
+			Name:  "verbose",
+			Usage: "enables verbose logging, mostly for sanic development",
+		},
+		cli.IntFlag{
+			Name:  "max-parallelism,j",
+			Usage: "sets the maximum parallel builds and tests that will occur",
+		},
+		cli.BoolFlag{
+			Name:  "fail-fast",
+			Usage: "cancels every other build and test as soon as one service fails",
+		},
+		cli.BoolFlag{
+			Name:  "keep-going",
+			Usage: "keeps testing every other service when one fails (the default)",
+		},
+		cli.StringFlag{
+			Name:  "output-dir",
+			Usage: "where to copy the files the tests write, in a directory for each service (default: logs/tests)",
+		},
+		cli.StringFlag{
+			Name:  "report-file",
+			Usage: "where to write the JUnit XML report of the tests (default: logs/test-report.xml)",
+		},
+	},
+}
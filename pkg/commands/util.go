@@ -3,11 +3,16 @@ package commands
 import (
 	"errors"
 	"fmt"
+	"github.com/webappio/sanic/pkg/bridge/git"
+	"github.com/webappio/sanic/pkg/build"
 	"github.com/webappio/sanic/pkg/config"
 	"github.com/webappio/sanic/pkg/provisioners"
 	"github.com/webappio/sanic/pkg/provisioners/provisioner"
 	"github.com/webappio/sanic/pkg/shell"
+	"github.com/webappio/sanic/pkg/util"
 	"github.com/urfave/cli"
+	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -22,6 +27,14 @@ func newUsageError(ctx *cli.Context) error {
 		1)
 }
 
+//projectRoot returns the root of the current sanic environment, or the current directory outside of one
+func projectRoot() (string, error) {
+	if s, err := shell.Current(); err == nil {
+		return s.GetSanicRoot(), nil
+	}
+	return os.Getwd()
+}
+
 func getProvisioner() (provisioner.Provisioner, error) {
 	s, err := shell.Current()
 	if err != nil {
@@ -38,8 +51,13 @@ func getProvisioner() (provisioner.Provisioner, error) {
 		return nil, err
 	}
 
+	return environmentProvisioner(s.GetSanicEnvironment(), env)
+}
+
+//environmentProvisioner returns the provisioner of the given environment (which does not need to be the current one)
+func environmentProvisioner(envName string, env *config.Environment) (provisioner.Provisioner, error) {
 	if env.ClusterProvisioner == "" {
-		return nil, errors.New("the environment " + s.GetSanicEnvironment() +
+		return nil, errors.New("the environment " + envName +
 			" does not have a 'clusterProvisioner' key defined in it. Try clusterProvisioner: localdev to start.")
 	}
 	return provisioners.GetProvisioner(env.ClusterProvisioner, env.ClusterProvisionerArgs), nil
@@ -84,3 +102,53 @@ func getNamespaceFromEnv() (string, error) {
 
 	return env.Namespace, nil
 }
+
+//selectServices filters services down to the ones named by selectors (see util.SelectServices)
+//if no selectors are given, every service is returned
+func selectServices(buildRoot string, services []util.BuildableService, selectors []string) ([]util.BuildableService, error) {
+	if len(selectors) == 0 {
+		return services, nil
+	}
+	selected, unmatched := util.SelectServices(buildRoot, services, selectors)
+	if len(unmatched) > 0 {
+		var serviceNames []string
+		seenNames := make(map[string]bool)
+		for _, service := range services {
+			if !seenNames[service.Name] {
+				seenNames[service.Name] = true
+				serviceNames = append(serviceNames, service.Name)
+			}
+		}
+		return nil, fmt.Errorf("service %s was not found in %s. Did you mean one of [%s]?",
+			unmatched[0],
+			buildRoot,
+			strings.Join(mostSimilarStrings(serviceNames, unmatched[0], 6), "|"),
+		)
+	}
+	return selected, nil
+}
+
+//serviceBuildConfigs returns the build configuration of each service in the given environment (which can be nil),
+//with their Contexts made absolute
+func serviceBuildConfigs(cfg *config.SanicConfig, env *config.Environment, buildRoot string, services []util.BuildableService) map[string]config.ServiceBuild {
+	serviceConfigs := make(map[string]config.ServiceBuild)
+	for _, service := range services {
+		serviceConfig := cfg.ServiceBuild(env, service.Name)
+		if serviceConfig.Context != "" {
+			serviceConfig.Context = filepath.Join(buildRoot, serviceConfig.Context)
+		}
+		serviceConfigs[service.Name] = serviceConfig
+	}
+	return serviceConfigs
+}
+
+//serviceContentTags returns the content hash of each service (see build.ContentHashes) to use as its tag.
+//It returns nil (and prints a warning) if the project is not in a git repository with at least one commit.
+func serviceContentTags(buildRoot, envName string, services []util.BuildableService, graph *build.Graph, serviceConfigs map[string]config.ServiceBuild) (map[string]string, error) {
+	tags, err := build.ContentHashes(buildRoot, envName, services, graph, serviceConfigs)
+	if err == git.ErrNotGitRepository || err == git.ErrNoCommits {
+		fmt.Fprintf(os.Stderr, "[WARNING] could not compute a tag for each service, every service will be built: %s\n", err.Error())
+		return nil, nil
+	}
+	return tags, err
+}
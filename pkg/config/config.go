@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"github.com/webappio/sanic/pkg/provisioners"
 	"github.com/webappio/sanic/pkg/shell"
+	"github.com/webappio/sanic/pkg/util"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -27,6 +30,86 @@ type Environment struct {
 	ClusterProvisioner     string            `yaml:"clusterProvisioner"`
 	ClusterProvisionerArgs map[string]string `yaml:"clusterProvisionerArgs"`
 	Namespace              string
+	Build                  EnvironmentBuild
+	RegistryAuth           RegistryAuth `yaml:"registryAuth"`
+}
+
+//RegistryAuth configures the credentials for an environment's registry, which are otherwise whatever "docker login"
+//has stored. At most one of DockerConfig, CredentialHelper, TokenEnv or PasswordFile can be set.
+type RegistryAuth struct {
+	//DockerConfig is the path to a docker config.json with credentials for the registry
+	DockerConfig string `yaml:"dockerConfig"`
+	//CredentialHelper is the name of a docker credential helper, e.g., ecr-login for docker-credential-ecr-login
+	CredentialHelper string `yaml:"credentialHelper"`
+	//TokenEnv is the name of an environment variable with a token for the registry.
+	//It is used as the password if Username is set, otherwise it is sent to the registry as a bearer token.
+	TokenEnv string `yaml:"tokenEnv"`
+	//Username is the username for PasswordFile or TokenEnv
+	Username string
+	//PasswordFile is the path to a file with the password for Username
+	PasswordFile string `yaml:"passwordFile"`
+	//ImagePullSecret is the name of an image pull secret to create from the credentials during "sanic deploy",
+	//which the namespace's default service account is set up to use
+	ImagePullSecret string `yaml:"imagePullSecret"`
+}
+
+//validate checks that the registry authentication does not configure conflicting sources of credentials
+func (auth RegistryAuth) validate() error {
+	var sources []string
+	for _, source := range []struct{ key, value string }{
+		{"dockerConfig", auth.DockerConfig},
+		{"credentialHelper", auth.CredentialHelper},
+		{"tokenEnv", auth.TokenEnv},
+		{"passwordFile", auth.PasswordFile},
+	} {
+		if source.value != "" {
+			sources = append(sources, source.key)
+		}
+	}
+	if len(sources) > 1 {
+		return fmt.Errorf("only one of %s can be set", strings.Join(sources, ", "))
+	}
+	if auth.PasswordFile != "" && auth.Username == "" {
+		return errors.New("passwordFile needs a username")
+	}
+	if auth.Username != "" && auth.PasswordFile == "" && auth.TokenEnv == "" {
+		return errors.New("username needs a passwordFile or tokenEnv")
+	}
+	if auth.ImagePullSecret != "" && len(sources) == 0 {
+		return errors.New("imagePullSecret needs credentials to create the secret from")
+	}
+	return nil
+}
+
+//IsSet returns whether any credentials are configured
+func (auth RegistryAuth) IsSet() bool {
+	return auth.DockerConfig != "" || auth.CredentialHelper != "" || auth.TokenEnv != "" || auth.PasswordFile != ""
+}
+
+//EnvironmentBuild handles build options which are specific to one environment
+type EnvironmentBuild struct {
+	//Backend can be one of:
+	// - docker (the default), which runs "docker build",
+	// - buildkit, which sends builds directly to a buildkitd daemon (falling back to docker if it cannot be reached),
+	// - podman, which runs "podman build" (e.g., for rootless workstations), or
+	// - kaniko, which runs builds as jobs in the environment's cluster, and can only push the images it builds
+	Backend string
+	//BuildkitAddr is the address of the buildkitd daemon, e.g., tcp://buildkitd:1234
+	//if it is empty, $BUILDKIT_HOST (or buildkit's default socket) is used
+	BuildkitAddr string `yaml:"buildkitAddr"`
+	//Platforms are the platforms (e.g., linux/amd64, linux/arm64) to build every service for in this environment,
+	//unless a service sets its own. If there is more than one, a multi-platform image is pushed.
+	Platforms []string
+	//CacheFrom is where builds import their layer cache from (see BuildCacheModes), or empty to only use the local cache:
+	// - inline, the cache which was pushed inside the images, or
+	// - registry, the cache which was pushed next to the images with cacheTo: registry
+	CacheFrom string `yaml:"cacheFrom"`
+	//CacheTo is where builds (with --push) export their layer cache to, or empty to not export it:
+	// - inline, inside the images (only the layers of the final stage), or
+	// - registry, as a separate cache image next to the images (every layer of every stage)
+	CacheTo string `yaml:"cacheTo"`
+	//Services overrides the global build.services block for this environment, keyed by service name
+	Services map[string]ServiceBuild
 }
 
 //Deploy handles configuration options for templating & saving the built kubernetes .yamls
@@ -35,8 +118,175 @@ type Deploy struct {
 	TemplaterImage string `yaml:"templaterImage"`
 }
 
+//Build handles configuration options for finding and building services
 type Build struct {
 	IgnoreDirs []string `yaml:"ignoreDirs"`
+	//LogHistory is how many runs of sanic build keep their logs in logs/builds, 20 by default
+	LogHistory int `yaml:"logHistory"`
+	//LogFormat is the format of the build logs (see LogFormats): text (the default) or json, i.e., JSON lines with
+	//the time, service and stream of every line
+	LogFormat string `yaml:"logFormat"`
+	//Services configures how specific services are built, keyed by service name
+	Services map[string]ServiceBuild
+}
+
+//ServiceBuild configures how a single service is built.
+//Every key can be overridden by an environment's build.services block.
+type ServiceBuild struct {
+	//Args are build args (in addition to SANIC_ENV and CI).
+	//An arg without a value (e.g., "NPM_TOKEN:") is passed through from the environment.
+	Args map[string]*string
+	//Target is the Dockerfile stage to build
+	Target string
+	//Context is the build context directory, relative to the directory that contains sanic.yaml.
+	//If it is empty, the directory that contains the Dockerfile is used.
+	Context string
+	//Tags are extra tags (e.g., "latest") to add to the image, in addition to the build tag
+	Tags []string
+	//Labels are extra labels to add to the image
+	Labels map[string]string
+	//Network is the network mode for RUN instructions, e.g., host or none
+	Network string
+	//Disabled services are never built
+	Disabled *bool
+	//Platforms are the platforms to build the service for, e.g., linux/amd64 and linux/arm64.
+	//If it is empty, the environment's platforms are used, or the platform of the machine that builds it.
+	Platforms []string
+	//MaxImageSize is the size that the image is not allowed to grow past, e.g., 500MB (see ParseByteSize)
+	MaxImageSize string `yaml:"maxImageSize"`
+	//MaxImageGrowth is how many percent larger than at its last build the image is allowed to get
+	MaxImageGrowth *float64 `yaml:"maxImageGrowth"`
+	//ImageSizeAction is what happens when the image is over MaxImageSize or MaxImageGrowth (see ImageSizeActions):
+	//fail (the default) fails the build, and warn only logs a warning
+	ImageSizeAction string `yaml:"imageSizeAction"`
+	//Hooks are shell commands which run around the build of the service
+	Hooks BuildHooks
+	//TestTarget is the Dockerfile stage which sanic test builds to run the tests of the service.
+	//The stage should write its results (e.g., JUnit XML reports) to /test-output. To collect them even when the tests
+	//fail, it can write their exit code to /test-output/exit-code instead of failing.
+	TestTarget string `yaml:"testTarget"`
+	//TestCommand is the shell command which sanic test runs in the built image of the service (if it has no
+	//TestTarget). It should write its results to the directory in $TEST_OUTPUT.
+	TestCommand string `yaml:"testCommand"`
+}
+
+//BuildHooks are shell commands which run in the directory of a service (through the sanic shell) when it is built,
+//but not when its image is up to date (which it never is with a PreBuild hook)
+type BuildHooks struct {
+	//PreBuild runs before the image is built, e.g., to generate code or compile assets
+	PreBuild string `yaml:"preBuild"`
+	//PostBuild runs after the image is built, e.g., to smoke test it
+	PostBuild string `yaml:"postBuild"`
+}
+
+//IsDisabled returns whether the service should not be built
+func (serviceBuild ServiceBuild) IsDisabled() bool {
+	return serviceBuild.Disabled != nil && *serviceBuild.Disabled
+}
+
+//merge returns a copy of serviceBuild with every key that is set in override replaced.
+//Args and Labels are merged key by key.
+func (serviceBuild ServiceBuild) merge(override ServiceBuild) ServiceBuild {
+	merged := serviceBuild
+	merged.Args = make(map[string]*string)
+	for k, v := range serviceBuild.Args {
+		merged.Args[k] = v
+	}
+	for k, v := range override.Args {
+		merged.Args[k] = v
+	}
+	merged.Labels = make(map[string]string)
+	for k, v := range serviceBuild.Labels {
+		merged.Labels[k] = v
+	}
+	for k, v := range override.Labels {
+		merged.Labels[k] = v
+	}
+	if override.Target != "" {
+		merged.Target = override.Target
+	}
+	if override.Context != "" {
+		merged.Context = override.Context
+	}
+	if override.Tags != nil {
+		merged.Tags = override.Tags
+	}
+	if override.Network != "" {
+		merged.Network = override.Network
+	}
+	if override.Disabled != nil {
+		merged.Disabled = override.Disabled
+	}
+	if override.Platforms != nil {
+		merged.Platforms = override.Platforms
+	}
+	if override.MaxImageSize != "" {
+		merged.MaxImageSize = override.MaxImageSize
+	}
+	if override.MaxImageGrowth != nil {
+		merged.MaxImageGrowth = override.MaxImageGrowth
+	}
+	if override.ImageSizeAction != "" {
+		merged.ImageSizeAction = override.ImageSizeAction
+	}
+	if override.Hooks.PreBuild != "" {
+		merged.Hooks.PreBuild = override.Hooks.PreBuild
+	}
+	if override.Hooks.PostBuild != "" {
+		merged.Hooks.PostBuild = override.Hooks.PostBuild
+	}
+	if override.TestTarget != "" {
+		merged.TestTarget = override.TestTarget
+	}
+	if override.TestCommand != "" {
+		merged.TestCommand = override.TestCommand
+	}
+	return merged
+}
+
+//validate checks the keys of the service's build configuration which have a fixed format
+func (serviceBuild ServiceBuild) validate() error {
+	if serviceBuild.MaxImageSize != "" {
+		if _, err := ParseByteSize(serviceBuild.MaxImageSize); err != nil {
+			return fmt.Errorf("maxImageSize: %s", err.Error())
+		}
+	}
+	if serviceBuild.MaxImageGrowth != nil && *serviceBuild.MaxImageGrowth < 0 {
+		return fmt.Errorf("maxImageGrowth must be a positive percentage, was: %g", *serviceBuild.MaxImageGrowth)
+	}
+	if serviceBuild.ImageSizeAction != "" && !util.StringInSlice(serviceBuild.ImageSizeAction, ImageSizeActions) {
+		return fmt.Errorf("imageSizeAction must be one of %s or omitted, was: '%s'",
+			strings.Join(ImageSizeActions, ", "), serviceBuild.ImageSizeAction)
+	}
+	return nil
+}
+
+//The values of the imageSizeAction key in a service's build configuration
+const (
+	//ImageSizeFail fails the build of an image which is over its size budget
+	ImageSizeFail = "fail"
+	//ImageSizeWarn only logs a warning for an image which is over its size budget
+	ImageSizeWarn = "warn"
+)
+
+//ImageSizeActions are the possible values for the imageSizeAction key in a service's build configuration
+var ImageSizeActions = []string{ImageSizeFail, ImageSizeWarn}
+
+var byteSizeRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([KMGT]?)(I?B)?$`)
+
+//ParseByteSize parses a size like 500MB, 1.5GB or 2GiB into bytes. The units are powers of 1024 (whether or not
+//they have an i), the same as the sizes sanic prints. A number without a unit is in bytes.
+func ParseByteSize(size string) (int64, error) {
+	match := byteSizeRegexp.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(size)))
+	if match == nil {
+		return 0, fmt.Errorf("'%s' is not a size, e.g., 500MB or 2GB", size)
+	}
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	units := map[string]float64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	return int64(value * units[match[2]]), nil
 }
 
 //SanicConfig is the global structure of entries in sanic.yaml
@@ -47,6 +297,25 @@ type SanicConfig struct {
 	Build        Build
 }
 
+//BuildBackends are the possible values for the backend key in an environment's build block
+var BuildBackends = []string{"docker", "buildkit", "podman", "kaniko"}
+
+const (
+	//CacheInline stores the build cache inside the pushed images
+	CacheInline = "inline"
+	//CacheRegistry stores the build cache as its own image in the registry
+	CacheRegistry = "registry"
+)
+
+//BuildCacheModes are the possible values for the cacheFrom and cacheTo keys in an environment's build block
+var BuildCacheModes = []string{CacheInline, CacheRegistry}
+
+//LogFormats are the possible values for the logFormat key in the build block
+var LogFormats = []string{"text", "json"}
+
+//DefaultLogHistory is how many builds keep their logs if the build block does not set logHistory
+const DefaultLogHistory = 20
+
 //ReadFromPath returns a new SanicConfig from the given filesystem path to a yaml file
 func ReadFromPath(configPath string) (SanicConfig, error) {
 	data, err := ioutil.ReadFile(configPath)
@@ -70,6 +339,60 @@ func ReadFromPath(configPath string) (SanicConfig, error) {
 					env.ClusterProvisioner)
 			}
 		}
+		if env.Build.Backend != "" && !util.StringInSlice(env.Build.Backend, BuildBackends) {
+			return SanicConfig{}, fmt.Errorf(
+				"configuration file error: environment %s's build backend must be one of %s or omitted, was: '%s'",
+				envName,
+				strings.Join(BuildBackends, ", "),
+				env.Build.Backend)
+		}
+		for _, cache := range []struct{ key, value string }{{"cacheFrom", env.Build.CacheFrom}, {"cacheTo", env.Build.CacheTo}} {
+			if cache.value != "" && !util.StringInSlice(cache.value, BuildCacheModes) {
+				return SanicConfig{}, fmt.Errorf(
+					"configuration file error: environment %s's build %s must be one of %s or omitted, was: '%s'",
+					envName,
+					cache.key,
+					strings.Join(BuildCacheModes, ", "),
+					cache.value)
+			}
+		}
+		if (env.Build.Backend == "podman" || env.Build.Backend == "kaniko") &&
+			(env.Build.CacheFrom == CacheInline || env.Build.CacheTo == CacheInline) {
+			return SanicConfig{}, fmt.Errorf(
+				"configuration file error: environment %s's build backend %s only supports the registry cache, not inline",
+				envName,
+				env.Build.Backend)
+		}
+		for service, serviceBuild := range env.Build.Services {
+			if err := serviceBuild.validate(); err != nil {
+				return SanicConfig{}, fmt.Errorf("configuration file error: environment %s's build of %s: %s", envName, service, err.Error())
+			}
+		}
+		if err := env.RegistryAuth.validate(); err != nil {
+			return SanicConfig{}, fmt.Errorf("configuration file error: environment %s's registryAuth: %s", envName, err.Error())
+		}
+	}
+	for service, serviceBuild := range cfg.Build.Services {
+		if err := serviceBuild.validate(); err != nil {
+			return SanicConfig{}, fmt.Errorf("configuration file error: build of %s: %s", service, err.Error())
+		}
+	}
+	if cfg.Build.LogFormat != "" && !util.StringInSlice(cfg.Build.LogFormat, LogFormats) {
+		return SanicConfig{}, fmt.Errorf(
+			"configuration file error: build logFormat must be one of %s or omitted, was: '%s'",
+			strings.Join(LogFormats, ", "),
+			cfg.Build.LogFormat)
+	}
+	if cfg.Build.LogHistory < 0 {
+		return SanicConfig{}, fmt.Errorf(
+			"configuration file error: build logHistory must be at least 1 or omitted, was: %d",
+			cfg.Build.LogHistory)
+	}
+	if cfg.Build.LogHistory == 0 {
+		cfg.Build.LogHistory = DefaultLogHistory
+	}
+	if cfg.Build.LogFormat == "" {
+		cfg.Build.LogFormat = "text"
 	}
 	if cfg.Deploy.Folder == "" {
 		cfg.Deploy.Folder = "deploy"
@@ -90,6 +413,20 @@ func Read() (SanicConfig, error) {
 	return ReadFromPath(configPath)
 }
 
+//ServiceBuild returns the build configuration for the given service in the given environment,
+//i.e., the global build.services entry for it, overridden by the environment's (if env is not nil).
+//If neither sets the service's platforms, it gets the environment's.
+func (cfg *SanicConfig) ServiceBuild(env *Environment, service string) ServiceBuild {
+	serviceBuild := ServiceBuild{}.merge(cfg.Build.Services[service])
+	if env != nil {
+		serviceBuild = serviceBuild.merge(env.Build.Services[service])
+		if serviceBuild.Platforms == nil {
+			serviceBuild.Platforms = env.Build.Platforms
+		}
+	}
+	return serviceBuild
+}
+
 //HasEnvironment returns the configuration has a given environment defined
 func (cfg *SanicConfig) HasEnvironment(env string) bool {
 	_, exists := cfg.Environments[env]
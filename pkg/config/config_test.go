@@ -0,0 +1,42 @@
+package config
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		size  string
+		bytes int64
+		err   bool
+	}{
+		{size: "0", bytes: 0},
+		{size: "1024", bytes: 1024},
+		{size: "10B", bytes: 10},
+		{size: "500KB", bytes: 500 << 10},
+		{size: "500MB", bytes: 500 << 20},
+		{size: "500MiB", bytes: 500 << 20},
+		{size: "500M", bytes: 500 << 20},
+		{size: "1.5GB", bytes: 3 << 29},
+		{size: "2gib", bytes: 2 << 30},
+		{size: " 1 TB ", bytes: 1 << 40},
+		{size: "", err: true},
+		{size: "-1GB", err: true},
+		{size: "1PB", err: true},
+		{size: "GB", err: true},
+		{size: "1.GB", err: true},
+		{size: "one GB", err: true},
+	}
+	for _, test := range tests {
+		bytes, err := ParseByteSize(test.size)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseByteSize(%q) is %d, want an error", test.size, bytes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseByteSize(%q): %s", test.size, err)
+		} else if bytes != test.bytes {
+			t.Errorf("ParseByteSize(%q) is %d, want %d", test.size, bytes, test.bytes)
+		}
+	}
+}
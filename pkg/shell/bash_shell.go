@@ -137,14 +137,21 @@ func (shell *BashShell) Exec(requestedCommand []string) (errorCode int, err erro
 	return
 }
 
+//ShellCommand : create the command for the given shell command (i.e., including spaces) in the given environment,
+//which runs in dir
+func (shell *BashShell) ShellCommand(dir string, requestedCommand string, args []string) *exec.Cmd {
+	cmd := exec.Command(shell.Path, append([]string{"-c", requestedCommand, "dummy"}, args...)...)
+	cmd.Env = append(os.Environ(), extraShellEnvironmentVars(shell)...)
+	cmd.Dir = dir
+	return cmd
+}
+
 //ShellExec : execute the given shell command (i.e., including spaces) in the given environment
 func (shell *BashShell) ShellExec(requestedCommand string, args []string) (errorCode int, err error) {
-	cmd := exec.Command(shell.Path, append([]string{"-c", requestedCommand, "dummy"}, args...)...)
+	cmd := shell.ShellCommand(shell.sanicRoot, requestedCommand, args)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
-	cmd.Env = append(os.Environ(), extraShellEnvironmentVars(shell)...)
-	cmd.Dir = shell.sanicRoot
 	err = cmd.Start()
 	if err != nil {
 		errorCode = 1
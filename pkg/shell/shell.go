@@ -23,6 +23,10 @@ type Shell interface {
 	//Execute the given command in "Shell mode", i.e., allowing spaces
 	ShellExec(requestedCommand string, args []string) (errorCode int, err error)
 
+	//Create (but do not start) a command which runs the given command in "Shell mode" in dir, for the caller to
+	//connect its input and output
+	ShellCommand(dir string, requestedCommand string, args []string) *exec.Cmd
+
 	//If "sanic env dev", return "dev"
 	GetSanicEnvironment() string
 
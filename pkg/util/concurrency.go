@@ -13,8 +13,8 @@ func RunContextuallyInParallel(ctx context.Context, funcs ...func(context.Contex
 		ctx = context.Background()
 	}
 	eg, ctx := errgroup.WithContext(ctx)
-	errGroupWait := make(chan error)
-	errGroupErrors := make(chan error)
+	errGroupWait := make(chan error, 1)
+	errGroupErrors := make(chan error, len(funcs)) //buffered, so that later errors do not block forever once one has been returned
 	for _, f := range funcs {
 		finalF := f
 		eg.Go(func() error {
@@ -36,18 +36,18 @@ func RunContextuallyInParallel(ctx context.Context, funcs ...func(context.Contex
 
 //WaitCmdContextually waits for a given exec.Cmd "in" the given context.  There are two cases:
 // 1. If the command finishes before the context is finished, the result of cmd.Run is returned
-// 2. If the context is cancelled before the command finishes, the command's process is killed forcefully
-//    and this method returns immediately.
+// 2. If the context is cancelled before the command finishes, the command's process (or its process group, see
+//    SetProcessGroup) is killed forcefully and this method returns the context's error immediately.
 func WaitCmdContextually(ctx context.Context, cmd *exec.Cmd) error {
-	cmdDone := make(chan error)
+	cmdDone := make(chan error, 1)
 	go func() { cmdDone <- cmd.Wait() }()
 	select {
 	case err := <-cmdDone:
 		return err
 	case <-ctx.Done():
 		if cmd.Process != nil {
-			return cmd.Process.Kill()
+			killProcess(cmd)
 		}
-		return nil
+		return ctx.Err()
 	}
 }
@@ -0,0 +1,199 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var dockerfileVariableRegexp = regexp.MustCompile(`\$\{?([a-zA-Z_][a-zA-Z0-9_]*)(:-[^}]*)?\}?`)
+
+//dockerfileInstruction is an instruction of a Dockerfile, with line continuations joined and comments removed
+type dockerfileInstruction struct {
+	text string
+	//lines are the lines of the Dockerfile which make up the instruction, as they are (including any comments before it)
+	lines []string
+}
+
+//dockerfileInstructions reads a Dockerfile and returns its instructions. The lines after the last instruction
+//(e.g., comments) are returned as an instruction without text.
+func dockerfileInstructions(dockerfilePath string) ([]dockerfileInstruction, error) {
+	f, err := os.Open(dockerfilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var instructions []dockerfileInstruction
+	var curr strings.Builder
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasSuffix(line, "\\") {
+			curr.WriteString(strings.TrimSuffix(line, "\\"))
+			curr.WriteString(" ")
+			continue
+		}
+		curr.WriteString(line)
+		if instruction := strings.TrimSpace(curr.String()); instruction != "" {
+			instructions = append(instructions, dockerfileInstruction{text: instruction, lines: lines})
+			lines = nil
+		}
+		curr.Reset()
+	}
+	if instruction := strings.TrimSpace(curr.String()); instruction != "" || len(lines) > 0 {
+		instructions = append(instructions, dockerfileInstruction{text: instruction, lines: lines})
+	}
+	return instructions, scanner.Err()
+}
+
+//expandDockerfileArgs substitutes $VAR, ${VAR} and ${VAR:-default} using the given ARG defaults
+func expandDockerfileArgs(s string, args map[string]string) string {
+	return dockerfileVariableRegexp.ReplaceAllStringFunc(s, func(match string) string {
+		parts := dockerfileVariableRegexp.FindStringSubmatch(match)
+		if value, ok := args[parts[1]]; ok && value != "" {
+			return value
+		}
+		return strings.TrimPrefix(parts[2], ":-")
+	})
+}
+
+//dockerfileImage is an image that an instruction of a Dockerfile refers to
+type dockerfileImage struct {
+	instruction int
+	field       int    //the index of the field of the instruction (split with strings.Fields) with the image
+	prefix      string //what comes before the image in the field, e.g., --from=
+	image       string //with the ARGs substituted
+}
+
+//dockerfileImages finds the images in the FROM lines and COPY --from flags of the instructions of a Dockerfile,
+//excluding references to its own build stages and "scratch".
+//ARGs declared before the first FROM are substituted with their default values.
+func dockerfileImages(instructions []dockerfileInstruction) []dockerfileImage {
+	globalArgs := make(map[string]string)
+	stages := make(map[string]bool)
+	seenFrom := false
+	var images []dockerfileImage
+
+	addImage := func(instruction, field int, prefix, image string) {
+		image = expandDockerfileArgs(image, globalArgs)
+		if image == "" || image == "scratch" || stages[strings.ToLower(image)] {
+			return
+		}
+		if _, err := strconv.Atoi(image); err == nil {
+			return //COPY --from=0 refers to a stage index
+		}
+		images = append(images, dockerfileImage{instruction: instruction, field: field, prefix: prefix, image: image})
+	}
+
+	for i, instruction := range instructions {
+		fields := strings.Fields(instruction.text)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "ARG":
+			if seenFrom {
+				continue
+			}
+			for _, arg := range fields[1:] {
+				kv := strings.SplitN(arg, "=", 2)
+				if len(kv) == 2 {
+					globalArgs[kv[0]] = strings.Trim(kv[1], `"'`)
+				} else {
+					globalArgs[kv[0]] = os.Getenv(kv[0])
+				}
+			}
+		case "FROM":
+			seenFrom = true
+			var args []int
+			for j, field := range fields[1:] {
+				if !strings.HasPrefix(field, "--") {
+					args = append(args, j+1)
+				}
+			}
+			if len(args) == 0 {
+				continue
+			}
+			addImage(i, args[0], "", fields[args[0]])
+			if len(args) == 3 && strings.EqualFold(fields[args[1]], "as") {
+				stages[strings.ToLower(fields[args[2]])] = true
+			}
+		case "COPY":
+			for j, field := range fields[1:] {
+				if strings.HasPrefix(field, "--from=") {
+					addImage(i, j+1, "--from=", strings.TrimPrefix(field, "--from="))
+				}
+			}
+		}
+	}
+	return images
+}
+
+//DockerfileImageReferences returns the images a Dockerfile depends on, i.e., the images in its FROM lines
+//and COPY --from flags, excluding references to its own build stages and "scratch".
+//ARGs declared before the first FROM are substituted with their default values.
+func DockerfileImageReferences(dockerfilePath string) ([]string, error) {
+	instructions, err := dockerfileInstructions(dockerfilePath)
+	if err != nil {
+		return nil, err
+	}
+	seenImages := make(map[string]bool)
+	var images []string
+	for _, image := range dockerfileImages(instructions) {
+		if !seenImages[image.image] {
+			seenImages[image.image] = true
+			images = append(images, image.image)
+		}
+	}
+	return images, nil
+}
+
+//RewriteDockerfileImages returns the contents of a Dockerfile with the images it depends on (see
+//DockerfileImageReferences) replaced, where rewrite returns true for them. The instructions with a replaced image
+//are written on a single line, everything else is kept as it is.
+func RewriteDockerfileImages(dockerfilePath string, rewrite func(image string) (string, bool)) ([]byte, error) {
+	instructions, err := dockerfileInstructions(dockerfilePath)
+	if err != nil {
+		return nil, err
+	}
+	rewritten := make(map[int][]string)
+	for _, image := range dockerfileImages(instructions) {
+		newImage, ok := rewrite(image.image)
+		if !ok {
+			continue
+		}
+		fields, ok := rewritten[image.instruction]
+		if !ok {
+			fields = strings.Fields(instructions[image.instruction].text)
+			rewritten[image.instruction] = fields
+		}
+		fields[image.field] = image.prefix + newImage
+	}
+
+	var out bytes.Buffer
+	for i, instruction := range instructions {
+		if fields, ok := rewritten[i]; ok {
+			//the comments are kept, since they can be parser directives, e.g., # syntax=docker/dockerfile:1
+			for _, line := range instruction.lines {
+				if strings.HasPrefix(strings.TrimSpace(line), "#") {
+					out.WriteString(line + "\n")
+				}
+			}
+			out.WriteString(strings.Join(fields, " ") + "\n")
+			continue
+		}
+		for _, line := range instruction.lines {
+			out.WriteString(line + "\n")
+		}
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,73 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDockerfileImageReferences(t *testing.T) {
+	os.Setenv("SANIC_TEST_BASE", "from-env")
+	defer os.Unsetenv("SANIC_TEST_BASE")
+	tests := []struct {
+		name       string
+		dockerfile string
+		images     []string
+	}{
+		{name: "single from", dockerfile: "FROM alpine:3.18\nRUN true\n", images: []string{"alpine:3.18"}},
+		{name: "platform flag", dockerfile: "FROM --platform=$BUILDPLATFORM golang AS build\n", images: []string{"golang"}},
+		{
+			name:       "stages are not images",
+			dockerfile: "FROM golang AS Build\nFROM build AS test\nFROM scratch\nCOPY --from=build /out /\nCOPY --from=0 /a /b\n",
+			images:     []string{"golang"},
+		},
+		{
+			name:       "copy from an image",
+			dockerfile: "FROM alpine\nCOPY --chown=1:1 --from=assets:latest /static /static\n",
+			images:     []string{"alpine", "assets:latest"},
+		},
+		{name: "duplicates", dockerfile: "FROM alpine AS a\nFROM alpine AS b\n", images: []string{"alpine"}},
+		{
+			name:       "global args",
+			dockerfile: "ARG BASE=python-base\nARG TAG\nARG SANIC_TEST_BASE\nFROM ${BASE}:${TAG:-3}\nFROM $SANIC_TEST_BASE\n",
+			images:     []string{"python-base:3", "from-env"},
+		},
+		{
+			name:       "args after from are not global",
+			dockerfile: "FROM alpine\nARG OTHER=debian\nFROM ${OTHER:-ubuntu}\n",
+			images:     []string{"alpine", "ubuntu"},
+		},
+		{
+			name:       "comments and continuations",
+			dockerfile: "# FROM commented\nFROM \\\n  --platform=linux/amd64 \\\n  node:20\n",
+			images:     []string{"node:20"},
+		},
+		{name: "lowercase instructions", dockerfile: "from alpine as base\ncopy --from=base / /\n", images: []string{"alpine"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sanic-dockerfile-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "Dockerfile")
+			if err := ioutil.WriteFile(path, []byte(test.dockerfile), 0644); err != nil {
+				t.Fatal(err)
+			}
+			images, err := DockerfileImageReferences(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(images, test.images) {
+				t.Errorf("got %q, want %q", images, test.images)
+			}
+		})
+	}
+
+	if _, err := DockerfileImageReferences(filepath.Join(os.TempDir(), "sanic-no-such-dockerfile")); err == nil {
+		t.Error("expected an error for a missing Dockerfile")
+	}
+}
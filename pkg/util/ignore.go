@@ -0,0 +1,176 @@
+package util
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+//ignorePattern is a single line of a .gitignore-style file
+type ignorePattern struct {
+	regexp  *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	//base is the directory (relative to the search root, using /) that the pattern is relative to
+	base string
+}
+
+//ignoreFileNames are the files in each directory whose patterns are ignored, like a .gitignore
+var ignoreFileNames = []string{".gitignore", ".sanicignore"}
+
+//IgnoreMatcher matches paths against a list of .gitignore-style patterns. The last matching pattern wins,
+//so a pattern starting with ! can re-include a path ignored by an earlier pattern.
+type IgnoreMatcher struct {
+	patterns []ignorePattern
+}
+
+//compileIgnorePattern converts a .gitignore glob (without a leading !, or a trailing /) to a regular expression
+//See https://git-scm.com/docs/gitignore#_pattern_format
+func compileIgnorePattern(pattern string) (*regexp.Regexp, error) {
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var re strings.Builder
+	re.WriteString("^")
+	if !anchored {
+		re.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+			re.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				re.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			re.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+//WithPatterns returns a new IgnoreMatcher with the given patterns added after this one's.
+//base is the directory that the patterns are relative to, relative to the search root (e.g., "" for the root itself).
+//Blank lines and lines starting with # are ignored, as in a .gitignore file.
+func (matcher *IgnoreMatcher) WithPatterns(base string, lines []string) *IgnoreMatcher {
+	newMatcher := &IgnoreMatcher{}
+	if matcher != nil {
+		newMatcher.patterns = append(newMatcher.patterns, matcher.patterns...)
+	}
+	base = strings.Trim(filepath.ToSlash(base), "/")
+	if base == "." {
+		base = ""
+	}
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := ignorePattern{base: base}
+		if strings.HasPrefix(line, "!") {
+			pattern.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, "./")
+		if strings.HasSuffix(line, "/") {
+			pattern.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		re, err := compileIgnorePattern(line)
+		if err != nil {
+			continue //like git, ignore invalid patterns
+		}
+		pattern.regexp = re
+		newMatcher.patterns = append(newMatcher.patterns, pattern)
+	}
+	return newMatcher
+}
+
+//WithIgnoreFile returns a new IgnoreMatcher with the patterns in the given file (e.g., a .gitignore) added,
+//relative to base (see WithPatterns). If the file does not exist, the matcher is returned unchanged.
+func (matcher *IgnoreMatcher) WithIgnoreFile(base string, path string) (*IgnoreMatcher, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return matcher, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return matcher.WithPatterns(base, lines), nil
+}
+
+//WithDirectoryIgnoreFiles returns a new IgnoreMatcher with the patterns of the .gitignore and .sanicignore files
+//in dir added, relative to base (the path of dir relative to the search root)
+func (matcher *IgnoreMatcher) WithDirectoryIgnoreFiles(base string, dir string) (*IgnoreMatcher, error) {
+	var err error
+	for _, ignoreFileName := range ignoreFileNames {
+		matcher, err = matcher.WithIgnoreFile(base, filepath.Join(dir, ignoreFileName))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matcher, nil
+}
+
+//Ignored returns whether the given path (relative to the search root) is ignored
+func (matcher *IgnoreMatcher) Ignored(path string, isDir bool) bool {
+	if matcher == nil {
+		return false
+	}
+	path = filepath.ToSlash(path)
+	ignored := false
+	for _, pattern := range matcher.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		relPath := path
+		if pattern.base != "" {
+			if !strings.HasPrefix(path, pattern.base+"/") {
+				continue
+			}
+			relPath = strings.TrimPrefix(path, pattern.base+"/")
+		}
+		if pattern.regexp.MatchString(relPath) {
+			ignored = !pattern.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,127 @@
+package util
+
+import "testing"
+
+func TestIgnoreMatcher(t *testing.T) {
+	type check struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}
+	tests := []struct {
+		name     string
+		base     string
+		patterns []string
+		checks   []check
+	}{
+		{
+			name:     "unanchored name",
+			patterns: []string{"node_modules"},
+			checks: []check{
+				{path: "node_modules", isDir: true, ignored: true},
+				{path: "web/node_modules", isDir: true, ignored: true},
+				{path: "web/node_modules_old", isDir: true},
+			},
+		},
+		{
+			name:     "anchored",
+			patterns: []string{"/build", "docs/*.md"},
+			checks: []check{
+				{path: "build", isDir: true, ignored: true},
+				{path: "web/build", isDir: true},
+				{path: "docs/a.md", ignored: true},
+				{path: "docs/sub/a.md"},
+				{path: "web/docs/a.md"},
+			},
+		},
+		{
+			name:     "directories only",
+			patterns: []string{"out/"},
+			checks: []check{
+				{path: "out", isDir: true, ignored: true},
+				{path: "out"},
+			},
+		},
+		{
+			name:     "wildcards",
+			patterns: []string{"*.log", "tmp?", "[ab].txt", "[!c]x.txt"},
+			checks: []check{
+				{path: "a/b/debug.log", ignored: true},
+				{path: "debug.log.gz"},
+				{path: "tmp1", ignored: true},
+				{path: "tmp12"},
+				{path: "b.txt", ignored: true},
+				{path: "c.txt"},
+				{path: "dx.txt", ignored: true},
+				{path: "cx.txt"},
+			},
+		},
+		{
+			name:     "double stars",
+			patterns: []string{"**/cache", "vendor/**", "a/**/z"},
+			checks: []check{
+				{path: "cache", isDir: true, ignored: true},
+				{path: "x/y/cache", isDir: true, ignored: true},
+				{path: "vendor/x/y", ignored: true},
+				{path: "vendor", isDir: true},
+				{path: "a/z", ignored: true},
+				{path: "a/b/c/z", ignored: true},
+			},
+		},
+		{
+			name:     "negation, where the last match wins",
+			patterns: []string{"*.log", "!keep.log", "# a comment", "", "!#literal", `\!important`},
+			checks: []check{
+				{path: "x.log", ignored: true},
+				{path: "keep.log"},
+				{path: "!important", ignored: true},
+			},
+		},
+		{
+			name:     "relative to a base directory",
+			base:     "services/web",
+			patterns: []string{"dist", "/local"},
+			checks: []check{
+				{path: "services/web/dist", isDir: true, ignored: true},
+				{path: "services/web/src/dist", isDir: true, ignored: true},
+				{path: "services/web/local", isDir: true, ignored: true},
+				{path: "services/web/src/local", isDir: true},
+				{path: "dist", isDir: true},
+				{path: "services/webapp/dist", isDir: true},
+			},
+		},
+		{
+			name: "no patterns",
+			checks: []check{
+				{path: "anything"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var matcher *IgnoreMatcher
+			if test.patterns != nil {
+				matcher = matcher.WithPatterns(test.base, test.patterns)
+			}
+			for _, check := range test.checks {
+				if ignored := matcher.Ignored(check.path, check.isDir); ignored != check.ignored {
+					t.Errorf("%s (dir: %t): ignored is %t, want %t", check.path, check.isDir, ignored, check.ignored)
+				}
+			}
+		})
+	}
+}
+
+func TestIgnoreMatcherInheritsPatterns(t *testing.T) {
+	root := (*IgnoreMatcher)(nil).WithPatterns("", []string{"*.tmp"})
+	child := root.WithPatterns("web", []string{"!keep.tmp"})
+	if !root.Ignored("web/keep.tmp", false) {
+		t.Error("adding patterns changed the matcher they were added to")
+	}
+	if child.Ignored("web/keep.tmp", false) {
+		t.Error("the child's negation did not re-include web/keep.tmp")
+	}
+	if !child.Ignored("other/keep.tmp", false) {
+		t.Error("the child's negation applied outside of its base directory")
+	}
+}
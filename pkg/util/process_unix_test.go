@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package util
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestWaitCmdContextuallyKillsProcessGroup(t *testing.T) {
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdoutReader.Close()
+	//the shell's child keeps stdout open unless it is killed too
+	cmd := exec.Command("sh", "-c", "sleep 60; echo done")
+	cmd.Stdout = stdoutWriter
+	SetProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	stdoutWriter.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := WaitCmdContextually(ctx, cmd); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	outputClosed := make(chan struct{})
+	go func() {
+		ioutil.ReadAll(stdoutReader)
+		close(outputClosed)
+	}()
+	select {
+	case <-outputClosed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the output of the command is still open, so its child was not killed")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package util
+
+import "os/exec"
+
+//SetProcessGroup does nothing, since process groups are only supported on unix
+func SetProcessGroup(cmd *exec.Cmd) {
+}
+
+//killProcess kills a started command
+func killProcess(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
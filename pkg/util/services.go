@@ -1,10 +1,13 @@
 package util
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
-	"fmt"
+	"sync"
 )
 
 type BuildableService struct {
@@ -13,43 +16,225 @@ type BuildableService struct {
 	Name       string
 }
 
+//serviceFinder walks a directory tree concurrently to find services
+type serviceFinder struct {
+	root     string
+	mutex    sync.Mutex
+	wg       sync.WaitGroup
+	sem      chan interface{}
+	services []BuildableService
+	visited  map[string]bool //real paths of directories which have already been walked, to avoid symlink loops
+	symlinks []pendingDir    //symlinked directories, which are walked after every real directory
+	err      error
+}
+
+type pendingDir struct {
+	path    string
+	matcher *IgnoreMatcher
+}
+
+func (finder *serviceFinder) setErr(err error) {
+	finder.mutex.Lock()
+	defer finder.mutex.Unlock()
+	if finder.err == nil {
+		finder.err = err
+	}
+}
+
+//markVisited returns false if the directory (after resolving symlinks) was already walked
+func (finder *serviceFinder) markVisited(dir string) bool {
+	realPath, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		realPath = dir
+	}
+	finder.mutex.Lock()
+	defer finder.mutex.Unlock()
+	if finder.visited[realPath] {
+		return false
+	}
+	finder.visited[realPath] = true
+	return true
+}
+
+//walk searches a directory, which must already be marked as visited
+func (finder *serviceFinder) walk(dir string, matcher *IgnoreMatcher) {
+	defer finder.wg.Done()
+
+	finder.sem <- true
+	relDir, err := filepath.Rel(finder.root, dir)
+	if err == nil {
+		matcher, err = matcher.WithDirectoryIgnoreFiles(relDir, dir)
+	}
+	var entries []os.FileInfo
+	if err == nil {
+		entries, err = ioutil.ReadDir(dir)
+	}
+	<-finder.sem
+	if err != nil {
+		finder.setErr(err)
+		return
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		relPath := filepath.Join(relDir, entry.Name())
+		isSymlink := entry.Mode()&os.ModeSymlink != 0
+		if isSymlink {
+			target, err := os.Stat(path)
+			if err != nil {
+				continue //broken symlink
+			}
+			entry = target
+		}
+		if entry.IsDir() {
+			if entry.Name() == ".git" || matcher.Ignored(relPath, true) {
+				continue
+			}
+			if isSymlink {
+				finder.mutex.Lock()
+				finder.symlinks = append(finder.symlinks, pendingDir{path: path, matcher: matcher})
+				finder.mutex.Unlock()
+			} else if finder.markVisited(path) {
+				finder.wg.Add(1)
+				go finder.walk(path, matcher)
+			}
+			continue
+		}
+		if matcher.Ignored(relPath, false) {
+			continue
+		}
+
+		var service BuildableService
+		if entry.Name() == "Dockerfile" {
+			service = BuildableService{
+				Dir:        dir,
+				Dockerfile: "Dockerfile",
+				Name:       filepath.Base(dir),
+			}
+		} else if strings.HasSuffix(entry.Name(), ".Dockerfile") {
+			service = BuildableService{
+				Dir:        dir,
+				Dockerfile: entry.Name(),
+				Name:       filepath.Base(dir) + "-" + strings.TrimSuffix(entry.Name(), ".Dockerfile"),
+			}
+		} else {
+			continue
+		}
+		finder.mutex.Lock()
+		finder.services = append(finder.services, service)
+		finder.mutex.Unlock()
+	}
+}
+
 //FindServices finds all of the buildable services in the given directory
 //(e.g., folders which contain a Dockerfile)
-func FindServices(dir string, ignorePaths []string) ([]BuildableService, error) {
+//ignorePatterns are .gitignore-style patterns relative to dir (e.g., node_modules, some/directory or **/fixtures),
+//and the patterns in any .gitignore or .sanicignore files are ignored as well.
+//Symlinks to directories are followed, but every directory is only searched once.
+func FindServices(dir string, ignorePatterns []string) ([]BuildableService, error) {
 	dir, err := filepath.Abs(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	var ret []BuildableService
-
-	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			fmt.Println(err)
-			return err
-		}
-		for _, ignorePath := range ignorePaths {
-			if filepath.Clean(filepath.Join(dir, ignorePath)) == path {
-				return filepath.SkipDir
+	finder := &serviceFinder{
+		root:    dir,
+		sem:     make(chan interface{}, 4*runtime.NumCPU()),
+		visited: make(map[string]bool),
+	}
+	finder.markVisited(dir)
+	finder.wg.Add(1)
+	finder.walk(dir, (&IgnoreMatcher{}).WithPatterns("", ignorePatterns))
+	finder.wg.Wait()
+	//symlinks are walked last (and in order), so that services are found at the same paths every time
+	for len(finder.symlinks) > 0 && finder.err == nil {
+		symlinks := finder.symlinks
+		finder.symlinks = nil
+		sort.Slice(symlinks, func(i, j int) bool {
+			return symlinks[i].path < symlinks[j].path
+		})
+		for _, symlink := range symlinks {
+			if finder.markVisited(symlink.path) {
+				finder.wg.Add(1)
+				go finder.walk(symlink.path, symlink.matcher)
 			}
 		}
+		finder.wg.Wait()
+	}
+	if finder.err != nil {
+		return nil, finder.err
+	}
 
-		if info.Name() == "Dockerfile" {
-			ret = append(ret, BuildableService{
-				Dir:        filepath.Dir(path),
-				Dockerfile: "Dockerfile",
-				Name:       filepath.Base(filepath.Dir(path)),
-			})
-		} else if strings.HasSuffix(info.Name(), ".Dockerfile") {
-			name := filepath.Base(filepath.Dir(path)) + "-" + strings.TrimSuffix(info.Name(), ".Dockerfile")
-			ret = append(ret, BuildableService{
-				Dir:        filepath.Dir(path),
-				Dockerfile: info.Name(),
-				Name:       name,
-			})
-		}
-		return nil
+	sort.Slice(finder.services, func(i, j int) bool {
+		return filepath.Join(finder.services[i].Dir, finder.services[i].Dockerfile) <
+			filepath.Join(finder.services[j].Dir, finder.services[j].Dockerfile)
 	})
+	return finder.services, nil
+}
 
-	return ret, err
+//SelectServices filters the given services (found in rootDir) down to the ones matched by any of the selectors.
+//A selector can be:
+// - a service name, e.g., web
+// - a glob of service names, e.g., svc-*
+// - a path relative to rootDir (or to the current directory, if it starts with ./ or ../), e.g., services/web
+// - a path prefix ending with /..., which matches every service beneath it, e.g., services/backend/...
+//The selectors which did not match any service are returned as unmatched.
+func SelectServices(rootDir string, services []BuildableService, selectors []string) (selected []BuildableService, unmatched []string) {
+	matched := make([]bool, len(services))
+	for _, selector := range selectors {
+		found := false
+		for i, service := range services {
+			if serviceMatchesSelector(rootDir, service, selector) {
+				matched[i] = true
+				found = true
+			}
+		}
+		if !found {
+			unmatched = append(unmatched, selector)
+		}
+	}
+	for i, service := range services {
+		if matched[i] {
+			selected = append(selected, service)
+		}
+	}
+	return
+}
+
+func serviceMatchesSelector(rootDir string, service BuildableService, selector string) bool {
+	if !strings.ContainsRune(selector, filepath.Separator) && selector != "." && selector != ".." && selector != "..." {
+		if ok, err := filepath.Match(selector, service.Name); err == nil && ok {
+			return true
+		}
+		return false
+	}
+
+	recursive := false
+	if selector == "..." || strings.HasSuffix(selector, string(filepath.Separator)+"...") {
+		recursive = true
+		selector = strings.TrimSuffix(strings.TrimSuffix(selector, "..."), string(filepath.Separator))
+	}
+
+	var selectorPath string
+	if filepath.IsAbs(selector) {
+		selectorPath = filepath.Clean(selector)
+	} else if selector == "." || selector == ".." || strings.HasPrefix(selector, "./") || strings.HasPrefix(selector, "../") {
+		abs, err := filepath.Abs(selector)
+		if err != nil {
+			return false
+		}
+		selectorPath = abs
+	} else {
+		selectorPath = filepath.Join(rootDir, selector)
+	}
+
+	if recursive {
+		rel, err := filepath.Rel(selectorPath, service.Dir)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+	if ok, err := filepath.Match(selectorPath, service.Dir); err == nil && ok {
+		return true
+	}
+	ok, err := filepath.Match(selectorPath, filepath.Join(service.Dir, service.Dockerfile))
+	return err == nil && ok
 }
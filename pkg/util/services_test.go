@@ -0,0 +1,52 @@
+package util
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSelectServices(t *testing.T) {
+	root := filepath.FromSlash("/repo")
+	services := []BuildableService{
+		{Name: "api", Dir: filepath.Join(root, "services", "backend", "api"), Dockerfile: "Dockerfile"},
+		{Name: "svc-auth", Dir: filepath.Join(root, "services", "backend", "auth"), Dockerfile: "Dockerfile"},
+		{Name: "svc-web", Dir: filepath.Join(root, "services", "web"), Dockerfile: "docker/Dockerfile.prod"},
+		{Name: "tools", Dir: filepath.Join(root, "tools"), Dockerfile: "Dockerfile"},
+	}
+	tests := []struct {
+		name      string
+		selectors []string
+		selected  []string
+		unmatched []string
+	}{
+		{name: "name", selectors: []string{"api"}, selected: []string{"api"}},
+		{name: "glob", selectors: []string{"svc-*"}, selected: []string{"svc-auth", "svc-web"}},
+		{name: "in the order of the services", selectors: []string{"tools", "api"}, selected: []string{"api", "tools"}},
+		{name: "overlapping", selectors: []string{"svc-*", "svc-web"}, selected: []string{"svc-auth", "svc-web"}},
+		{name: "directory", selectors: []string{filepath.FromSlash("services/web")}, selected: []string{"svc-web"}},
+		{name: "directory glob", selectors: []string{filepath.FromSlash("services/backend/*")}, selected: []string{"api", "svc-auth"}},
+		{name: "dockerfile", selectors: []string{filepath.FromSlash("services/web/docker/Dockerfile.prod")}, selected: []string{"svc-web"}},
+		{name: "recursive", selectors: []string{filepath.FromSlash("services/...")}, selected: []string{"api", "svc-auth", "svc-web"}},
+		{name: "absolute and recursive", selectors: []string{filepath.Join(root, "services", "backend", "...")}, selected: []string{"api", "svc-auth"}},
+		{name: "a directory is not a prefix", selectors: []string{filepath.FromSlash("services/back...")}, unmatched: []string{filepath.FromSlash("services/back...")}},
+		{name: "a name is not a path", selectors: []string{"web"}, unmatched: []string{"web"}},
+		{name: "unmatched", selectors: []string{"api", "nope-*"}, selected: []string{"api"}, unmatched: []string{"nope-*"}},
+		{name: "invalid glob", selectors: []string{"svc-["}, unmatched: []string{"svc-["}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selected, unmatched := SelectServices(root, services, test.selectors)
+			var names []string
+			for _, service := range selected {
+				names = append(names, service.Name)
+			}
+			if !reflect.DeepEqual(names, test.selected) {
+				t.Errorf("selected %v, want %v", names, test.selected)
+			}
+			if !reflect.DeepEqual(unmatched, test.unmatched) {
+				t.Errorf("unmatched %v, want %v", unmatched, test.unmatched)
+			}
+		})
+	}
+}
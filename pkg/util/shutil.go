@@ -17,7 +17,7 @@ func ExpandUser(s string) (string, error) {
 		return homedir + "/" + s[2:], nil
 	}
 	if s[0] == '~' {
-		return "", fmt.Errorf("Unrecognized path type: %s, did not expect it to start with ~, s")
+		return "", fmt.Errorf("Unrecognized path type: %s, did not expect it to start with ~", s)
 	}
 	return s, nil
 }
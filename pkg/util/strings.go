@@ -0,0 +1,11 @@
+package util
+
+//StringInSlice returns whether s is one of the elements of slice
+func StringInSlice(s string, slice []string) bool {
+	for _, elem := range slice {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
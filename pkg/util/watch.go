@@ -0,0 +1,188 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//FileWatcher watches a directory tree for changes, skipping ignored directories and files
+type FileWatcher struct {
+	root      string
+	watcher   *fsnotify.Watcher
+	matchers  map[string]*IgnoreMatcher //watched directory -> the matcher for the files in it
+	realPaths map[string]string         //watched directory -> its real path
+	visited   map[string]bool           //real paths of watched directories, to avoid symlink loops
+}
+
+//NewFileWatcher starts watching root and every directory beneath it.
+//ignorePatterns and the patterns of any .gitignore or .sanicignore files are ignored, as in FindServices.
+func NewFileWatcher(root string, ignorePatterns []string) (*FileWatcher, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("could not start watching for file changes: %s", err.Error())
+	}
+	watcher := &FileWatcher{
+		root:      root,
+		watcher:   fsWatcher,
+		matchers:  make(map[string]*IgnoreMatcher),
+		realPaths: make(map[string]string),
+		visited:   make(map[string]bool),
+	}
+	if err := watcher.watchTree(root, (&IgnoreMatcher{}).WithPatterns("", ignorePatterns)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return watcher, nil
+}
+
+//watchTree adds a watch to dir and (recursively) every directory beneath it which is not ignored
+func (watcher *FileWatcher) watchTree(dir string, matcher *IgnoreMatcher) error {
+	realPath, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil //removed since the event about it
+	}
+	if watcher.visited[realPath] {
+		return nil
+	}
+	watcher.visited[realPath] = true
+
+	relDir, err := filepath.Rel(watcher.root, dir)
+	if err != nil {
+		return err
+	}
+	matcher, err = matcher.WithDirectoryIgnoreFiles(relDir, dir)
+	if err != nil {
+		return err
+	}
+	err = watcher.watcher.Add(dir)
+	if err == syscall.ENOSPC {
+		return fmt.Errorf("too many directories to watch, try increasing fs.inotify.max_user_watches or adding some to ignoreDirs")
+	}
+	if err != nil {
+		return fmt.Errorf("could not watch %s: %s", dir, err.Error())
+	}
+	watcher.matchers[dir] = matcher
+	watcher.realPaths[dir] = realPath
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil //removed since it was watched
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.Mode()&os.ModeSymlink != 0 {
+			if entry, err = os.Stat(path); err != nil {
+				continue //broken symlink
+			}
+		}
+		if !entry.IsDir() || entry.Name() == ".git" || matcher.Ignored(filepath.Join(relDir, entry.Name()), true) {
+			continue
+		}
+		if err := watcher.watchTree(path, matcher); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//unwatchTree forgets about a watched directory which was removed or moved away, and every directory beneath it
+func (watcher *FileWatcher) unwatchTree(dir string) {
+	for watchedDir := range watcher.matchers {
+		if watchedDir == dir || strings.HasPrefix(watchedDir, dir+string(os.PathSeparator)) {
+			watcher.watcher.Remove(watchedDir) //already removed by the os if it was deleted
+			delete(watcher.visited, watcher.realPaths[watchedDir])
+			delete(watcher.realPaths, watchedDir)
+			delete(watcher.matchers, watchedDir)
+		}
+	}
+}
+
+//changedPath returns the path that an event is about, or "" if it is ignored.
+//New directories are watched, and directories which are removed or moved away are not watched anymore.
+func (watcher *FileWatcher) changedPath(event fsnotify.Event) (string, error) {
+	path := filepath.Clean(event.Name)
+	_, wasWatched := watcher.matchers[path]
+	if wasWatched && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		watcher.unwatchTree(path)
+	}
+	if path == watcher.root {
+		return path, nil
+	}
+	dir := filepath.Dir(path)
+	matcher, ok := watcher.matchers[dir]
+	if !ok {
+		return "", nil //its directory was removed since
+	}
+
+	isDir := wasWatched
+	if info, err := os.Stat(path); err == nil {
+		isDir = info.IsDir()
+	}
+	relPath, err := filepath.Rel(watcher.root, path)
+	if err != nil || filepath.Base(path) == ".git" || matcher.Ignored(relPath, isDir) {
+		return "", nil
+	}
+	if isDir && event.Op&fsnotify.Create != 0 {
+		if err := watcher.watchTree(path, matcher); err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+//Next waits for files to change, and then until no more have changed for the given quiet period (to debounce
+//bursts of changes, e.g., from a git checkout). It returns the absolute paths which changed, or ctx's error if it
+//is cancelled first.
+func (watcher *FileWatcher) Next(ctx context.Context, quietPeriod time.Duration) ([]string, error) {
+	changedSet := make(map[string]bool)
+	var changed []string
+	addChanged := func(path string) {
+		if !changedSet[path] {
+			changedSet[path] = true
+			changed = append(changed, path)
+		}
+	}
+	quiet := time.NewTimer(quietPeriod)
+	quiet.Stop()
+	defer quiet.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-quiet.C:
+			return changed, nil
+		case err := <-watcher.watcher.Errors:
+			if err != fsnotify.ErrEventOverflow {
+				return nil, err
+			}
+			//some events were lost, so anything could have changed
+			addChanged(watcher.root)
+		case event := <-watcher.watcher.Events:
+			path, err := watcher.changedPath(event)
+			if err != nil {
+				return nil, err
+			}
+			if path == "" {
+				continue
+			}
+			addChanged(path)
+		}
+		quiet.Reset(quietPeriod)
+	}
+}
+
+//Close stops watching for changes
+func (watcher *FileWatcher) Close() error {
+	return watcher.watcher.Close()
+}